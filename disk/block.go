@@ -0,0 +1,207 @@
+package disk
+
+import (
+	"LsmStorageEngine/types"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// every restartInterval-th key of a block is stored in full
+const restartInterval = 16
+
+/*
+blockBuilder writes a data block of the prefix format. A key only stores
+the part that differs from the key before it,
+
+	| shared (uvarint) | unshared (uvarint) | value length (uvarint) |
+	| key suffix | value | tombstone (1) | sequence number (8) |
+
+and every restartInterval-th key is stored in full as a restart point. The
+block ends in the offsets of its restart points and their count, each a
+little endian uint32, so a reader can binary search the restart points.
+*/
+type blockBuilder struct {
+	buffer   []byte
+	restarts []uint32
+	counter  int
+	lastKey  []byte
+}
+
+func (b *blockBuilder) add(record types.Record) {
+	shared := 0
+	if b.counter%restartInterval == 0 {
+		b.restarts = append(b.restarts, uint32(len(b.buffer)))
+	} else {
+		for shared < len(b.lastKey) && shared < len(record.Key) && b.lastKey[shared] == record.Key[shared] {
+			shared++
+		}
+	}
+
+	b.buffer = binary.AppendUvarint(b.buffer, uint64(shared))
+	b.buffer = binary.AppendUvarint(b.buffer, uint64(len(record.Key)-shared))
+	b.buffer = binary.AppendUvarint(b.buffer, uint64(len(record.Value)))
+	b.buffer = append(b.buffer, record.Key[shared:]...)
+	b.buffer = append(b.buffer, record.Value...)
+
+	var tombStone byte
+	if record.TombStone {
+		tombStone = 1
+	}
+	b.buffer = append(b.buffer, tombStone)
+	b.buffer = binary.LittleEndian.AppendUint64(b.buffer, record.SeqNum)
+
+	b.lastKey = record.Key
+	b.counter++
+}
+
+// size of the entries written so far
+func (b *blockBuilder) size() int {
+	return len(b.buffer)
+}
+
+func (b *blockBuilder) finish() []byte {
+	for _, restart := range b.restarts {
+		b.buffer = binary.LittleEndian.AppendUint32(b.buffer, restart)
+	}
+
+	return binary.LittleEndian.AppendUint32(b.buffer, uint32(len(b.restarts)))
+}
+
+func blockCorrupted(reason string) error {
+	return types.NewEngineError(
+		types.TABLE_RECORD_READ_ERROR,
+		fmt.Sprintf("malformed data block : %s", reason),
+	)
+}
+
+// splits a block of the prefix format into its entries and restart offsets
+func splitPrefixBlock(block []byte) ([]byte, []uint32, error) {
+	if len(block) < 4 {
+		return nil, nil, blockCorrupted("missing restart count")
+	}
+
+	count := int(binary.LittleEndian.Uint32(block[len(block)-4:]))
+	trailer := 4 * (count + 1)
+
+	if count == 0 || trailer > len(block) {
+		return nil, nil, blockCorrupted(fmt.Sprintf("bad restart count %d", count))
+	}
+
+	entries := block[:len(block)-trailer]
+	restarts := make([]uint32, count)
+	for i := range restarts {
+		restarts[i] = binary.LittleEndian.Uint32(block[len(entries)+4*i:])
+
+		if int(restarts[i]) >= len(entries) {
+			return nil, nil, blockCorrupted(fmt.Sprintf("restart point %d past the entries", restarts[i]))
+		}
+	}
+
+	return entries, restarts, nil
+}
+
+// decodes the entry at the start of entries given the key before it, and
+// returns what is left after it
+func decodePrefixEntry(entries []byte, lastKey []byte) (types.Record, []byte, error) {
+	var header [3]uint64
+	for i := range header {
+		value, n := binary.Uvarint(entries)
+		if n <= 0 {
+			return types.Record{}, nil, blockCorrupted("bad entry header")
+		}
+
+		header[i] = value
+		entries = entries[n:]
+	}
+
+	// lengths are checked one at a time, a sum of them may wrap around
+	shared, unshared, valueLength := header[0], header[1], header[2]
+	remaining := uint64(len(entries))
+	if shared > uint64(len(lastKey)) || remaining < 9 || unshared > remaining-9 || valueLength > remaining-9-unshared {
+		return types.Record{}, nil, blockCorrupted("entry runs past the block")
+	}
+
+	key := make([]byte, 0, shared+unshared)
+	key = append(append(key, lastKey[:shared]...), entries[:unshared]...)
+	entries = entries[unshared:]
+
+	value := append([]byte{}, entries[:valueLength]...)
+	entries = entries[valueLength:]
+
+	record := types.NewRecordWithSeqNum(key, value, entries[0] == 1, binary.LittleEndian.Uint64(entries[1:]))
+
+	return record, entries[9:], nil
+}
+
+func decodePrefixEntries(entries []byte) ([]types.Record, error) {
+	var records []types.Record
+	var lastKey []byte
+
+	for len(entries) != 0 {
+		record, rest, err := decodePrefixEntry(entries, lastKey)
+		if err != nil {
+			return nil, err
+		}
+
+		records = append(records, record)
+		lastKey = record.Key
+		entries = rest
+	}
+
+	return records, nil
+}
+
+// every record of a data block written in formatVersion
+func decodeBlock(block []byte, formatVersion int) ([]types.Record, error) {
+	if formatVersion == unsequencedFormatVersion {
+		return types.DecodeUnsequencedRecordsFromBuffer(bytes.NewReader(block))
+	}
+
+	if formatVersion < prefixFormatVersion {
+		return types.DecodeRecordsFromBuffer(bytes.NewReader(block))
+	}
+
+	entries, _, err := splitPrefixBlock(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodePrefixEntries(entries)
+}
+
+/*
+the records of a data block from the last restart point before key on, so
+the first record with the key is among them. blocks of the prefix format are
+binary searched over their restart points, older blocks are decoded whole.
+*/
+func seekBlock(block []byte, key []byte, formatVersion int) ([]types.Record, error) {
+	if formatVersion < prefixFormatVersion {
+		return decodeBlock(block, formatVersion)
+	}
+
+	entries, restarts, err := splitPrefixBlock(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// the last restart point whose key is < key, versions of key may start
+	// before a restart point holding key itself
+	start, end := 0, len(restarts)-1
+	for start < end {
+		mid := (start + end + 1) / 2
+
+		record, _, err := decodePrefixEntry(entries[restarts[mid]:], nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if bytes.Compare(record.Key, key) < 0 {
+			start = mid
+		} else {
+			end = mid - 1
+		}
+	}
+
+	return decodePrefixEntries(entries[restarts[start]:])
+}
@@ -0,0 +1,90 @@
+package disk
+
+import (
+	"LsmStorageEngine/types"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrefixBlockRoundTrip(t *testing.T) {
+	var records []types.Record
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("tenant/%03d/user/%03d", i/10, i))
+		records = append(records, types.NewRecordWithSeqNum(key, []byte(fmt.Sprintf("v%d", i)), i%7 == 0, uint64(i)))
+	}
+
+	builder := &blockBuilder{}
+	for _, record := range records {
+		builder.add(record)
+	}
+	block := builder.finish()
+
+	// the shared prefixes are not repeated
+	assert.Less(t, len(block), len(NewDataBlock(records).Encode())/2)
+
+	decoded, err := decodeBlock(block, prefixFormatVersion)
+	assert.NoError(t, err)
+	assert.Equal(t, records, decoded)
+
+	_, restarts, err := splitPrefixBlock(block)
+	assert.NoError(t, err)
+	assert.Len(t, restarts, (len(records)+restartInterval-1)/restartInterval)
+
+	for i, record := range records {
+		seeked, err := seekBlock(block, record.Key, prefixFormatVersion)
+		assert.NoError(t, err)
+		assert.Contains(t, seeked, records[i])
+	}
+}
+
+func TestPrefixBlockSeekFindsEveryVersion(t *testing.T) {
+	var records []types.Record
+	for seqNum := uint64(40); seqNum > 0; seqNum-- {
+		records = append(records, types.NewRecordWithSeqNum([]byte("key"), []byte(fmt.Sprintf("v%d", seqNum)), false, seqNum))
+	}
+
+	builder := &blockBuilder{}
+	for _, record := range records {
+		builder.add(record)
+	}
+
+	// restart points in the middle of the versions hold the key as well
+	seeked, err := seekBlock(builder.finish(), []byte("key"), prefixFormatVersion)
+	assert.NoError(t, err)
+	assert.Equal(t, records, seeked)
+}
+
+func TestPrefixBlockCorrupted(t *testing.T) {
+	builder := &blockBuilder{}
+	builder.add(types.NewRecord([]byte("k1"), []byte("v1"), false))
+	block := builder.finish()
+
+	_, err := decodeBlock(block[:len(block)-1], prefixFormatVersion)
+	assert.Error(t, err)
+
+	_, err = decodeBlock(block[3:], prefixFormatVersion)
+	assert.Error(t, err)
+}
+
+func TestPrefixEntryLengthsDoNotWrapAround(t *testing.T) {
+	// the lengths add up to less than the entry holds once they wrap
+	for _, lengths := range [][2]uint64{
+		{math.MaxUint64 - 8, 1},
+		{1, math.MaxUint64 - 8},
+		{math.MaxUint64, math.MaxUint64},
+	} {
+		entry := binary.AppendUvarint(nil, 0)
+		entry = binary.AppendUvarint(entry, lengths[0])
+		entry = binary.AppendUvarint(entry, lengths[1])
+		entry = append(entry, make([]byte, 16)...)
+
+		_, _, err := decodePrefixEntry(entry, nil)
+		if assert.Error(t, err, "%v", lengths) {
+			assert.Equal(t, types.TABLE_RECORD_READ_ERROR, err.(*types.EngineError).GetErrorCode())
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package disk
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/spaolacci/murmur3"
+)
+
+// bytes of a block, one cache line
+const filterBlockSize = 64
+
+/*
+blockedBloomFilter hashes a key once. The hash picks one 64 byte block and
+every probe of the key lands inside it, derived from the hash by double
+hashing, so a lookup touches a single cache line instead of one per hash
+function. It is serialized as
+
+	| blocks | probe count (1) |
+*/
+type blockedBloomFilter struct {
+	blocks []byte
+	probes int
+}
+
+func newBlockedBloomFilter(keyCount int, bitsPerKey int) *blockedBloomFilter {
+	blockCount := max((keyCount*bitsPerKey+8*filterBlockSize-1)/(8*filterBlockSize), 1)
+
+	return &blockedBloomFilter{
+		blocks: make([]byte, blockCount*filterBlockSize),
+		probes: min(max(int(math.Round(float64(bitsPerKey)*math.Ln2)), 1), 30),
+	}
+}
+
+func decodeBlockedBloomFilter(buffer []byte) (*blockedBloomFilter, error) {
+	if len(buffer) <= filterBlockSize || (len(buffer)-1)%filterBlockSize != 0 {
+		return nil, fmt.Errorf("size %d is not a whole number of blocks", len(buffer))
+	}
+
+	probes := int(buffer[len(buffer)-1])
+	if probes == 0 {
+		return nil, fmt.Errorf("no probes")
+	}
+
+	return &blockedBloomFilter{blocks: buffer[:len(buffer)-1], probes: probes}, nil
+}
+
+// the block of the key and the bits of its probes
+func (bf *blockedBloomFilter) locate(key []byte, visit func(block []byte, bit uint32) bool) bool {
+	hash := murmur3.Sum64(key)
+	blockCount := uint64(len(bf.blocks) / filterBlockSize)
+
+	// the upper half picks the block, the lower half the probes
+	blockIndex := (hash >> 32) * blockCount >> 32
+	block := bf.blocks[blockIndex*filterBlockSize : (blockIndex+1)*filterBlockSize]
+
+	h := uint32(hash)
+	delta := h>>17 | h<<15
+	for i := 0; i < bf.probes; i++ {
+		if !visit(block, h%(8*filterBlockSize)) {
+			return false
+		}
+
+		h += delta
+	}
+
+	return true
+}
+
+func (bf *blockedBloomFilter) put(key []byte) {
+	bf.locate(key, func(block []byte, bit uint32) bool {
+		block[bit/8] |= 1 << (bit % 8)
+		return true
+	})
+}
+
+func (bf *blockedBloomFilter) ContainsKey(key []byte) (bool, error) {
+	return bf.locate(key, func(block []byte, bit uint32) bool {
+		return block[bit/8]&(1<<(bit%8)) != 0
+	}), nil
+}
+
+func (bf *blockedBloomFilter) serialize() []byte {
+	return append(append([]byte{}, bf.blocks...), byte(bf.probes))
+}
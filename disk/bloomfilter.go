@@ -12,12 +12,47 @@ import (
 type BloomFilter struct {
 	// the biet set vector where we map an input x as h1(x) | h2(x) | .... | hk(x)
 	bitSet types.BitVector
-	// the size of this bitset (m) = -n*ln(p) / (ln(2)^2), where n is the no of elements and p is the error rate
+	// the number of bits keys are hashed onto. legacy filters have a bitset of
+	// (m) = -n*ln(p) / (ln(2)^2), where n is the no of elements and p is the error rate,
+	// but only hash onto its first m/8 bits
 	bitSetSize int
 	// the no of has functions (k) = m/n * ln(2)
 	hashFunctionCount int
 }
 
+// bits per key of the filters of new tables, about a 1% false positive rate
+const DefaultBloomBitsPerKey = 10
+
+/*
+NewBloomFilterForKeys sizes a filter for keyCount keys at bitsPerKey bits
+each, hashing every key with the number of functions that gives the lowest
+false positive rate for that many bits per key.
+*/
+func NewBloomFilterForKeys(keyCount int, bitsPerKey int) BloomFilter {
+	bits := max(keyCount*bitsPerKey, 64)
+	hashFunctionCount := min(max(int(math.Round(float64(bitsPerKey)*math.Ln2)), 1), 30)
+
+	return BloomFilter{
+		bitSet:            types.NewBitVector(bits),
+		bitSetSize:        bits,
+		hashFunctionCount: hashFunctionCount,
+	}
+}
+
+// the bits per key that keep the false positive rate at about p
+func BitsPerKeyForErrorRate(p float64) int {
+	return max(int(math.Ceil(-math.Log(p)/(math.Ln2*math.Ln2))), 1)
+}
+
+// a filter from its serialized bitset and the parameters it was built with
+func NewBloomFilterFromBuffer(buffer []byte, bitCount int, hashFunctionCount int) BloomFilter {
+	return BloomFilter{
+		bitSet:            types.NewBitSetVectorFromBytes(&buffer),
+		bitSetSize:        bitCount,
+		hashFunctionCount: hashFunctionCount,
+	}
+}
+
 func NewBloomFilter(n float64, p float64) BloomFilter {
 	m := (-1 * n * math.Round(math.Log(p))) / math.Pow(math.Log(2), 2)
 	k := (m / n) * math.Log(2)
@@ -65,6 +100,17 @@ func ReconstructBloomFilterFromFile(file *os.File, n float64, p float64) (BloomF
 	return bf, nil
 }
 
+func ReconstructBloomFilterFromBuffer(buffer []byte, n float64, p float64) BloomFilter {
+	m := (-1 * n * math.Round(math.Log(p))) / math.Pow(math.Log(2), 2)
+	k := (m / n) * math.Log(2)
+
+	return BloomFilter{
+		bitSet:            types.NewBitSetVectorFromBytes(&buffer),
+		bitSetSize:        (int(math.Ceil(m)) + 7) / 8,
+		hashFunctionCount: int(k),
+	}
+}
+
 func (bf *BloomFilter) getBufferSize() int {
 	return len(bf.bitSet.Bytes())
 }
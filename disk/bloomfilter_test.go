@@ -1,6 +1,7 @@
 package disk
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -27,3 +28,36 @@ func TestBloomFilterPut(t *testing.T) {
 
 	assert.False(t, containsKey)
 }
+
+func TestBloomFilterForKeysFalsePositiveRate(t *testing.T) {
+	assert.Equal(t, 10, BitsPerKeyForErrorRate(0.01))
+	assert.Equal(t, 5, BitsPerKeyForErrorRate(0.1))
+
+	for _, keyCount := range []int{100, 10_000, 100_000} {
+		bf := NewBloomFilterForKeys(keyCount, 10)
+		assert.Equal(t, 7, bf.hashFunctionCount)
+		assert.Equal(t, keyCount*10, bf.bitSetSize)
+
+		for i := 0; i < keyCount; i++ {
+			bf.Put([]byte(fmt.Sprintf("key-%d", i)))
+		}
+
+		for i := 0; i < keyCount; i++ {
+			containsKey, err := bf.ContainsKey([]byte(fmt.Sprintf("key-%d", i)))
+			assert.NoError(t, err)
+			assert.True(t, containsKey)
+		}
+
+		falsePositives := 0
+		for i := 0; i < 10_000; i++ {
+			containsKey, err := bf.ContainsKey([]byte(fmt.Sprintf("absent-%d", i)))
+			assert.NoError(t, err)
+
+			if containsKey {
+				falsePositives++
+			}
+		}
+
+		assert.Less(t, falsePositives, 200, "%d keys", keyCount)
+	}
+}
@@ -0,0 +1,141 @@
+package disk
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+const blockCacheShards = 16
+
+// a cached block is named by the table it belongs to and its offset in the
+// table file
+type blockCacheKey struct {
+	tableID uint64
+	offset  int
+}
+
+type blockCacheEntry struct {
+	key    blockCacheKey
+	value  any
+	charge int
+}
+
+// one lru list with its own lock and an even part of the capacity
+type blockCacheShard struct {
+	mu       sync.Mutex
+	capacity int
+	usage    int
+	entries  map[blockCacheKey]*list.Element
+	// most recently used first
+	lru *list.List
+}
+
+/*
+BlockCache is an lru cache of uncompressed data blocks, and optionally the
+parsed index and filter, shared by every table of a DiskManager. It is
+split into shards by key so concurrent lookups rarely wait on one another,
+each shard evicting its least recently used blocks once the bytes it holds
+pass its part of the capacity.
+*/
+type BlockCache struct {
+	shards   [blockCacheShards]blockCacheShard
+	capacity int
+	nextID   atomic.Uint64
+	hits     atomic.Uint64
+	misses   atomic.Uint64
+}
+
+type BlockCacheStats struct {
+	Hits     uint64
+	Misses   uint64
+	Usage    int
+	Capacity int
+}
+
+// a cache holding capacity bytes of blocks at most
+func NewBlockCache(capacity int) *BlockCache {
+	c := &BlockCache{capacity: capacity}
+
+	for i := range c.shards {
+		c.shards[i].capacity = (capacity + blockCacheShards - 1) / blockCacheShards
+		c.shards[i].entries = map[blockCacheKey]*list.Element{}
+		c.shards[i].lru = list.New()
+	}
+
+	return c
+}
+
+// an id no other table of the cache uses, keys blocks of one table
+func (c *BlockCache) newTableID() uint64 {
+	return c.nextID.Add(1)
+}
+
+func (c *BlockCache) shard(key blockCacheKey) *blockCacheShard {
+	hash := (key.tableID*0x9e3779b97f4a7c15 ^ uint64(key.offset)) * 0xbf58476d1ce4e5b9
+
+	return &c.shards[hash>>60]
+}
+
+func (c *BlockCache) get(key blockCacheKey) (any, bool) {
+	shard := c.shard(key)
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	element, found := shard.entries[key]
+	if !found {
+		c.misses.Add(1)
+		return nil, false
+	}
+
+	c.hits.Add(1)
+	shard.lru.MoveToFront(element)
+
+	return element.Value.(*blockCacheEntry).value, true
+}
+
+// caches value as charge bytes, a value larger than a shard is not cached
+func (c *BlockCache) insert(key blockCacheKey, value any, charge int) {
+	shard := c.shard(key)
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if charge > shard.capacity {
+		return
+	}
+
+	if element, found := shard.entries[key]; found {
+		shard.remove(element)
+	}
+
+	shard.entries[key] = shard.lru.PushFront(&blockCacheEntry{key: key, value: value, charge: charge})
+	shard.usage += charge
+
+	for shard.usage > shard.capacity {
+		shard.remove(shard.lru.Back())
+	}
+}
+
+func (s *blockCacheShard) remove(element *list.Element) {
+	entry := s.lru.Remove(element).(*blockCacheEntry)
+	delete(s.entries, entry.key)
+	s.usage -= entry.charge
+}
+
+func (c *BlockCache) Stats() BlockCacheStats {
+	stats := BlockCacheStats{
+		Hits:     c.hits.Load(),
+		Misses:   c.misses.Load(),
+		Capacity: c.capacity,
+	}
+
+	for i := range c.shards {
+		c.shards[i].mu.Lock()
+		stats.Usage += c.shards[i].usage
+		c.shards[i].mu.Unlock()
+	}
+
+	return stats
+}
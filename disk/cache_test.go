@@ -0,0 +1,127 @@
+package disk
+
+import (
+	"LsmStorageEngine/types"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlockCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := NewBlockCache(blockCacheShards * 100)
+
+	// keys of one shard
+	var keys []blockCacheKey
+	for offset := 0; len(keys) < 4; offset++ {
+		key := blockCacheKey{tableID: 1, offset: offset}
+		if len(keys) == 0 || cache.shard(key) == cache.shard(keys[0]) {
+			keys = append(keys, key)
+		}
+	}
+
+	cache.insert(keys[0], "a", 40)
+	cache.insert(keys[1], "b", 40)
+
+	// keys[0] becomes the most recently used, keys[1] goes first
+	value, found := cache.get(keys[0])
+	assert.True(t, found)
+	assert.Equal(t, "a", value)
+
+	cache.insert(keys[2], "c", 40)
+
+	_, found = cache.get(keys[1])
+	assert.False(t, found)
+	_, found = cache.get(keys[0])
+	assert.True(t, found)
+	_, found = cache.get(keys[2])
+	assert.True(t, found)
+
+	// larger than a shard
+	cache.insert(keys[3], "d", 101)
+	_, found = cache.get(keys[3])
+	assert.False(t, found)
+
+	stats := cache.Stats()
+	assert.Equal(t, uint64(3), stats.Hits)
+	assert.Equal(t, uint64(2), stats.Misses)
+	assert.Equal(t, 80, stats.Usage)
+	assert.Equal(t, blockCacheShards*100, stats.Capacity)
+}
+
+func TestBlockCacheReplacesEntry(t *testing.T) {
+	cache := NewBlockCache(blockCacheShards * 100)
+	key := blockCacheKey{tableID: cache.newTableID(), offset: 0}
+
+	cache.insert(key, "a", 30)
+	cache.insert(key, "b", 50)
+
+	value, found := cache.get(key)
+	assert.True(t, found)
+	assert.Equal(t, "b", value)
+	assert.Equal(t, 50, cache.Stats().Usage)
+}
+
+func TestTableReadsThroughBlockCache(t *testing.T) {
+	_, err := os.Stat(dataDir)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(dataDir, 0755)
+
+		if err != nil {
+			t.Errorf("test failed due to data dir creation error : %s", err.Error())
+			return
+		}
+	}
+	defer os.RemoveAll(dataDir)
+
+	var entries []types.Record
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("k%04d", i))
+		entries = append(entries, types.NewRecordWithSeqNum(key, []byte(fmt.Sprintf("value %d", i)), false, uint64(i+1)))
+	}
+
+	created, err := createTable(entries, dataDir, 0, 1, TableOptions{Compression: FlateCompression})
+	assert.NoError(t, err)
+
+	for _, cacheIndexAndFilter := range []bool{false, true} {
+		t.Run(fmt.Sprintf("cache index and filter %t", cacheIndexAndFilter), func(t *testing.T) {
+			table, err := ReadTablesFromDisk(created.filePath)
+			assert.NoError(t, err)
+
+			cache := NewBlockCache(1 << 20)
+			table.setBlockCache(cache, cacheIndexAndFilter)
+			assert.Equal(t, cacheIndexAndFilter, table.indexBlock == nil)
+
+			record, err := table.get(entries[500].Key)
+			assert.NoError(t, err)
+			assert.Equal(t, entries[500], record)
+			first := cache.Stats()
+
+			record, err = table.get(entries[500].Key)
+			assert.NoError(t, err)
+			assert.Equal(t, entries[500], record)
+			second := cache.Stats()
+
+			// the data block came from the cache the second time
+			assert.Equal(t, first.Misses, second.Misses)
+			assert.Greater(t, second.Hits, first.Hits)
+			assert.Greater(t, second.Usage, 0)
+
+			allEntries, err := table.getAllEntries()
+			assert.NoError(t, err)
+			assert.Equal(t, entries, allEntries)
+		})
+	}
+
+	// a cache too small to keep anything reads every block from the file
+	table, err := ReadTablesFromDisk(created.filePath)
+	assert.NoError(t, err)
+	table.setBlockCache(NewBlockCache(blockCacheShards), true)
+
+	for _, i := range []int{0, 999, 500} {
+		record, err := table.get(entries[i].Key)
+		assert.NoError(t, err)
+		assert.Equal(t, entries[i], record)
+	}
+}
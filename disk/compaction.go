@@ -0,0 +1,256 @@
+package disk
+
+import (
+	"bytes"
+	"time"
+)
+
+// TableInfo describes a table of a level to a compaction strategy
+type TableInfo struct {
+	FileNumber int
+	// bytes of the table file
+	Size        int64
+	SmallestKey []byte
+	LargestKey  []byte
+	// unix nanoseconds the table was written at
+	CreatedAt int64
+}
+
+/*
+Compaction merges the Inputs tables of Level into OutputLevel, which is
+either the level below, where the tables of that level overlapping the
+inputs join the merge, or level 0 itself. The tables of every other level
+have disjoint key ranges, so they are never merged in place. A Drop
+compaction deletes the inputs without reading them, whatever they hold.
+*/
+type Compaction struct {
+	Level       int
+	OutputLevel int
+	// file numbers of the tables of Level
+	Inputs []int
+	Drop   bool
+}
+
+/*
+CompactionStrategy decides which tables are merged, and when. The disk
+manager asks it for a compaction after every flush and compaction, with
+its lock held, so the calls never overlap.
+*/
+type CompactionStrategy interface {
+	Name() string
+	// the next compaction of levels, holding the tables of every level in
+	// the order the level keeps them, newest first in level 0 and by key
+	// range below. a compaction must not read or write a level busy
+	// reports, ok is false when nothing is to be compacted
+	PickCompaction(levels [][]TableInfo, busy func(level int) bool) (Compaction, bool)
+}
+
+// a strategy whose picks change with time alone, the disk manager asks it
+// for a compaction every CheckInterval as well, writes or not. a zero
+// interval leaves it to the flushes and compactions
+type PeriodicCompactionStrategy interface {
+	CompactionStrategy
+	CheckInterval() time.Duration
+}
+
+// bytes level 1 is sized for by default, every level below holds levelRatio
+// times more
+const DefaultLevelBaseBytes = 10 << 20
+
+// levels dynamic level bytes lays the tree over by default, level 0 included
+const DefaultNumLevels = 7
+
+/*
+LeveledCompactionStrategy keeps every level below 0 made of disjoint
+tables. Every level gets a score, the count of tables of level 0 over
+l0Target, whose tables overlap however small they are, and the bytes of
+the tables of any other level over its target size. The level scoring
+highest above 1 is compacted first: all of level 0, or a single table of
+any other level, the tables of a level being taken in turns through the
+key space.
+
+Level 1 targets levelBaseBytes and every level below it levelRatio times
+more. With dynamic level bytes the tree spans numLevels levels from the
+start and the levels above the last one are sized back from the bytes the
+last level actually holds instead, levelRatio times less per level. The
+first level whose target reaches levelBaseBytes or more, or the last level
+while it holds less, is the base level: level 0 is compacted straight into
+it and the levels above it are left empty, so the last level keeps about
+levelRatio times the data of the level above it however much the store
+holds. The last level itself is never compacted.
+*/
+type LeveledCompactionStrategy struct {
+	levelRatio        int
+	l0Target          int
+	levelBaseBytes    int64
+	dynamicLevelBytes bool
+	numLevels         int
+	// last key of the table each level was last compacted from
+	compactPointers map[int][]byte
+}
+
+func NewLeveledCompactionStrategy(levelRatio int, l0Target int) *LeveledCompactionStrategy {
+	return &LeveledCompactionStrategy{
+		levelRatio:      max(levelRatio, 1),
+		l0Target:        max(l0Target, 1),
+		levelBaseBytes:  DefaultLevelBaseBytes,
+		numLevels:       DefaultNumLevels,
+		compactPointers: map[int][]byte{},
+	}
+}
+
+// the target size of level 1, set before the strategy is handed to a disk
+// manager
+func (s *LeveledCompactionStrategy) SetLevelBaseBytes(bytes int64) {
+	s.levelBaseBytes = max(bytes, 1)
+}
+
+// sizes the levels from the last one up, set before the strategy is handed
+// to a disk manager
+func (s *LeveledCompactionStrategy) SetDynamicLevelBytes(enabled bool) {
+	s.dynamicLevelBytes = enabled
+}
+
+// the levels dynamic level bytes lays the tree over, level 0 included, set
+// before the strategy is handed to a disk manager
+func (s *LeveledCompactionStrategy) SetNumLevels(n int) {
+	s.numLevels = max(n, 2)
+}
+
+func (s *LeveledCompactionStrategy) Name() string { return "leveled" }
+
+func (s *LeveledCompactionStrategy) PickCompaction(levels [][]TableInfo, busy func(level int) bool) (Compaction, bool) {
+	scores, baseLevel := s.levelScores(levels)
+
+	picked, pickedOutput := -1, 0
+	for levelIndex, score := range scores {
+		outputLevel := levelIndex + 1
+		if levelIndex == 0 {
+			outputLevel = l0OutputLevel(levels, baseLevel)
+		}
+
+		if busy(levelIndex) || busy(outputLevel) || score <= 1 {
+			continue
+		}
+
+		if picked < 0 || score > scores[picked] {
+			picked, pickedOutput = levelIndex, outputLevel
+		}
+	}
+
+	if picked < 0 {
+		return Compaction{}, false
+	}
+
+	return s.compactionOf(levels[picked], picked, pickedOutput), true
+}
+
+// the base level, or the first level above it still holding tables, as
+// level 0 has to stay above every older table
+func l0OutputLevel(levels [][]TableInfo, baseLevel int) int {
+	for levelIndex := 1; levelIndex < baseLevel && levelIndex < len(levels); levelIndex++ {
+		if len(levels[levelIndex]) != 0 {
+			return levelIndex
+		}
+	}
+
+	return baseLevel
+}
+
+// how far over its target every level is, a level scoring above 1 needs
+// a compaction, and the base level
+func (s *LeveledCompactionStrategy) levelScores(levels [][]TableInfo) ([]float64, int) {
+	targets, baseLevel := s.levelTargets(levels)
+
+	scores := make([]float64, len(levels))
+	for levelIndex, tables := range levels {
+		switch {
+		case levelIndex == 0:
+			scores[0] = float64(len(tables)) / float64(s.l0Target)
+		case levelIndex < baseLevel:
+			// left over from a larger or a static tree, drained first
+			scores[levelIndex] = float64(levelBytes(tables))
+		case targets[levelIndex] != 0:
+			scores[levelIndex] = float64(levelBytes(tables)) / float64(targets[levelIndex])
+		}
+	}
+
+	return scores, baseLevel
+}
+
+// the target size in bytes of every level below 0 and the base level, a
+// zero target is never compacted
+func (s *LeveledCompactionStrategy) levelTargets(levels [][]TableInfo) ([]int64, int) {
+	if !s.dynamicLevelBytes {
+		targets := make([]int64, len(levels))
+
+		target := s.levelBaseBytes
+		for levelIndex := 1; levelIndex < len(levels); levelIndex++ {
+			targets[levelIndex] = target
+			target *= int64(s.levelRatio)
+		}
+
+		return targets, 1
+	}
+
+	lastLevel := s.numLevels - 1
+	for levelIndex := len(levels) - 1; levelIndex > lastLevel; levelIndex-- {
+		if len(levels[levelIndex]) != 0 {
+			lastLevel = levelIndex
+			break
+		}
+	}
+
+	var lastBytes int64
+	if lastLevel < len(levels) {
+		lastBytes = levelBytes(levels[lastLevel])
+	}
+
+	// every level up from the last targets levelRatio times less, as long as
+	// that is levelBaseBytes or more
+	targets := make([]int64, max(len(levels), lastLevel+1))
+	baseLevel, target := lastLevel, lastBytes
+	for baseLevel > 1 && target/int64(s.levelRatio) >= s.levelBaseBytes {
+		target /= int64(s.levelRatio)
+		baseLevel--
+		targets[baseLevel] = target
+	}
+
+	return targets[:len(levels)], baseLevel
+}
+
+func levelBytes(tables []TableInfo) int64 {
+	var size int64
+	for _, table := range tables {
+		size += table.Size
+	}
+
+	return size
+}
+
+// the compaction of the level into outputLevel, whatever its size
+func (s *LeveledCompactionStrategy) compactionOf(tables []TableInfo, levelIndex, outputLevel int) Compaction {
+	c := Compaction{Level: levelIndex, OutputLevel: outputLevel}
+
+	if levelIndex == 0 || len(tables) == 0 {
+		for _, table := range tables {
+			c.Inputs = append(c.Inputs, table.FileNumber)
+		}
+
+		return c
+	}
+
+	pointer := s.compactPointers[levelIndex]
+	picked := tables[0]
+	for _, table := range tables {
+		if pointer != nil && bytes.Compare(table.SmallestKey, pointer) > 0 {
+			picked = table
+			break
+		}
+	}
+
+	s.compactPointers[levelIndex] = picked.LargestKey
+	c.Inputs = []int{picked.FileNumber}
+
+	return c
+}
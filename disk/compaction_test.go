@@ -0,0 +1,507 @@
+package disk
+
+import (
+	"LsmStorageEngine/types"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func tableInfosOfSizes(sizes ...int64) []TableInfo {
+	var tables []TableInfo
+	for i, size := range sizes {
+		tables = append(tables, TableInfo{FileNumber: i + 1, Size: size})
+	}
+
+	return tables
+}
+
+func TestLeveledStrategyTakesTablesInTurns(t *testing.T) {
+	s := NewLeveledCompactionStrategy(2, 1)
+	s.SetLevelBaseBytes(200)
+	idle := func(int) bool { return false }
+
+	levels := [][]TableInfo{
+		nil,
+		{
+			{FileNumber: 1, Size: 100, SmallestKey: []byte("a"), LargestKey: []byte("b")},
+			{FileNumber: 2, Size: 100, SmallestKey: []byte("c"), LargestKey: []byte("d")},
+			{FileNumber: 3, Size: 100, SmallestKey: []byte("e"), LargestKey: []byte("f")},
+		},
+	}
+
+	for _, fileNumber := range []int{1, 2, 3, 1} {
+		c, ok := s.PickCompaction(levels, idle)
+		assert.True(t, ok)
+		assert.Equal(t, Compaction{Level: 1, OutputLevel: 2, Inputs: []int{fileNumber}}, c)
+	}
+
+	// level 0 twice over its target scores above level 1, with every table
+	levels[0] = tableInfosOfSizes(10, 10)
+	c, ok := s.PickCompaction(levels, idle)
+	assert.True(t, ok)
+	assert.Equal(t, Compaction{Level: 0, OutputLevel: 1, Inputs: []int{1, 2}}, c)
+
+	// a compaction of level 0 needs level 1 as well
+	_, ok = s.PickCompaction(levels, func(level int) bool { return level == 1 })
+	assert.False(t, ok)
+}
+
+func TestLeveledStrategyScoresLevelsByBytes(t *testing.T) {
+	s := NewLeveledCompactionStrategy(10, 4)
+	s.SetLevelBaseBytes(1000)
+	idle := func(int) bool { return false }
+
+	// many small tables are under target, a few big ones over it
+	levels := [][]TableInfo{
+		tableInfosOfSizes(1, 1, 1),
+		tableInfosOfSizes(100, 100, 100, 100, 100, 100, 100, 100),
+		{{FileNumber: 9, Size: 6000}, {FileNumber: 10, Size: 6000}},
+		nil,
+	}
+	scores, baseLevel := s.levelScores(levels)
+	assert.Equal(t, []float64{0.75, 0.8, 1.2, 0}, scores)
+	assert.Equal(t, 1, baseLevel)
+
+	c, ok := s.PickCompaction(levels, idle)
+	assert.True(t, ok)
+	assert.Equal(t, 2, c.Level)
+
+	// the highest score goes first
+	levels[1] = append(levels[1], tableInfosOfSizes(1000)...)
+	c, ok = s.PickCompaction(levels, idle)
+	assert.True(t, ok)
+	assert.Equal(t, 1, c.Level)
+
+	c, ok = s.PickCompaction(levels, func(level int) bool { return level == 1 })
+	assert.True(t, ok)
+	assert.Equal(t, 2, c.Level)
+
+	levels[2] = nil
+	levels[1] = tableInfosOfSizes(100)
+	_, ok = s.PickCompaction(levels, idle)
+	assert.False(t, ok)
+}
+
+func TestLeveledStrategySizesLevelsFromTheLastOne(t *testing.T) {
+	s := NewLeveledCompactionStrategy(10, 4)
+	s.SetLevelBaseBytes(1000)
+	s.SetNumLevels(4)
+
+	levels := [][]TableInfo{nil, nil, nil, tableInfosOfSizes(50000, 30000)}
+	targets, baseLevel := s.levelTargets(levels)
+	assert.Equal(t, []int64{0, 1000, 10000, 100000}, targets)
+	assert.Equal(t, 1, baseLevel)
+
+	// level 1 would target 800 bytes, under the base, so it is left out
+	s.SetDynamicLevelBytes(true)
+	targets, baseLevel = s.levelTargets(levels)
+	assert.Equal(t, []int64{0, 0, 8000, 0}, targets)
+	assert.Equal(t, 2, baseLevel)
+
+	// a level 2 under its static target is over its dynamic one
+	levels = [][]TableInfo{nil, nil, tableInfosOfSizes(10000), tableInfosOfSizes(90000)}
+	targets, _ = s.levelTargets(levels)
+	assert.Equal(t, []int64{0, 0, 9000, 0}, targets)
+
+	c, ok := s.PickCompaction(levels, func(int) bool { return false })
+	assert.True(t, ok)
+	assert.Equal(t, Compaction{Level: 2, OutputLevel: 3, Inputs: []int{1}}, c)
+
+	// the last level holding more than the levels allow for makes level 1
+	// the base and takes a deeper last level
+	levels = [][]TableInfo{nil, nil, nil, nil, nil, tableInfosOfSizes(1000000)}
+	targets, baseLevel = s.levelTargets(levels)
+	assert.Equal(t, []int64{0, 0, 1000, 10000, 100000, 0}, targets)
+	assert.Equal(t, 2, baseLevel)
+}
+
+func TestLeveledStrategyCompactsLevel0IntoTheBaseLevel(t *testing.T) {
+	s := NewLeveledCompactionStrategy(10, 4)
+	s.SetLevelBaseBytes(1000)
+	s.SetNumLevels(4)
+	s.SetDynamicLevelBytes(true)
+	idle := func(int) bool { return false }
+
+	// a store smaller than the base has its last level as base
+	levels := [][]TableInfo{tableInfosOfSizes(1, 1, 1, 1, 1)}
+	c, ok := s.PickCompaction(levels, idle)
+	assert.True(t, ok)
+	assert.Equal(t, Compaction{Level: 0, OutputLevel: 3, Inputs: []int{1, 2, 3, 4, 5}}, c)
+
+	_, ok = s.PickCompaction(levels, func(level int) bool { return level == 3 })
+	assert.False(t, ok)
+
+	levels = [][]TableInfo{tableInfosOfSizes(1, 1, 1, 1, 1), nil, nil, tableInfosOfSizes(20000)}
+	c, ok = s.PickCompaction(levels, idle)
+	assert.True(t, ok)
+	assert.Equal(t, 2, c.OutputLevel)
+
+	// a level above the base still holding tables is drained before level
+	// 0 passes over it
+	levels[1] = tableInfosOfSizes(100)
+	scores, baseLevel := s.levelScores(levels)
+	assert.Equal(t, []float64{1.25, 100, 0, 0}, scores)
+	assert.Equal(t, 1, l0OutputLevel(levels, baseLevel))
+
+	c, ok = s.PickCompaction(levels, idle)
+	assert.True(t, ok)
+	assert.Equal(t, Compaction{Level: 1, OutputLevel: 2, Inputs: []int{1}}, c)
+
+	_, ok = s.PickCompaction(levels, func(level int) bool { return level == 1 })
+	assert.False(t, ok)
+}
+
+func TestDynamicLevelsFillFromTheLastLevelUp(t *testing.T) {
+	_, err := os.Stat(dataDir)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(dataDir, 0755)
+
+		if err != nil {
+			t.Errorf("test failed due to data dir creation error : %s", err.Error())
+			return
+		}
+	}
+	defer os.RemoveAll(dataDir)
+
+	dm, err := OpenDiskManager(10, 1, dataDir)
+	assert.NoError(t, err)
+
+	s := NewLeveledCompactionStrategy(4, 1)
+	s.SetLevelBaseBytes(8 << 10)
+	s.SetNumLevels(4)
+	s.SetDynamicLevelBytes(true)
+	dm.SetCompactionStrategy(s)
+	dm.SetTargetFileSize(4 << 10)
+
+	levelSizes := func() []int {
+		var sizes []int
+		for _, level := range dm.current.levels {
+			sizes = append(sizes, len(level.tables))
+		}
+
+		return sizes
+	}
+
+	baseLevels := map[int]bool{}
+	for batch := 0; batch < 40; batch++ {
+		var records []types.Record
+		for i := 0; i < 20; i++ {
+			key := []byte(fmt.Sprintf("k%04d", (batch*37+i*53)%1000))
+			records = append(records, types.NewRecordWithSeqNum(key, bytes.Repeat([]byte("v"), 100), false, uint64(batch*20+i+1)))
+		}
+		sort.Slice(records, func(i, j int) bool { return bytes.Compare(records[i].Key, records[j].Key) < 0 })
+
+		assert.NoError(t, dm.Flush(records, batch+2))
+		assert.NoError(t, dm.WaitForCompactions())
+
+		// a single table is not over the level 0 target yet
+		if batch == 0 {
+			continue
+		}
+
+		// the levels above the base stay empty, the last one is never skipped
+		sizes := levelSizes()
+		assert.Len(t, sizes, 4)
+		assert.NotZero(t, sizes[3], "%v", sizes)
+
+		base := 3
+		for base > 1 && sizes[base-1] != 0 {
+			base--
+		}
+		for level := 1; level < base; level++ {
+			assert.Zero(t, sizes[level], "%v", sizes)
+		}
+		baseLevels[base] = true
+	}
+
+	// the base moved up as the last level grew
+	assert.True(t, baseLevels[3])
+	assert.True(t, baseLevels[2])
+
+	assert.NoError(t, dm.Close())
+	dm, err = OpenDiskManager(10, 1, dataDir)
+	assert.NoError(t, err)
+	defer dm.Close()
+
+	for batch := 0; batch < 40; batch++ {
+		_, err := dm.Get([]byte(fmt.Sprintf("k%04d", (batch*37)%1000)))
+		assert.NoError(t, err)
+	}
+}
+
+func TestSizeTieredStrategyMergesTablesOfSimilarSize(t *testing.T) {
+	s := NewSizeTieredCompactionStrategy(4)
+	idle := func(int) bool { return false }
+
+	// three small tables are not enough, the four of about 100 KiB are
+	levels := [][]TableInfo{tableInfosOfSizes(
+		1<<20, 10<<10, 100<<10, 1<<20, 90<<10, 12<<10, 110<<10, 8<<10, 120<<10,
+	)}
+
+	c, ok := s.PickCompaction(levels, idle)
+	assert.True(t, ok)
+	assert.Equal(t, 0, c.Level)
+	assert.Equal(t, 0, c.OutputLevel)
+	assert.ElementsMatch(t, []int{3, 5, 7, 9}, c.Inputs)
+
+	_, ok = s.PickCompaction(levels, func(level int) bool { return level == 0 })
+	assert.False(t, ok)
+
+	_, ok = s.PickCompaction([][]TableInfo{tableInfosOfSizes(1<<20, 100<<10, 10<<10)}, idle)
+	assert.False(t, ok)
+
+	// tables below the minimum size share a bucket whatever their sizes
+	c, ok = s.PickCompaction([][]TableInfo{tableInfosOfSizes(1<<10, 20<<10, 3<<10, 30<<10)}, idle)
+	assert.True(t, ok)
+	assert.ElementsMatch(t, []int{1, 2, 3, 4}, c.Inputs)
+}
+
+func TestSizeTieredCompactionKeepsTablesInLevel0(t *testing.T) {
+	_, err := os.Stat(dataDir)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(dataDir, 0755)
+
+		if err != nil {
+			t.Errorf("test failed due to data dir creation error : %s", err.Error())
+			return
+		}
+	}
+	defer os.RemoveAll(dataDir)
+
+	dm, err := OpenDiskManager(10, 1, dataDir)
+	assert.NoError(t, err)
+	defer dm.Close()
+
+	dm.SetCompactionStrategy(NewSizeTieredCompactionStrategy(4))
+
+	seqNum := uint64(0)
+	latest := map[string]types.Record{}
+	for batch := 0; batch < 40; batch++ {
+		var records []types.Record
+		for i := 0; i < 50; i++ {
+			seqNum++
+			key := []byte(fmt.Sprintf("k%04d", i*40+batch))
+			record := types.NewRecordWithSeqNum(key, []byte(fmt.Sprintf("v%d", seqNum)), false, seqNum)
+
+			// every batch deletes a key of the one before
+			if i == 0 && batch > 0 {
+				key = []byte(fmt.Sprintf("k%04d", 40+batch-1))
+				record = types.NewRecordWithSeqNum(key, nil, true, seqNum)
+			}
+
+			records = append(records, record)
+			latest[string(key)] = record
+		}
+
+		sort.Slice(records, func(i, j int) bool { return bytes.Compare(records[i].Key, records[j].Key) < 0 })
+		assert.NoError(t, dm.Flush(records, batch+2))
+	}
+	assert.NoError(t, dm.WaitForCompactions())
+
+	levels := levelFileNumbers(dm)
+	assert.Len(t, levels, 1)
+	assert.Less(t, len(levels[0]), 10)
+
+	for key, record := range latest {
+		found, err := dm.Get([]byte(key))
+
+		if record.TombStone {
+			if err == nil {
+				assert.True(t, found.TombStone, key)
+			}
+			continue
+		}
+
+		assert.NoError(t, err)
+		assert.Equal(t, record.Value, found.Value)
+	}
+}
+
+func TestLevel0MergeKeepsTombstonesOfOlderTables(t *testing.T) {
+	_, err := os.Stat(dataDir)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(dataDir, 0755)
+
+		if err != nil {
+			t.Errorf("test failed due to data dir creation error : %s", err.Error())
+			return
+		}
+	}
+	defer os.RemoveAll(dataDir)
+
+	dm, err := OpenDiskManager(10, 100, dataDir)
+	assert.NoError(t, err)
+	defer dm.Close()
+
+	assert.NoError(t, dm.Flush([]types.Record{types.NewRecordWithSeqNum(toBytes("k"), toBytes("old"), false, 1)}, 2))
+	assert.NoError(t, dm.Flush([]types.Record{types.NewRecordWithSeqNum(toBytes("k"), nil, true, 2)}, 3))
+	assert.NoError(t, dm.Flush([]types.Record{types.NewRecordWithSeqNum(toBytes("j"), toBytes("v"), false, 3)}, 4))
+
+	// the table holding the old version is left out
+	assert.NoError(t, dm.compact(Compaction{Level: 0, OutputLevel: 0, Inputs: []int{2, 3}}))
+	assert.Equal(t, [][]int{{4, 1}}, levelFileNumbers(dm))
+
+	record, err := dm.Get(toBytes("k"))
+	assert.NoError(t, err)
+	assert.True(t, record.TombStone)
+
+	// with every table merged the tombstone has nothing left to hide
+	assert.NoError(t, dm.compact(Compaction{Level: 0, OutputLevel: 0, Inputs: []int{4, 1}}))
+
+	_, err = dm.Get(toBytes("k"))
+	assert.Equal(t, types.DISKMANAGER_KEY_NOT_FOUND_ERROR, err.(*types.EngineError).GetErrorCode())
+
+	assert.Error(t, dm.compact(Compaction{Level: 1, OutputLevel: 1, Inputs: []int{5}}))
+	assert.Error(t, dm.compact(Compaction{Level: 0, OutputLevel: 0, Inputs: []int{1}}))
+}
+
+func TestFIFOStrategyDropsTheOldestTables(t *testing.T) {
+	now := time.Unix(1000, 0)
+	s := NewFIFOCompactionStrategy(250, 0)
+	s.now = func() time.Time { return now }
+	idle := func(int) bool { return false }
+
+	// newest first, as level 0 keeps them
+	levels := [][]TableInfo{{
+		{FileNumber: 4, Size: 100, CreatedAt: now.Add(-time.Minute).UnixNano()},
+		{FileNumber: 3, Size: 100, CreatedAt: now.Add(-2 * time.Minute).UnixNano()},
+		{FileNumber: 2, Size: 100, CreatedAt: now.Add(-3 * time.Minute).UnixNano()},
+		{FileNumber: 1, Size: 100, CreatedAt: now.Add(-4 * time.Minute).UnixNano()},
+	}}
+
+	c, ok := s.PickCompaction(levels, idle)
+	assert.True(t, ok)
+	assert.Equal(t, Compaction{Level: 0, OutputLevel: 0, Inputs: []int{1, 2}, Drop: true}, c)
+
+	_, ok = s.PickCompaction(levels, func(level int) bool { return level == 0 })
+	assert.False(t, ok)
+
+	s = NewFIFOCompactionStrategy(0, 150*time.Second)
+	s.now = func() time.Time { return now }
+
+	c, ok = s.PickCompaction(levels, idle)
+	assert.True(t, ok)
+	assert.Equal(t, []int{1, 2}, c.Inputs)
+
+	_, ok = s.PickCompaction([][]TableInfo{levels[0][:2]}, idle)
+	assert.False(t, ok)
+}
+
+func TestFIFOCompactionDeletesTablesWithoutMerging(t *testing.T) {
+	_, err := os.Stat(dataDir)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(dataDir, 0755)
+
+		if err != nil {
+			t.Errorf("test failed due to data dir creation error : %s", err.Error())
+			return
+		}
+	}
+	defer os.RemoveAll(dataDir)
+
+	dm, err := OpenDiskManager(10, 1, dataDir)
+	assert.NoError(t, err)
+
+	flush := func(batch int) {
+		var records []types.Record
+		for i := 0; i < 20; i++ {
+			seqNum := uint64(batch*20 + i + 1)
+			key := []byte(fmt.Sprintf("b%02d-%02d", batch, i))
+			records = append(records, types.NewRecordWithSeqNum(key, bytes.Repeat([]byte("v"), 100), false, seqNum))
+		}
+
+		assert.NoError(t, dm.Flush(records, batch+2))
+		assert.NoError(t, dm.WaitForCompactions())
+	}
+
+	flush(0)
+	tableSize := dm.current.levels[0].tables[0].metaData.fileSize
+	dm.SetCompactionStrategy(NewFIFOCompactionStrategy(3*tableSize, 0))
+
+	for batch := 1; batch < 10; batch++ {
+		flush(batch)
+	}
+
+	levels := levelFileNumbers(dm)
+	assert.Equal(t, [][]int{{10, 9, 8}}, levels)
+
+	for batch := 0; batch < 10; batch++ {
+		_, err := dm.Get([]byte(fmt.Sprintf("b%02d-00", batch)))
+		if batch < 7 {
+			assert.Equal(t, types.DISKMANAGER_KEY_NOT_FOUND_ERROR, err.(*types.EngineError).GetErrorCode())
+		} else {
+			assert.NoError(t, err)
+		}
+	}
+
+	entries, err := os.ReadDir(dataDir)
+	assert.NoError(t, err)
+
+	tableFiles := 0
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) == ".data" {
+			tableFiles++
+		}
+	}
+	assert.Equal(t, 3, tableFiles)
+
+	// the tables dropped stay dropped once reopened
+	assert.NoError(t, dm.Close())
+	dm, err = OpenDiskManager(10, 1, dataDir)
+	assert.NoError(t, err)
+	defer dm.Close()
+
+	assert.Equal(t, levels, levelFileNumbers(dm))
+}
+
+func TestFIFOCompactionExpiresTablesOfAnIdleStore(t *testing.T) {
+	_, err := os.Stat(dataDir)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(dataDir, 0755)
+
+		if err != nil {
+			t.Errorf("test failed due to data dir creation error : %s", err.Error())
+			return
+		}
+	}
+	defer os.RemoveAll(dataDir)
+
+	dm, err := OpenDiskManager(10, 1, dataDir)
+	assert.NoError(t, err)
+	defer dm.Close()
+
+	dm.SetCompactionStrategy(NewFIFOCompactionStrategy(0, 200*time.Millisecond))
+
+	for batch := 0; batch < 2; batch++ {
+		key := []byte(fmt.Sprintf("b%02d", batch))
+		assert.NoError(t, dm.Flush([]types.Record{types.NewRecordWithSeqNum(key, key, false, uint64(batch+1))}, batch+2))
+	}
+
+	dm.mu.RLock()
+	assert.Len(t, dm.current.levels[0].tables, 2)
+	dm.mu.RUnlock()
+
+	// nothing is written anymore, the timer alone finds the tables expired
+	assert.Eventually(t, func() bool {
+		dm.mu.RLock()
+		defer dm.mu.RUnlock()
+
+		return len(dm.current.levels[0].tables) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	_, err = dm.Get([]byte("b00"))
+	assert.Equal(t, types.DISKMANAGER_KEY_NOT_FOUND_ERROR, err.(*types.EngineError).GetErrorCode())
+
+	// another strategy stops the timer
+	dm.SetCompactionStrategy(NewLeveledCompactionStrategy(10, 1))
+	dm.mu.RLock()
+	assert.Nil(t, dm.stopPeriodic)
+	dm.mu.RUnlock()
+}
@@ -0,0 +1,251 @@
+package disk
+
+import (
+	"LsmStorageEngine/types"
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// CompressionType is the codec of a data block, stored in the last byte of
+// every block so tables written with different settings coexist
+type CompressionType byte
+
+const (
+	NoCompression    CompressionType = 0
+	FlateCompression CompressionType = 1
+	ZlibCompression  CompressionType = 2
+	// built in byte oriented lz77 codec, cheap on cpu
+	LZCompression CompressionType = 3
+)
+
+func (c CompressionType) String() string {
+	switch c {
+	case NoCompression:
+		return "none"
+	case FlateCompression:
+		return "flate"
+	case ZlibCompression:
+		return "zlib"
+	case LZCompression:
+		return "lz"
+	}
+
+	return fmt.Sprintf("unknown(%d)", byte(c))
+}
+
+// compresses block with codec and appends the codec id, a block that does
+// not shrink by at least an eighth is kept raw
+func compressBlock(block []byte, codec CompressionType) []byte {
+	var compressed []byte
+
+	switch codec {
+	case FlateCompression:
+		var buffer bytes.Buffer
+		writer, _ := flate.NewWriter(&buffer, flate.DefaultCompression)
+		writer.Write(block)
+		writer.Close()
+		compressed = buffer.Bytes()
+	case ZlibCompression:
+		var buffer bytes.Buffer
+		writer := zlib.NewWriter(&buffer)
+		writer.Write(block)
+		writer.Close()
+		compressed = buffer.Bytes()
+	case LZCompression:
+		compressed = lzCompress(block)
+	}
+
+	if codec == NoCompression || len(compressed) >= len(block)-len(block)/8 {
+		return append(append([]byte{}, block...), byte(NoCompression))
+	}
+
+	return append(compressed, byte(codec))
+}
+
+// strips the codec id off a stored block and decompresses it
+func uncompressBlock(stored []byte) ([]byte, error) {
+	if len(stored) == 0 {
+		return nil, types.NewEngineError(
+			types.TABLE_BLOCK_DECOMPRESSION_ERROR,
+			"block is missing its codec",
+		)
+	}
+
+	codec := CompressionType(stored[len(stored)-1])
+	payload := stored[:len(stored)-1]
+
+	var block []byte
+	var err error
+
+	switch codec {
+	case NoCompression:
+		return payload, nil
+	case FlateCompression:
+		block, err = io.ReadAll(flate.NewReader(bytes.NewReader(payload)))
+	case ZlibCompression:
+		var reader io.ReadCloser
+		if reader, err = zlib.NewReader(bytes.NewReader(payload)); err == nil {
+			block, err = io.ReadAll(reader)
+		}
+	case LZCompression:
+		block, err = lzUncompress(payload)
+	default:
+		err = fmt.Errorf("unknown codec %d", byte(codec))
+	}
+
+	if err != nil {
+		return nil, types.NewEngineError(
+			types.TABLE_BLOCK_DECOMPRESSION_ERROR,
+			fmt.Sprintf("%s block decompression error : %s", codec, err.Error()),
+		)
+	}
+
+	return block, nil
+}
+
+const (
+	lzLiteral      = 0
+	lzMatch        = 1
+	lzMinMatch     = 4
+	lzHashBits     = 14
+	lzMaxMatchDist = 1 << 16
+	// output bytes per input byte the decompressor makes room for up front
+	lzExpectedRatio = 8
+)
+
+/*
+lzCompress is a greedy lz77 over a hash of the next four bytes. The output
+is the uvarint length of the input followed by tokens, either
+
+	| 0 | length (uvarint) | literal bytes |
+	| 1 | distance (uvarint) | length (uvarint) |
+*/
+func lzCompress(src []byte) []byte {
+	dst := binary.AppendUvarint(nil, uint64(len(src)))
+
+	var table [1 << lzHashBits]int
+	for i := range table {
+		table[i] = -1
+	}
+
+	hash := func(i int) uint32 {
+		return (binary.LittleEndian.Uint32(src[i:]) * 2654435761) >> (32 - lzHashBits)
+	}
+
+	literalStart := 0
+	flushLiterals := func(end int) {
+		if end > literalStart {
+			dst = append(dst, lzLiteral)
+			dst = binary.AppendUvarint(dst, uint64(end-literalStart))
+			dst = append(dst, src[literalStart:end]...)
+		}
+	}
+
+	for i := 0; i+lzMinMatch <= len(src); {
+		h := hash(i)
+		candidate := table[h]
+		table[h] = i
+
+		if candidate < 0 || i-candidate > lzMaxMatchDist ||
+			!bytes.Equal(src[candidate:candidate+lzMinMatch], src[i:i+lzMinMatch]) {
+			i++
+			continue
+		}
+
+		length := lzMinMatch
+		for i+length < len(src) && src[candidate+length] == src[i+length] {
+			length++
+		}
+
+		flushLiterals(i)
+		dst = append(dst, lzMatch)
+		dst = binary.AppendUvarint(dst, uint64(i-candidate))
+		dst = binary.AppendUvarint(dst, uint64(length))
+
+		i += length
+		literalStart = i
+	}
+
+	flushLiterals(len(src))
+
+	return dst
+}
+
+func lzUncompress(src []byte) ([]byte, error) {
+	length, n := binary.Uvarint(src)
+	if n <= 0 {
+		return nil, fmt.Errorf("missing length")
+	}
+	src = src[n:]
+
+	// blocks address their restart points in 32 bits
+	if length > math.MaxUint32 {
+		return nil, fmt.Errorf("length %d past the largest block", length)
+	}
+
+	readUvarint := func() (int, error) {
+		value, n := binary.Uvarint(src)
+		if n <= 0 || value > length {
+			return 0, fmt.Errorf("bad token")
+		}
+
+		src = src[n:]
+		return int(value), nil
+	}
+
+	// the length is not trusted with memory the tokens did not produce yet,
+	// a block seldom shrinks more than lzExpectedRatio times
+	dst := make([]byte, 0, min(length, uint64(len(src))*lzExpectedRatio))
+	for len(src) != 0 {
+		token := src[0]
+		src = src[1:]
+
+		switch token {
+		case lzLiteral:
+			size, err := readUvarint()
+			if err != nil || size > len(src) {
+				return nil, fmt.Errorf("literal runs past the input")
+			}
+
+			if uint64(len(dst)+size) > length {
+				return nil, fmt.Errorf("output longer than its length")
+			}
+
+			dst = append(dst, src[:size]...)
+			src = src[size:]
+		case lzMatch:
+			distance, err := readUvarint()
+			if err != nil || distance == 0 || distance > len(dst) {
+				return nil, fmt.Errorf("match before the start of the output")
+			}
+
+			size, err := readUvarint()
+			if err != nil {
+				return nil, err
+			}
+
+			if uint64(len(dst)+size) > length {
+				return nil, fmt.Errorf("output longer than its length")
+			}
+
+			// matches may overlap the bytes they produce
+			start := len(dst) - distance
+			for i := 0; i < size; i++ {
+				dst = append(dst, dst[start+i])
+			}
+		default:
+			return nil, fmt.Errorf("unknown token %d", token)
+		}
+	}
+
+	if uint64(len(dst)) != length {
+		return nil, fmt.Errorf("output shorter than its length")
+	}
+
+	return dst, nil
+}
@@ -0,0 +1,160 @@
+package disk
+
+import (
+	"LsmStorageEngine/types"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var codecs = []CompressionType{NoCompression, FlateCompression, ZlibCompression, LZCompression}
+
+func TestCompressBlockRoundTrip(t *testing.T) {
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	blocks := map[string][]byte{
+		"empty":        {},
+		"short":        []byte("abc"),
+		"repetitive":   bytes.Repeat([]byte("tenant/123/user/456="), 200),
+		"random":       random,
+		"overlapping":  bytes.Repeat([]byte{'a'}, 1000),
+		"mixed blocks": append(bytes.Repeat([]byte("xyzw"), 100), random[:500]...),
+	}
+
+	for name, block := range blocks {
+		for _, codec := range codecs {
+			t.Run(fmt.Sprintf("%s %s", name, codec), func(t *testing.T) {
+				stored := compressBlock(block, codec)
+
+				decoded, err := uncompressBlock(stored)
+				assert.NoError(t, err)
+				assert.Equal(t, block, append([]byte{}, decoded...))
+			})
+		}
+	}
+}
+
+func TestCompressBlockKeepsIncompressibleBlocksRaw(t *testing.T) {
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(2)).Read(random)
+
+	for _, codec := range codecs {
+		stored := compressBlock(random, codec)
+		assert.Equal(t, byte(NoCompression), stored[len(stored)-1])
+	}
+
+	repetitive := bytes.Repeat([]byte("tenant/123/user/456="), 200)
+	for _, codec := range codecs[1:] {
+		stored := compressBlock(repetitive, codec)
+		assert.Equal(t, byte(codec), stored[len(stored)-1])
+		assert.Less(t, len(stored), len(repetitive)/4)
+	}
+}
+
+func TestUncompressBlockRejectsCorruption(t *testing.T) {
+	block := bytes.Repeat([]byte("tenant/123/user/456="), 200)
+
+	for _, stored := range [][]byte{
+		nil,
+		append(compressBlock(block, NoCompression)[:10], 42),
+		compressBlock(block, FlateCompression)[5:],
+		compressBlock(block, ZlibCompression)[5:],
+		append([]byte{0xff, 0x01}, byte(LZCompression)),
+		append(lzCompress(block)[:20], byte(LZCompression)),
+	} {
+		_, err := uncompressBlock(stored)
+		assert.Error(t, err)
+		assert.Equal(t, types.TABLE_BLOCK_DECOMPRESSION_ERROR, err.(*types.EngineError).GetErrorCode())
+	}
+}
+
+func TestLZUncompressDoesNotTrustItsLength(t *testing.T) {
+	withLength := func(length uint64, tokens ...byte) []byte {
+		return append(binary.AppendUvarint(nil, length), tokens...)
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	for name, src := range map[string][]byte{
+		"past the largest block":  withLength(math.MaxUint64, lzLiteral, 1, 'a'),
+		"largest block":           withLength(math.MaxUint32, lzLiteral, 1, 'a'),
+		"match past the length":   withLength(1<<20, lzLiteral, 1, 'a', lzMatch, 1, 0x80, 0x80, 0x40),
+		"literal past the length": withLength(1, lzLiteral, 2, 'a', 'b'),
+	} {
+		_, err := lzUncompress(src)
+		assert.Error(t, err, name)
+	}
+
+	// none of them got the memory they asked for
+	runtime.ReadMemStats(&after)
+	assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(1<<20))
+
+	// a block shrunk far more than usual still comes back whole
+	block := bytes.Repeat([]byte{'z'}, 1<<20)
+	uncompressed, err := lzUncompress(lzCompress(block))
+	assert.NoError(t, err)
+	assert.Equal(t, block, uncompressed)
+}
+
+func TestTablesOfDifferentCodecsCoexist(t *testing.T) {
+	dataDir := "./data"
+
+	_, err := os.Stat(dataDir)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(dataDir, 0755)
+
+		if err != nil {
+			t.Errorf("test failed due to data dir creation error : %s", err.Error())
+		}
+	}
+	defer os.RemoveAll(dataDir)
+
+	var entries []types.Record
+	for i := 0; i < 2000; i++ {
+		key := []byte(fmt.Sprintf("tenant/%03d/user/%05d", i/100, i))
+		entries = append(entries, types.NewRecordWithSeqNum(key, bytes.Repeat([]byte{byte('a' + i%26)}, 40), false, uint64(i+1)))
+	}
+
+	var tables []*Table
+	for i, codec := range codecs {
+		table, err := createTable(entries, dataDir, 0, i+1, TableOptions{Compression: codec})
+		assert.NoError(t, err)
+
+		table, err = ReadTablesFromDisk(table.filePath)
+		assert.NoError(t, err)
+		tables = append(tables, table)
+	}
+
+	// older tables without codec ids stay readable next to them
+	_, content := buildTable(entries, 0, prefixFormatVersion, DefaultTableOptions())
+	fileName := tableFileName(dataDir, 0, len(codecs)+1)
+	assert.NoError(t, os.WriteFile(fileName, content, 0644))
+
+	table, err := ReadTablesFromDisk(fileName)
+	assert.NoError(t, err)
+	tables = append(tables, table)
+
+	for _, table := range tables {
+		for _, i := range []int{0, 999, 1999} {
+			record, err := table.get(entries[i].Key)
+			assert.NoError(t, err)
+			assert.Equal(t, entries[i], record)
+		}
+
+		allEntries, err := table.getAllEntries()
+		assert.NoError(t, err)
+		assert.Equal(t, entries, allEntries)
+	}
+
+	// the zlib table is much smaller than the uncompressed one
+	assert.Less(t, tables[2].dataHandle.size, tables[0].dataHandle.size/2)
+}
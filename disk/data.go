@@ -5,6 +5,9 @@ import (
 	"encoding/binary"
 )
 
+// target size of a data block, a block is cut once it reaches it
+const dataBlockSize = 4 * 1024
+
 type Data struct {
 	entries       []types.Record
 	dataBlockSize int
@@ -27,31 +30,94 @@ func (d *Data) Encode() []byte {
 	var buffer []byte
 
 	for _, entry := range d.entries {
-		// key size
-		var keyLenScratchPad []byte = make([]byte, 8)
-		binary.LittleEndian.PutUint64(keyLenScratchPad, uint64(len(entry.Key)))
-		buffer = append(buffer, keyLenScratchPad...)
-
-		// key
-		buffer = append(buffer, entry.Key...)
-
-		// value size
-		var valueSizeScratchPad []byte = make([]byte, 8)
-		binary.LittleEndian.PutUint64(valueSizeScratchPad, uint64(len(entry.Value)))
-		buffer = append(buffer, valueSizeScratchPad...)
-
-		// value
-		buffer = append(buffer, entry.Value...)
-
-		// tombstone
-		var b byte
-		if entry.TombStone {
-			b = 1
+		buffer = encodeRecord(buffer, entry)
+	}
+
+	return buffer
+}
+
+/*
+EncodeBlocks cuts the records into blocks of about blockSize bytes in the
+layout of formatVersion and returns them back to back, together with the
+sparse index holding the last key and the position of every block. The
+versions of one key may run over into the next block. From the compressed
+format on every block is compressed with codec and ends in its codec id,
+from the checksum format on in the crc32c of the stored block after that.
+*/
+func (d *Data) EncodeBlocks(blockSize int, formatVersion int, codec CompressionType) ([]byte, *TableIndex) {
+	var buffer []byte
+	index := &TableIndex{}
+
+	var builder *blockBuilder
+	blockStart := 0
+	for i, entry := range d.entries {
+		last := i == len(d.entries)-1
+
+		if formatVersion < prefixFormatVersion {
+			buffer = encodeRecord(buffer, entry)
+
+			if len(buffer)-blockStart < blockSize && !last {
+				continue
+			}
 		} else {
-			b = 0
+			if builder == nil {
+				builder = &blockBuilder{}
+			}
+			builder.add(entry)
+
+			if builder.size() < blockSize && !last {
+				continue
+			}
+
+			block := builder.finish()
+			if formatVersion >= compressedFormatVersion {
+				block = compressBlock(block, codec)
+			}
+			if formatVersion >= checksumFormatVersion {
+				block = appendChecksum(block)
+			}
+
+			buffer = append(buffer, block...)
+			builder = nil
 		}
-		buffer = append(buffer, b)
+
+		index.add(indexRecord{key: entry.Key, offset: blockStart, size: len(buffer) - blockStart})
+		blockStart = len(buffer)
 	}
 
+	return buffer, index
+}
+
+func encodeRecord(buffer []byte, entry types.Record) []byte {
+	// key size
+	var keyLenScratchPad []byte = make([]byte, 8)
+	binary.LittleEndian.PutUint64(keyLenScratchPad, uint64(len(entry.Key)))
+	buffer = append(buffer, keyLenScratchPad...)
+
+	// key
+	buffer = append(buffer, entry.Key...)
+
+	// value size
+	var valueSizeScratchPad []byte = make([]byte, 8)
+	binary.LittleEndian.PutUint64(valueSizeScratchPad, uint64(len(entry.Value)))
+	buffer = append(buffer, valueSizeScratchPad...)
+
+	// value
+	buffer = append(buffer, entry.Value...)
+
+	// tombstone
+	var b byte
+	if entry.TombStone {
+		b = 1
+	} else {
+		b = 0
+	}
+	buffer = append(buffer, b)
+
+	// sequence number
+	var seqNumScratchPad []byte = make([]byte, 8)
+	binary.LittleEndian.PutUint64(seqNumScratchPad, entry.SeqNum)
+	buffer = append(buffer, seqNumScratchPad...)
+
 	return buffer
 }
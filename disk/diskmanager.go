@@ -2,72 +2,705 @@ package disk
 
 import (
 	"LsmStorageEngine/types"
+	"bytes"
+	"container/heap"
 	"fmt"
 	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
+// size of the keys and values compactions write to a table by default
+const defaultTargetFileSize = 2 << 20
+
 type DiskManager struct {
-	levels     []*Level
-	levelRatio int
-	l0Target   int
-	dir        string
-	mu         sync.RWMutex
+	// levels readers start from, replaced as a whole by flushes and compactions
+	current        *version
+	dir            string
+	manifest       *manifest
+	nextFileNumber int
+	logNumber      int
+	lastSequence   uint64
+	// sequence numbers of the snapshots readers still hold
+	snapshots func() []uint64
+	// settings of the tables flushes and compactions write
+	tableOptions TableOptions
+	// size of the keys and values compactions put in a table before starting
+	// the next one
+	targetFileSize int
+	// picks the tables compactions merge
+	compactionStrategy CompactionStrategy
+	// shared by the tables of every version, nil when caching is off
+	blockCache          *BlockCache
+	cacheIndexAndFilter bool
+	// open files of the tables of every version, nil opens them per read
+	tableCache *TableCache
+	// at most maxBackgroundCompactions run at once, a level takes part in
+	// at most one of them
+	maxBackgroundCompactions int
+	runningCompactions       int
+	compactingLevels         map[int]bool
+	// stops the timer of a periodic compaction strategy, nil without one
+	stopPeriodic chan struct{}
+	periodicDone chan struct{}
+	// first error of a background compaction, fails every later flush
+	backgroundErr  error
+	closing        bool
+	compactionDone *sync.Cond
+	mu             sync.RWMutex
 }
 
 func CreateDiskManager(levelRatio int, l0Target int, dir string) *DiskManager {
-	return &DiskManager{
-		levels:     make([]*Level, 1),
-		levelRatio: levelRatio,
-		l0Target:   l0Target,
-		dir:        dir,
+	dm := &DiskManager{
+		current:                  newVersion([]*Level{{}}),
+		dir:                      dir,
+		nextFileNumber:           1,
+		tableOptions:             DefaultTableOptions(),
+		targetFileSize:           defaultTargetFileSize,
+		compactionStrategy:       NewLeveledCompactionStrategy(levelRatio, l0Target),
+		maxBackgroundCompactions: 1,
+		compactingLevels:         map[int]bool{},
+	}
+	dm.compactionDone = sync.NewCond(&dm.mu)
+
+	return dm
+}
+
+/*
+OpenDiskManager rebuilds the tree described by the manifest in dir. A
+directory written before manifests existed has its tables discovered from
+the file names instead. Either way a fresh manifest is started and table
+files no level refers to are removed. It refuses to open a directory whose
+tables do not describe a valid lsm tree.
+*/
+func OpenDiskManager(levelRatio int, l0Target int, dir string) (*DiskManager, error) {
+	dm := CreateDiskManager(levelRatio, l0Target, dir)
+
+	state, manifestNumber, found, err := ReadManifest(dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !found {
+		state, err = importUnversionedTables(dir)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if state.NextFileNumber == 0 {
+		state.NextFileNumber = 1
+	}
+
+	levels := []*Level{{}}
+	referenced := map[string]bool{}
+	for level, fileNumbers := range state.Levels {
+		for len(levels) <= level {
+			levels = append(levels, &Level{})
+		}
+
+		for _, fileNumber := range fileNumbers {
+			fileName := tableFileName(dir, level, fileNumber)
+			table, err := ReadTablesFromDisk(fileName)
+
+			if err != nil {
+				return nil, types.NewEngineError(
+					types.DISKMANAGER_INCONSISTENT_DIR_ERROR,
+					fmt.Sprintf("unable to recover table %s : %s", fileName, err.Error()),
+				)
+			}
+
+			if table.metaData.level != level {
+				return nil, types.NewEngineError(
+					types.DISKMANAGER_INCONSISTENT_DIR_ERROR,
+					fmt.Sprintf(
+						"table %s belongs to level %d but its header says level %d",
+						fileName, level, table.metaData.level,
+					),
+				)
+			}
+
+			if fileNumber >= state.NextFileNumber {
+				return nil, types.NewEngineError(
+					types.DISKMANAGER_INCONSISTENT_DIR_ERROR,
+					fmt.Sprintf("table %s is numbered past the next file number %d", fileName, state.NextFileNumber),
+				)
+			}
+
+			table.fileNumber = fileNumber
+			levels[level].tables = append(levels[level].tables, table)
+			referenced[filepath.Base(fileName)] = true
+		}
+	}
+
+	if err := orderLevels(levels); err != nil {
+		return nil, err
+	}
+
+	dm.current = newVersion(levels)
+
+	dm.nextFileNumber = state.NextFileNumber
+	dm.logNumber = state.LogNumber
+	dm.lastSequence = state.LastSequence
+
+	dm.manifest, err = createManifest(dir, manifestNumber+1, state)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// leftovers of flushes and compactions that never made it to the manifest,
+	// only told apart from tables of a lost edit when every edit was read
+	if state.TornTail {
+		return dm, nil
+	}
+
+	entries, err := os.ReadDir(dir)
+
+	if err != nil {
+		return nil, types.NewEngineError(
+			types.TABLE_READ_FILE_ERROR,
+			fmt.Sprintf("data directory read error : %s", err.Error()),
+		)
+	}
+
+	for _, entry := range entries {
+		if _, _, ok := parseTableFileName(entry.Name()); ok && !referenced[entry.Name()] {
+			os.Remove(filepath.Join(dir, entry.Name()))
+		}
+	}
+
+	return dm, nil
+}
+
+// level 0 is ordered newest table first, every other level by key range and
+// its tables must not overlap
+func orderLevels(levels []*Level) error {
+	for levelIndex, level := range levels {
+		if levelIndex == 0 {
+			sort.Slice(level.tables, func(i, j int) bool {
+				return level.tables[i].fileNumber > level.tables[j].fileNumber
+			})
+
+			continue
+		}
+
+		sort.Slice(level.tables, func(i, j int) bool {
+			iStart, _ := level.tables[i].GetBoundaries()
+			jStart, _ := level.tables[j].GetBoundaries()
+
+			return bytes.Compare(iStart, jStart) < 0
+		})
+
+		for i := 1; i < level.size(); i++ {
+			_, previousEnd := level.tables[i-1].GetBoundaries()
+			start, _ := level.tables[i].GetBoundaries()
+
+			if bytes.Compare(previousEnd, start) >= 0 {
+				return types.NewEngineError(
+					types.DISKMANAGER_INCONSISTENT_DIR_ERROR,
+					fmt.Sprintf(
+						"tables %s and %s of level %d overlap",
+						level.tables[i-1].filePath, level.tables[i].filePath, levelIndex,
+					),
+				)
+			}
+		}
+	}
+
+	return nil
+}
+
+// tables written before the manifest existed are named L<level>_<uuid>.data,
+// they are renamed to numbered files in the order they were created
+func importUnversionedTables(dir string) (ManifestState, error) {
+	entries, err := os.ReadDir(dir)
+
+	if err != nil {
+		return ManifestState{}, types.NewEngineError(
+			types.TABLE_READ_FILE_ERROR,
+			fmt.Sprintf("data directory read error : %s", err.Error()),
+		)
+	}
+
+	var tables []*Table
+	state := ManifestState{NextFileNumber: 1}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), tableFileSuffix) {
+			continue
+		}
+
+		level, id, ok := parseTableFileName(entry.Name())
+
+		if !ok {
+			return ManifestState{}, types.NewEngineError(
+				types.DISKMANAGER_INCONSISTENT_DIR_ERROR,
+				fmt.Sprintf("unexpected table file name %s", entry.Name()),
+			)
+		}
+
+		table, err := ReadTablesFromDisk(filepath.Join(dir, entry.Name()))
+
+		if err != nil {
+			return ManifestState{}, types.NewEngineError(
+				types.DISKMANAGER_INCONSISTENT_DIR_ERROR,
+				fmt.Sprintf("unable to recover table %s : %s", entry.Name(), err.Error()),
+			)
+		}
+
+		if table.metaData.level != level {
+			return ManifestState{}, types.NewEngineError(
+				types.DISKMANAGER_INCONSISTENT_DIR_ERROR,
+				fmt.Sprintf(
+					"table %s is named for level %d but its header says level %d",
+					entry.Name(), level, table.metaData.level,
+				),
+			)
+		}
+
+		// new names must not clobber files that are already numbered
+		if fileNumber, err := strconv.Atoi(id); err == nil && fileNumber >= state.NextFileNumber {
+			state.NextFileNumber = fileNumber + 1
+		}
+
+		tables = append(tables, table)
+	}
+
+	sort.Slice(tables, func(i, j int) bool {
+		return tables[i].metaData.createdAt < tables[j].metaData.createdAt
+	})
+
+	for _, table := range tables {
+		fileName := tableFileName(dir, table.metaData.level, state.NextFileNumber)
+
+		if err := os.Rename(table.filePath, fileName); err != nil {
+			return ManifestState{}, types.NewEngineError(
+				types.DISKMANAGER_INCONSISTENT_DIR_ERROR,
+				fmt.Sprintf("unable to rename table %s : %s", table.filePath, err.Error()),
+			)
+		}
+
+		state.apply(VersionEdit{
+			addedTables:    []tableEdit{{level: table.metaData.level, fileNumber: state.NextFileNumber}},
+			nextFileNumber: state.NextFileNumber + 1,
+		})
+	}
+
+	return state, nil
+}
+
+// every wal segment numbered below LogNumber is already covered by a table
+func (dm *DiskManager) LogNumber() int {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+
+	return dm.logNumber
+}
+
+// newest sequence number that made it into a table
+func (dm *DiskManager) LastSequence() uint64 {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+
+	return dm.lastSequence
+}
+
+// source of the live snapshots whose versions flushes and compactions keep
+func (dm *DiskManager) SetSnapshotSource(snapshots func() []uint64) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	dm.snapshots = snapshots
+}
+
+// settings of the tables written from now on, compactions rewrite older
+// tables with them
+func (dm *DiskManager) SetTableOptions(options TableOptions) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	dm.tableOptions = options
+}
+
+/*
+caches the blocks the tables read in cache, and their index and filter as
+well with cacheIndexAndFilter. It has to be set before the first flush, the
+tables already open are attached right away.
+*/
+func (dm *DiskManager) SetBlockCache(cache *BlockCache, cacheIndexAndFilter bool) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	dm.blockCache = cache
+	dm.cacheIndexAndFilter = cacheIndexAndFilter
+
+	if cache == nil {
+		return
+	}
+
+	for _, level := range dm.current.levels {
+		for _, table := range level.tables {
+			table.setBlockCache(cache, cacheIndexAndFilter)
+		}
+	}
+}
+
+// hits, misses and usage of the block cache, zero without one
+func (dm *DiskManager) BlockCacheStats() BlockCacheStats {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+
+	if dm.blockCache == nil {
+		return BlockCacheStats{}
 	}
+
+	return dm.blockCache.Stats()
 }
 
-// flushing data to disk and trigger compaction
-func (dm *DiskManager) Flush(records []types.Record) error {
+// keeps the files of the tables open in cache between reads, it has to be
+// set before the first flush
+func (dm *DiskManager) SetTableCache(cache *TableCache) {
 	dm.mu.Lock()
 	defer dm.mu.Unlock()
 
-	table, err := CreateNewTableToDisk(records, dm.dir)
+	dm.tableCache = cache
+
+	if cache == nil {
+		return
+	}
+
+	for _, level := range dm.current.levels {
+		for _, table := range level.tables {
+			table.setTableCache(cache)
+		}
+	}
+}
+
+// hits, misses and open files of the table cache, zero without one
+func (dm *DiskManager) TableCacheStats() TableCacheStats {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+
+	if dm.tableCache == nil {
+		return TableCacheStats{}
+	}
+
+	return dm.tableCache.Stats()
+}
+
+// number of compactions allowed to run in the background at once
+func (dm *DiskManager) SetMaxBackgroundCompactions(n int) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	dm.maxBackgroundCompactions = max(n, 1)
+}
+
+// the current version with a reference the caller has to drop with unref
+func (dm *DiskManager) acquireVersion() *version {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+
+	dm.current.ref()
+
+	return dm.current
+}
+
+// swaps in the version following the current one, callers hold dm.mu
+func (dm *DiskManager) installVersion(added []*Table, removed []*Table) {
+	if dm.blockCache != nil {
+		for _, table := range added {
+			table.setBlockCache(dm.blockCache, dm.cacheIndexAndFilter)
+		}
+	}
+
+	if dm.tableCache != nil {
+		for _, table := range added {
+			table.setTableCache(dm.tableCache)
+		}
+	}
+
+	previous := dm.current
+	dm.current = previous.next(added, removed)
+	previous.unref()
+}
+
+// live snapshot sequence numbers in ascending order
+func (dm *DiskManager) liveSnapshots() []uint64 {
+	if dm.snapshots == nil {
+		return nil
+	}
+
+	snapshots := dm.snapshots()
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i] < snapshots[j] })
+
+	return snapshots
+}
+
+func (dm *DiskManager) newFileNumber() int {
+	fileNumber := dm.nextFileNumber
+	dm.nextFileNumber++
+
+	return fileNumber
+}
+
+// records the edit in the manifest before it becomes visible in memory
+func (dm *DiskManager) logAndApply(edit VersionEdit) error {
+	edit.nextFileNumber = dm.nextFileNumber
+
+	if dm.manifest != nil {
+		if err := dm.manifest.append(edit); err != nil {
+			return err
+		}
+	}
+
+	if edit.logNumber != editFieldUnsetMarker {
+		dm.logNumber = edit.logNumber
+	}
+
+	if edit.lastSequence > dm.lastSequence {
+		dm.lastSequence = edit.lastSequence
+	}
+
+	return nil
+}
+
+// flushing data to disk and schedule compactions, logNumber is the first wal
+// segment that is not part of records
+func (dm *DiskManager) Flush(records []types.Record, logNumber int) error {
+	dm.mu.Lock()
+	if dm.backgroundErr != nil {
+		dm.mu.Unlock()
+		return dm.backgroundErr
+	}
+
+	// tombstones have to reach the lower levels to hide the versions there
+	records = filterVersions(records, dm.liveSnapshots(), false)
+	fileNumber := dm.newFileNumber()
+	options := dm.tableOptions
+	dm.mu.Unlock()
+
+	table, err := createTable(records, dm.dir, 0, fileNumber, options)
 	if err != nil {
 		return err
 	}
 
-	dm.levels[0].push(table)
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
 
-	err = dm.checkAndCompact()
+	edit := VersionEdit{logNumber: logNumber}
+	edit.AddTable(0, table.fileNumber)
 
-	if err != nil {
+	for _, record := range records {
+		if record.SeqNum > edit.lastSequence {
+			edit.lastSequence = record.SeqNum
+		}
+	}
+
+	if err := dm.logAndApply(edit); err != nil {
+		table.Delete()
 		return err
 	}
 
+	dm.installVersion([]*Table{table}, nil)
+	dm.maybeScheduleCompaction()
+
 	return nil
 }
 
-func (dm *DiskManager) checkAndCompact() error {
-	for levelIndex, level := range dm.levels {
-		if level.size() > dm.l0Target*int(math.Pow(float64(dm.levelRatio), float64(levelIndex))) {
-			err := dm.compact(levelIndex)
-			if err != nil {
-				return err
-			}
+// size of the tables compactions write, tables already written keep theirs
+func (dm *DiskManager) SetTargetFileSize(size int) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	dm.targetFileSize = max(size, 1)
+}
+
+// the strategy picking the tables compactions merge, leveled compaction
+// unless set otherwise. a periodic strategy is also asked on a timer
+func (dm *DiskManager) SetCompactionStrategy(strategy CompactionStrategy) {
+	dm.stopPeriodicCompactions()
+
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	dm.compactionStrategy = strategy
+
+	if periodic, ok := strategy.(PeriodicCompactionStrategy); ok && periodic.CheckInterval() > 0 && !dm.closing {
+		dm.stopPeriodic = make(chan struct{})
+		dm.periodicDone = make(chan struct{})
+		go dm.periodicCompactions(periodic.CheckInterval(), dm.stopPeriodic, dm.periodicDone)
+	}
+}
+
+func (dm *DiskManager) periodicCompactions(interval time.Duration, stop, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			dm.mu.Lock()
+			dm.maybeScheduleCompaction()
+			dm.mu.Unlock()
+		case <-stop:
+			return
 		}
 	}
+}
 
-	return nil
+// waits for the timer of the periodic strategy to stop, called without dm.mu
+// as the timer takes it
+func (dm *DiskManager) stopPeriodicCompactions() {
+	dm.mu.Lock()
+	stop, done := dm.stopPeriodic, dm.periodicDone
+	dm.stopPeriodic, dm.periodicDone = nil, nil
+	dm.mu.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
 }
 
-func (dm *DiskManager) compact(levelIndex int) error {
-	// do the compaction for the ln and ln+1 tables
-	if len(dm.levels) < levelIndex+1 {
-		dm.levels = append(dm.levels, &Level{})
+// starts a background compaction for every compaction the strategy asks for,
+// as long as the concurrency limit allows. a level takes part in at most one
+// running compaction. callers hold dm.mu
+func (dm *DiskManager) maybeScheduleCompaction() {
+	busy := func(level int) bool { return dm.compactingLevels[level] }
+
+	for !dm.closing && dm.backgroundErr == nil && dm.runningCompactions < dm.maxBackgroundCompactions {
+		c, ok := dm.compactionStrategy.PickCompaction(tableInfos(dm.current), busy)
+		if !ok || len(c.Inputs) == 0 {
+			return
+		}
+
+		dm.compactingLevels[c.Level] = true
+		dm.compactingLevels[c.OutputLevel] = true
+		dm.runningCompactions++
+
+		go dm.backgroundCompaction(c)
 	}
+}
 
-	lnTables := dm.levels[levelIndex].GetAll()
+// the tables of every level of v as compaction strategies see them
+func tableInfos(v *version) [][]TableInfo {
+	levels := make([][]TableInfo, len(v.levels))
+	for levelIndex, level := range v.levels {
+		for _, table := range level.tables {
+			smallestKey, largestKey := table.GetBoundaries()
+
+			levels[levelIndex] = append(levels[levelIndex], TableInfo{
+				FileNumber:  table.fileNumber,
+				Size:        table.metaData.fileSize,
+				SmallestKey: smallestKey,
+				LargestKey:  largestKey,
+				CreatedAt:   table.metaData.createdAt,
+			})
+		}
+	}
+
+	return levels
+}
 
-	nextLevelTables := dm.levels[levelIndex+1].GetAll()
+func (dm *DiskManager) backgroundCompaction(c Compaction) {
+	err := dm.compact(c)
+
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	if err != nil && dm.backgroundErr == nil {
+		dm.backgroundErr = types.NewEngineError(
+			types.TABLE_MERGE_ERROR,
+			fmt.Sprintf("background compaction error : %s", err.Error()),
+		)
+	}
+
+	delete(dm.compactingLevels, c.Level)
+	delete(dm.compactingLevels, c.OutputLevel)
+	dm.runningCompactions--
+
+	// the compaction may have pushed the next level over its target
+	dm.maybeScheduleCompaction()
+	dm.compactionDone.Broadcast()
+}
+
+// blocks until no compaction is running or scheduled and returns the error
+// that stopped them, if any
+func (dm *DiskManager) WaitForCompactions() error {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	for dm.runningCompactions > 0 {
+		dm.compactionDone.Wait()
+	}
+
+	return dm.backgroundErr
+}
+
+/*
+merges the input tables of the compaction with the tables of the output
+level they overlap. Merged into the level below, the records are cut into
+tables of about the target file size, so the tables of every level below 0
+stay disjoint and bounded. Merged in place in level 0 they make one table.
+Either way the tombstones are kept while a table left out of the merge, in
+the output level or below, may hold what they delete.
+The tables are read and written without holding dm.mu and the result is
+swapped in as a new version at the end.
+*/
+func (dm *DiskManager) compact(c Compaction) error {
+	dm.mu.Lock()
+	v := dm.current
+	v.ref()
+	snapshots := dm.liveSnapshots()
+	targetFileSize := dm.targetFileSize
+	strategy := dm.compactionStrategy
+	dm.mu.Unlock()
+
+	defer v.unref()
+
+	levelIndex, outputLevel := c.Level, c.OutputLevel
+	if c.Drop && levelIndex < len(v.levels) && outputLevel == levelIndex {
+		lnTables, err := compactionTables(v.levels[levelIndex], c.Inputs)
+		if err != nil {
+			return err
+		}
+
+		return dm.dropTables(levelIndex, lnTables)
+	}
+
+	// a compaction may pass over levels only while they hold no table
+	skipsTables := false
+	for skipped := levelIndex + 1; skipped < outputLevel && skipped < len(v.levels); skipped++ {
+		skipsTables = skipsTables || len(v.levels[skipped].tables) != 0
+	}
+
+	if c.Drop || levelIndex >= len(v.levels) || skipsTables || outputLevel <= levelIndex && (outputLevel != levelIndex || levelIndex != 0) {
+		return types.NewEngineError(
+			types.TABLE_MERGE_ERROR,
+			fmt.Sprintf("%s compaction of level %d into level %d is not possible", strategy.Name(), levelIndex, outputLevel),
+		)
+	}
+
+	lnTables, err := compactionTables(v.levels[levelIndex], c.Inputs)
+	if err != nil {
+		return err
+	}
+
+	var nextLevelTables []*Table
+	if outputLevel != levelIndex && outputLevel < len(v.levels) && len(lnTables) != 0 {
+		start, end := keyRange(lnTables)
+		nextLevelTables = getOverlap(v.levels[outputLevel], start, end)
+	}
 
 	var t [][]*Table
 	t = append(t, lnTables)
@@ -78,40 +711,198 @@ func (dm *DiskManager) compact(levelIndex int) error {
 		for _, table := range tables {
 			record, err := table.getAllEntries()
 			if err != nil {
-				panic(err)
+				return types.NewEngineError(
+					types.TABLE_MERGE_ERROR,
+					fmt.Sprintf("unable to read table %s for compaction : %s", table.filePath, err.Error()),
+				)
 			}
 
 			r = append(r, record)
 		}
 	}
 
-	mergedRecords := merge(r)
-	mergedTables, err := CreateNewTableToDisk(mergedRecords, dm.dir)
+	// a tombstone is dropped only when no table the merge leaves out may
+	// hold an older version of its key, which would show through again
+	dropTombstones := false
+	if len(lnTables) != 0 {
+		start, end := keyRange(lnTables)
+		merged := append(lnTables[:len(lnTables):len(lnTables)], nextLevelTables...)
+		dropTombstones = !overlapsOlderTables(v, merged, outputLevel, start, end)
+	}
 
-	if err != nil {
-		return err
+	runs := [][]types.Record{}
+	mergedRecords := merge(r, snapshots, dropTombstones)
+
+	if outputLevel != levelIndex {
+		runs = splitRecords(mergedRecords, targetFileSize)
+	} else if len(mergedRecords) != 0 {
+		runs = append(runs, mergedRecords)
 	}
 
-	for _, lntable := range lnTables {
-		dm.levels[levelIndex].delete(func(table *Table) bool {
-			return strings.EqualFold(table.filePath, lntable.filePath)
-		})
+	var edit VersionEdit
+	var added []*Table
+	for _, records := range runs {
+		dm.mu.Lock()
+		fileNumber := dm.newFileNumber()
+		options := dm.tableOptions
+		dm.mu.Unlock()
+
+		mergedTable, err := createTable(records, dm.dir, outputLevel, fileNumber, options)
+
+		if err != nil {
+			for _, table := range added {
+				table.Delete()
+			}
+
+			return err
+		}
+
+		edit.AddTable(outputLevel, mergedTable.fileNumber)
+		added = append(added, mergedTable)
+	}
+
+	for _, table := range lnTables {
+		edit.DeleteTable(levelIndex, table.fileNumber)
 	}
 
 	for _, table := range nextLevelTables {
-		dm.levels[levelIndex+1].delete(func(_table *Table) bool {
-			return strings.EqualFold(_table.filePath, table.filePath)
-		})
+		edit.DeleteTable(outputLevel, table.fileNumber)
+	}
+
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	if err := dm.logAndApply(edit); err != nil {
+		for _, table := range added {
+			table.Delete()
+		}
+
+		return err
+	}
+
+	dm.installVersion(added, append(lnTables[:len(lnTables):len(lnTables)], nextLevelTables...))
+
+	return nil
+}
+
+// removes the tables of the level from the store, their files go once no
+// version refers to them
+func (dm *DiskManager) dropTables(levelIndex int, tables []*Table) error {
+	var edit VersionEdit
+	for _, table := range tables {
+		edit.DeleteTable(levelIndex, table.fileNumber)
+	}
+
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	if err := dm.logAndApply(edit); err != nil {
+		return err
 	}
 
-	dm.levels[levelIndex+1].push(mergedTables)
+	dm.installVersion(nil, tables)
 
 	return nil
 }
 
-func merge(records [][]types.Record) []types.Record {
+// the tables of the level with the file numbers, in the order of the level
+func compactionTables(level *Level, fileNumbers []int) ([]*Table, error) {
+	wanted := map[int]bool{}
+	for _, fileNumber := range fileNumbers {
+		wanted[fileNumber] = true
+	}
+
+	var tables []*Table
+	for _, table := range level.tables {
+		if wanted[table.fileNumber] {
+			tables = append(tables, table)
+		}
+	}
+
+	if len(tables) != len(wanted) {
+		return nil, types.NewEngineError(
+			types.TABLE_MERGE_ERROR,
+			fmt.Sprintf("compaction inputs %v are not all tables of the level", fileNumbers),
+		)
+	}
+
+	return tables, nil
+}
+
+/*
+whether a table of v other than the merged ones, in the output level or
+below, intersects [start, end]. The levels above the output level only hold
+versions newer than the merged tables, but level 0 merged in place may
+leave out tables older than the merged ones, so there every table counts.
+*/
+func overlapsOlderTables(v *version, merged []*Table, outputLevel int, start, end []byte) bool {
+	given := map[*Table]bool{}
+	for _, table := range merged {
+		given[table] = true
+	}
+
+	for _, level := range v.levels[min(outputLevel, len(v.levels)):] {
+		for _, table := range getOverlap(level, start, end) {
+			if !given[table] {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// the smallest and the largest key of the tables
+func keyRange(tables []*Table) ([]byte, []byte) {
+	start, end := tables[0].GetBoundaries()
+	for _, table := range tables[1:] {
+		first, last := table.GetBoundaries()
+
+		if bytes.Compare(first, start) < 0 {
+			start = first
+		}
+
+		if bytes.Compare(last, end) > 0 {
+			end = last
+		}
+	}
+
+	return start, end
+}
+
+// cuts the sorted records into runs of about targetSize bytes of keys and
+// values, never between two versions of a key, which would leave two tables
+// of a level sharing it
+func splitRecords(records []types.Record, targetSize int) [][]types.Record {
+	var runs [][]types.Record
+
+	start, size := 0, 0
+	for i, record := range records {
+		if size >= targetSize && !bytes.Equal(records[i-1].Key, record.Key) {
+			runs = append(runs, records[start:i])
+			start, size = i, 0
+		}
+
+		size += len(record.Key) + len(record.Value)
+	}
+
+	if start < len(records) {
+		runs = append(runs, records[start:])
+	}
+
+	return runs
+}
+
+// k-way merge of sorted record runs, runs with a lower index are newer and
+// win on equal sequence numbers. versions no snapshot can observe are dropped,
+// tombstones only with dropTombstones.
+func merge(records [][]types.Record, snapshots []uint64, dropTombstones bool) []types.Record {
 	var r []types.Element
 	for idx, record := range records {
+		if len(record) == 0 {
+			continue
+		}
+
 		element := types.Element{
 			Entry: record[0], Index: idx,
 		}
@@ -121,36 +912,78 @@ func merge(records [][]types.Record) []types.Record {
 
 	elementHeap := types.InitHeap(r)
 
-	var mergedElements []types.Element
+	var merged []types.Record
 	for elementHeap.Len() != 0 {
-		topElement, _ := elementHeap.Pop().(types.Element)
-		element := records[topElement.Index][0]
+		topElement := heap.Pop(elementHeap).(types.Element)
 
 		if len(records[topElement.Index]) != 0 {
+			heap.Push(elementHeap, types.Element{
+				Entry: records[topElement.Index][0], Index: topElement.Index,
+			})
 			records[topElement.Index] = records[topElement.Index][1:]
 		}
 
-		mergedElements = append(mergedElements, topElement)
+		merged = append(merged, topElement.Entry)
+	}
 
-		elementHeap.Push(element)
+	return filterVersions(merged, snapshots, dropTombstones)
+}
+
+/*
+filterVersions thins out records sorted by key and newest version first.
+snapshots, in ascending order, split the versions of a key into stripes, a
+stripe holding the versions a snapshot sees but the one before it does not,
+plus the stripe above every snapshot that only current readers see. Only the
+newest version of every stripe can be observed, so that is the one kept.
+
+dropTombstones drops a tombstone no snapshot observes when nothing older of
+its key is kept, hiding a version that is no longer there.
+*/
+func filterVersions(records []types.Record, snapshots []uint64, dropTombstones bool) []types.Record {
+	stripe := func(seqNum uint64) int {
+		return sort.Search(len(snapshots), func(i int) bool { return snapshots[i] >= seqNum })
 	}
 
-	var merged []types.Record
-	for _, element := range mergedElements {
-		if !element.Entry.TombStone {
-			merged = append(merged, element.Entry)
+	var filtered []types.Record
+	for start := 0; start < len(records); {
+		end := start + 1
+		for end < len(records) && bytes.Equal(records[end].Key, records[start].Key) {
+			end++
 		}
+
+		keyStart := len(filtered)
+		lastStripe := -1
+		for _, record := range records[start:end] {
+			if recordStripe := stripe(record.SeqNum); recordStripe != lastStripe {
+				filtered = append(filtered, record)
+				lastStripe = recordStripe
+			}
+		}
+
+		// the newest stripe is the top one whenever it is the only one kept
+		if dropTombstones && len(filtered) == keyStart+1 &&
+			filtered[keyStart].TombStone && lastStripe == len(snapshots) {
+			filtered = filtered[:keyStart]
+		}
+
+		start = end
 	}
 
-	return merged
+	return filtered
 }
 
 func (dm *DiskManager) Get(key []byte) (types.Record, error) {
-	dm.mu.RLock()
-	defer dm.mu.RUnlock()
+	return dm.GetAt(key, math.MaxUint64, false)
+}
+
+// the newest version of key with a sequence number of at most seqNum, with
+// verifyChecksums the blocks read are checked against their crc32c
+func (dm *DiskManager) GetAt(key []byte, seqNum uint64, verifyChecksums bool) (types.Record, error) {
+	v := dm.acquireVersion()
+	defer v.unref()
 
-	for _, level := range dm.levels {
-		record, err := level.ScanAllTables(key)
+	for _, level := range v.levels {
+		record, err := level.ScanAllTablesAt(key, seqNum, verifyChecksums)
 
 		if err != nil &&
 			err.(*types.EngineError).GetErrorCode() != types.TABLE_KEY_SEARCH_NOT_FOUND {
@@ -165,3 +998,27 @@ func (dm *DiskManager) Get(key []byte) (types.Record, error) {
 		fmt.Sprintf("key (%x) not found in any level!", key),
 	)
 }
+
+// waits for the running compactions and closes the cached table files, the
+// current version keeps its tables
+func (dm *DiskManager) Close() error {
+	dm.stopPeriodicCompactions()
+
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	dm.closing = true
+	for dm.runningCompactions > 0 {
+		dm.compactionDone.Wait()
+	}
+
+	if dm.tableCache != nil {
+		dm.tableCache.evictAll()
+	}
+
+	if dm.manifest == nil {
+		return nil
+	}
+
+	return dm.manifest.close()
+}
@@ -0,0 +1,583 @@
+package disk
+
+import (
+	"LsmStorageEngine/types"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func levelFileNumbers(dm *DiskManager) [][]int {
+	var levels [][]int
+	for _, level := range dm.current.levels {
+		var fileNumbers []int
+		for _, table := range level.tables {
+			fileNumbers = append(fileNumbers, table.fileNumber)
+		}
+
+		levels = append(levels, fileNumbers)
+	}
+
+	return levels
+}
+
+func TestOpenDiskManagerRecoversLevelsFromManifest(t *testing.T) {
+	_, err := os.Stat(dataDir)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(dataDir, 0755)
+
+		if err != nil {
+			t.Errorf("test failed due to data dir creation error : %s", err.Error())
+			return
+		}
+	}
+	defer os.RemoveAll(dataDir)
+
+	dm, err := OpenDiskManager(10, 1, dataDir)
+
+	if err != nil {
+		t.Errorf("test failed due to disk manager open error : %s", err.Error())
+		return
+	}
+
+	for i, d := range data {
+		if err := dm.Flush(d.records, i+2); err != nil {
+			t.Errorf("test failed due to flush error : %s", err.Error())
+			return
+		}
+
+		assert.NoError(t, dm.WaitForCompactions())
+	}
+
+	layout := levelFileNumbers(dm)
+	dm.Close()
+
+	dm, err = OpenDiskManager(10, 1, dataDir)
+
+	if err != nil {
+		t.Errorf("test failed due to disk manager open error : %s", err.Error())
+		return
+	}
+	defer dm.Close()
+
+	assert.Equal(t, layout, levelFileNumbers(dm))
+	assert.Equal(t, len(data)+1, dm.LogNumber())
+	assert.Equal(t, 1, dm.current.levels[1].tables[0].metaData.level)
+
+	record, err := dm.Get(toBytes("k10"))
+	assert.NoError(t, err)
+	assert.Equal(t, toBytes("v10"), record.Value)
+}
+
+func TestOpenDiskManagerImportsUnversionedTables(t *testing.T) {
+	_, err := os.Stat(dataDir)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(dataDir, 0755)
+
+		if err != nil {
+			t.Errorf("test failed due to data dir creation error : %s", err.Error())
+			return
+		}
+	}
+	defer os.RemoveAll(dataDir)
+
+	for i, name := range []string{"L0_older.data", "L0_newer.data", "L1_bottom.data"} {
+		level, _, _ := parseTableFileName(name)
+		table, err := CreateNewTableToDisk(data[i].records, dataDir, level, i+1)
+		assert.NoError(t, err)
+		os.Rename(table.filePath, filepath.Join(dataDir, name))
+	}
+
+	dm, err := OpenDiskManager(10, 4, dataDir)
+
+	if err != nil {
+		t.Errorf("test failed due to disk manager open error : %s", err.Error())
+		return
+	}
+	defer dm.Close()
+
+	assert.Equal(t, [][]int{{2, 1}, {3}}, levelFileNumbers(dm))
+
+	record, err := dm.Get(toBytes("k5"))
+	assert.NoError(t, err)
+	assert.Equal(t, toBytes("v5"), record.Value)
+
+	_, err = os.Stat(filepath.Join(dataDir, currentFileName))
+	assert.NoError(t, err)
+}
+
+func TestOpenDiskManagerImportsBaselineTables(t *testing.T) {
+	_, err := os.Stat(dataDir)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(dataDir, 0755)
+
+		if err != nil {
+			t.Errorf("test failed due to data dir creation error : %s", err.Error())
+			return
+		}
+	}
+	defer os.RemoveAll(dataDir)
+
+	// written by the first version of the engine, whose header has no
+	// creation time and whose records have no sequence number. The newer
+	// table overwrites banana and deletes cherry
+	tables := []string{
+		"L0_160dd323-49ee-41ae-a0d9-7593ee8d229f.data",
+		"L0_2aaf1b5a-68db-446e-aa6f-4d4d29569d30.data",
+	}
+	createdAt := time.Now().Add(-time.Hour)
+	for i, name := range tables {
+		content, err := os.ReadFile(filepath.Join("testdata", "baseline", name))
+		assert.NoError(t, err)
+
+		fileName := filepath.Join(dataDir, name)
+		assert.NoError(t, os.WriteFile(fileName, content, 0644))
+		assert.NoError(t, os.Chtimes(fileName, createdAt, createdAt.Add(time.Duration(i)*time.Minute)))
+	}
+
+	dm, err := OpenDiskManager(10, 4, dataDir)
+
+	if err != nil {
+		t.Errorf("test failed due to disk manager open error : %s", err.Error())
+		return
+	}
+	defer dm.Close()
+
+	assert.Equal(t, [][]int{{2, 1}}, levelFileNumbers(dm))
+
+	for key, value := range map[string]string{"apple": "red", "banana": "green", "damson": "purple"} {
+		record, err := dm.Get(toBytes(key))
+		assert.NoError(t, err)
+		assert.Equal(t, toBytes(value), record.Value)
+		assert.False(t, record.TombStone)
+	}
+
+	record, err := dm.Get(toBytes("cherry"))
+	assert.NoError(t, err)
+	assert.True(t, record.TombStone)
+}
+
+func TestOpenDiskManagerRemovesUnreferencedTables(t *testing.T) {
+	_, err := os.Stat(dataDir)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(dataDir, 0755)
+
+		if err != nil {
+			t.Errorf("test failed due to data dir creation error : %s", err.Error())
+			return
+		}
+	}
+	defer os.RemoveAll(dataDir)
+
+	dm, err := OpenDiskManager(10, 4, dataDir)
+	assert.NoError(t, err)
+	dm.Close()
+
+	// a table whose flush crashed before reaching the manifest
+	orphan, err := CreateNewTableToDisk(data[0].records, dataDir, 0, 7)
+	assert.NoError(t, err)
+
+	dm, err = OpenDiskManager(10, 4, dataDir)
+	assert.NoError(t, err)
+	defer dm.Close()
+
+	_, err = os.Stat(orphan.filePath)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestOpenDiskManagerRefusesOverlappingLevel(t *testing.T) {
+	_, err := os.Stat(dataDir)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(dataDir, 0755)
+
+		if err != nil {
+			t.Errorf("test failed due to data dir creation error : %s", err.Error())
+			return
+		}
+	}
+	defer os.RemoveAll(dataDir)
+
+	CreateNewTableToDisk(data[0].records, dataDir, 1, 1)
+	CreateNewTableToDisk(data[0].records, dataDir, 1, 2)
+
+	_, err = OpenDiskManager(10, 4, dataDir)
+	assert.Error(t, err)
+	assert.Equal(t, types.DISKMANAGER_INCONSISTENT_DIR_ERROR, err.(*types.EngineError).GetErrorCode())
+}
+
+func TestMergePicksNewestSequence(t *testing.T) {
+	// the run holding the newer versions is deliberately handed over last
+	older := []types.Record{
+		types.NewRecordWithSeqNum(toBytes("k1"), toBytes("old"), false, 1),
+		types.NewRecordWithSeqNum(toBytes("k2"), toBytes("old"), false, 2),
+		types.NewRecordWithSeqNum(toBytes("k3"), toBytes("v3"), false, 3),
+	}
+	newer := []types.Record{
+		types.NewRecordWithSeqNum(toBytes("k1"), toBytes("new"), false, 4),
+		types.NewRecordWithSeqNum(toBytes("k2"), nil, true, 5),
+	}
+
+	merged := merge([][]types.Record{older, newer}, nil, true)
+
+	assert.Equal(t, []types.Record{
+		types.NewRecordWithSeqNum(toBytes("k1"), toBytes("new"), false, 4),
+		types.NewRecordWithSeqNum(toBytes("k3"), toBytes("v3"), false, 3),
+	}, merged)
+}
+
+func TestMergeKeepsVersionsSeenBySnapshots(t *testing.T) {
+	older := []types.Record{
+		types.NewRecordWithSeqNum(toBytes("k1"), toBytes("v1"), false, 1),
+		types.NewRecordWithSeqNum(toBytes("k2"), toBytes("v2"), false, 2),
+		types.NewRecordWithSeqNum(toBytes("k3"), toBytes("v3"), false, 3),
+	}
+	newer := []types.Record{
+		types.NewRecordWithSeqNum(toBytes("k1"), toBytes("v1-c"), false, 5),
+		types.NewRecordWithSeqNum(toBytes("k1"), toBytes("v1-b"), false, 4),
+		types.NewRecordWithSeqNum(toBytes("k2"), nil, true, 6),
+		types.NewRecordWithSeqNum(toBytes("k3"), nil, true, 7),
+	}
+
+	// a snapshot taken at 4 still sees v1-b, v2 and v3
+	merged := merge([][]types.Record{newer, older}, []uint64{4, 6}, true)
+
+	assert.Equal(t, []types.Record{
+		types.NewRecordWithSeqNum(toBytes("k1"), toBytes("v1-c"), false, 5),
+		types.NewRecordWithSeqNum(toBytes("k1"), toBytes("v1-b"), false, 4),
+		types.NewRecordWithSeqNum(toBytes("k2"), nil, true, 6),
+		types.NewRecordWithSeqNum(toBytes("k2"), toBytes("v2"), false, 2),
+		types.NewRecordWithSeqNum(toBytes("k3"), nil, true, 7),
+		types.NewRecordWithSeqNum(toBytes("k3"), toBytes("v3"), false, 3),
+	}, merged)
+}
+
+func TestCompactionKeepsTablesOfHeldVersion(t *testing.T) {
+	_, err := os.Stat(dataDir)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(dataDir, 0755)
+
+		if err != nil {
+			t.Errorf("test failed due to data dir creation error : %s", err.Error())
+			return
+		}
+	}
+	defer os.RemoveAll(dataDir)
+
+	dm, err := OpenDiskManager(10, 1, dataDir)
+	assert.NoError(t, err)
+	defer dm.Close()
+
+	assert.NoError(t, dm.Flush(data[0].records, 2))
+
+	// a reader that started before the compaction
+	held := dm.acquireVersion()
+	heldTable := held.levels[0].tables[0]
+
+	assert.NoError(t, dm.Flush(data[1].records, 3))
+	assert.NoError(t, dm.WaitForCompactions())
+
+	assert.Equal(t, [][]int{nil, {3}}, levelFileNumbers(dm))
+
+	record, err := held.levels[0].ScanAllTables(toBytes("k2"))
+	assert.NoError(t, err)
+	assert.Equal(t, toBytes("v2"), record.Value)
+
+	held.unref()
+
+	_, err = os.Stat(heldTable.filePath)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestCompactionRewritesTablesWithCurrentCodec(t *testing.T) {
+	_, err := os.Stat(dataDir)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(dataDir, 0755)
+
+		if err != nil {
+			t.Errorf("test failed due to data dir creation error : %s", err.Error())
+			return
+		}
+	}
+	defer os.RemoveAll(dataDir)
+
+	dm, err := OpenDiskManager(10, 1, dataDir)
+	assert.NoError(t, err)
+	defer dm.Close()
+
+	var records []types.Record
+	for i := 0; i < 500; i++ {
+		key := []byte(fmt.Sprintf("tenant/%03d/user/%05d", i/50, i))
+		records = append(records, types.NewRecordWithSeqNum(key, bytes.Repeat([]byte("v"), 50), false, uint64(i+1)))
+	}
+
+	assert.NoError(t, dm.Flush(records[:250], 2))
+
+	dm.SetTableOptions(TableOptions{Compression: LZCompression})
+	assert.NoError(t, dm.Flush(records[250:], 3))
+	assert.NoError(t, dm.WaitForCompactions())
+
+	v := dm.acquireVersion()
+	defer v.unref()
+
+	assert.Len(t, v.levels[1].tables, 1)
+	table := v.levels[1].tables[0]
+
+	fd, err := os.Open(table.filePath)
+	assert.NoError(t, err)
+	defer fd.Close()
+
+	for _, entry := range table.indexBlock.lookUpTable {
+		block, err := readBlock(fd, blockHandle{offset: entry.offset, size: entry.size})
+		assert.NoError(t, err)
+		assert.Equal(t, byte(LZCompression), block[len(block)-checksumSize-1])
+	}
+
+	allEntries, err := table.getAllEntries()
+	assert.NoError(t, err)
+	assert.Equal(t, records, allEntries)
+}
+
+func TestSplitRecordsKeepsVersionsTogether(t *testing.T) {
+	var records []types.Record
+	for i := 0; i < 10; i++ {
+		for seqNum := uint64(3); seqNum > 0; seqNum-- {
+			records = append(records, types.NewRecordWithSeqNum([]byte(fmt.Sprintf("k%d", i)), []byte("vvvv"), false, seqNum))
+		}
+	}
+
+	// 6 bytes a record, a run is cut once it holds 20 bytes
+	runs := splitRecords(records, 20)
+	assert.Len(t, runs, 5)
+
+	var joined []types.Record
+	for i, run := range runs {
+		assert.Len(t, run, 6)
+		if i > 0 {
+			assert.NotEqual(t, runs[i-1][len(runs[i-1])-1].Key, run[0].Key)
+		}
+
+		joined = append(joined, run...)
+	}
+	assert.Equal(t, records, joined)
+
+	assert.Nil(t, splitRecords(nil, 20))
+}
+
+func TestLeveledCompactionKeepsLevelsDisjoint(t *testing.T) {
+	_, err := os.Stat(dataDir)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(dataDir, 0755)
+
+		if err != nil {
+			t.Errorf("test failed due to data dir creation error : %s", err.Error())
+			return
+		}
+	}
+	defer os.RemoveAll(dataDir)
+
+	dm, err := OpenDiskManager(2, 1, dataDir)
+	assert.NoError(t, err)
+	defer dm.Close()
+
+	strategy := NewLeveledCompactionStrategy(2, 1)
+	strategy.SetLevelBaseBytes(8 << 10)
+	dm.SetCompactionStrategy(strategy)
+	dm.SetTargetFileSize(1 << 10)
+
+	seqNum := uint64(0)
+	latest := map[string][]byte{}
+	for batch := 0; batch < 30; batch++ {
+		var records []types.Record
+		for i := 0; i < 100; i++ {
+			seqNum++
+			key := []byte(fmt.Sprintf("k%05d", (i*97+batch*31)%1000*7))
+			value := []byte(fmt.Sprintf("value-%d", seqNum))
+			records = append(records, types.NewRecordWithSeqNum(key, value, false, seqNum))
+			latest[string(key)] = value
+		}
+
+		sort.Slice(records, func(i, j int) bool { return bytes.Compare(records[i].Key, records[j].Key) < 0 })
+		assert.NoError(t, dm.Flush(records, batch+2))
+	}
+	assert.NoError(t, dm.WaitForCompactions())
+
+	v := dm.acquireVersion()
+	defer v.unref()
+
+	levelsWithManyTables := 0
+	for levelIndex, level := range v.levels[1:] {
+		if level.size() > 1 {
+			levelsWithManyTables++
+		}
+
+		for i, table := range level.tables {
+			entries, err := table.getAllEntries()
+			assert.NoError(t, err)
+
+			size := 0
+			for _, entry := range entries {
+				size += len(entry.Key) + len(entry.Value)
+			}
+			assert.Less(t, size, 1<<10+32, "table %d of level %d", i, levelIndex+1)
+
+			if i > 0 {
+				_, previousLast := level.tables[i-1].GetBoundaries()
+				first, _ := table.GetBoundaries()
+				assert.Negative(t, bytes.Compare(previousLast, first))
+			}
+		}
+	}
+	assert.NotZero(t, levelsWithManyTables)
+	assert.Greater(t, len(v.levels), 3)
+
+	for key, value := range latest {
+		record, err := dm.Get([]byte(key))
+		assert.NoError(t, err)
+		assert.Equal(t, value, record.Value)
+	}
+}
+
+// compacts the level the way the leveled strategy does, whatever its size
+func compactLevel(dm *DiskManager, levelIndex int) error {
+	dm.mu.Lock()
+	c := dm.compactionStrategy.(*LeveledCompactionStrategy).compactionOf(tableInfos(dm.current)[levelIndex], levelIndex, levelIndex+1)
+	dm.mu.Unlock()
+
+	return dm.compact(c)
+}
+
+func TestCompactionMergesOnlyOverlappingTables(t *testing.T) {
+	_, err := os.Stat(dataDir)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(dataDir, 0755)
+
+		if err != nil {
+			t.Errorf("test failed due to data dir creation error : %s", err.Error())
+			return
+		}
+	}
+	defer os.RemoveAll(dataDir)
+
+	// large targets, compactions only run when asked for
+	dm, err := OpenDiskManager(10, 100, dataDir)
+	assert.NoError(t, err)
+	defer dm.Close()
+
+	dm.SetTargetFileSize(100)
+
+	seqNum := uint64(0)
+	records := func(from, to int) []types.Record {
+		var records []types.Record
+		for i := from; i < to; i++ {
+			seqNum++
+			records = append(records, types.NewRecordWithSeqNum([]byte(fmt.Sprintf("k%03d", i)), []byte("value"), false, seqNum))
+		}
+
+		return records
+	}
+
+	// ten records of 9 bytes a table
+	assert.NoError(t, dm.Flush(records(0, 50), 2))
+	assert.NoError(t, compactLevel(dm, 0))
+
+	levels := levelFileNumbers(dm)
+	assert.Len(t, levels[1], 5)
+
+	assert.NoError(t, dm.Flush(records(12, 15), 3))
+	assert.NoError(t, compactLevel(dm, 0))
+
+	// only the second table of level 1 holds keys of the flushed table
+	after := levelFileNumbers(dm)
+	assert.Len(t, after[1], 5)
+	assert.Equal(t, []int{levels[1][0]}, after[1][:1])
+	assert.Equal(t, levels[1][2:], after[1][2:])
+	assert.NotEqual(t, levels[1][1], after[1][1])
+
+	// level 1 is compacted a table at a time, in key order
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, compactLevel(dm, 1))
+
+		levels := levelFileNumbers(dm)
+		assert.ElementsMatch(t, after[1][i+1:], levels[1])
+		assert.Len(t, levels[2], i+1)
+	}
+
+	assert.NoError(t, compactLevel(dm, 2))
+	assert.Len(t, levelFileNumbers(dm)[3], 1)
+
+	for i := 0; i < 50; i++ {
+		_, err := dm.Get([]byte(fmt.Sprintf("k%03d", i)))
+		assert.NoError(t, err)
+	}
+}
+
+func TestOpenDiskManagerRefusesCorruptedManifest(t *testing.T) {
+	_, err := os.Stat(dataDir)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(dataDir, 0755)
+
+		if err != nil {
+			t.Errorf("test failed due to data dir creation error : %s", err.Error())
+			return
+		}
+	}
+	defer os.RemoveAll(dataDir)
+
+	dm, err := OpenDiskManager(10, 100, dataDir)
+	assert.NoError(t, err)
+
+	for i := 1; i <= 3; i++ {
+		key := toBytes(fmt.Sprintf("k%d", i))
+		assert.NoError(t, dm.Flush([]types.Record{types.NewRecordWithSeqNum(key, key, false, uint64(i))}, i+1))
+	}
+	manifestPath := manifestFileName(dataDir, dm.manifest.number)
+	dm.Close()
+
+	buffer, err := os.ReadFile(manifestPath)
+	assert.NoError(t, err)
+
+	// flip a byte of the edit of the first flush, past the opening snapshot
+	_, rest, ok := decodeLogRecord(buffer)
+	assert.True(t, ok)
+	flushEdit := len(buffer) - len(rest)
+	buffer[flushEdit+walRecordHeaderSize] ^= 0xff
+	assert.NoError(t, os.WriteFile(manifestPath, buffer, 0644))
+
+	_, err = OpenDiskManager(10, 100, dataDir)
+	assert.Equal(t, types.MANIFEST_DECODE_ERROR, err.(*types.EngineError).GetErrorCode())
+
+	tables, _ := filepath.Glob(filepath.Join(dataDir, "*"+tableFileSuffix))
+	assert.Len(t, tables, 3)
+
+	// so does a length reaching past the end with edits after it
+	buffer[flushEdit+walRecordHeaderSize] ^= 0xff
+	length := binary.LittleEndian.Uint32(buffer[flushEdit+4:])
+	binary.LittleEndian.PutUint32(buffer[flushEdit+4:], uint32(len(buffer)))
+	assert.NoError(t, os.WriteFile(manifestPath, buffer, 0644))
+
+	_, err = OpenDiskManager(10, 100, dataDir)
+	assert.Equal(t, types.MANIFEST_DECODE_ERROR, err.(*types.EngineError).GetErrorCode())
+
+	// a torn last edit only loses the flush it records, its table stays
+	binary.LittleEndian.PutUint32(buffer[flushEdit+4:], length)
+	assert.NoError(t, os.WriteFile(manifestPath, buffer[:len(buffer)-1], 0644))
+
+	dm, err = OpenDiskManager(10, 100, dataDir)
+	assert.NoError(t, err)
+	defer dm.Close()
+
+	assert.Len(t, levelFileNumbers(dm)[0], 2)
+	record, err := dm.Get(toBytes("k2"))
+	assert.NoError(t, err)
+	assert.Equal(t, toBytes("k2"), record.Value)
+
+	tables, _ = filepath.Glob(filepath.Join(dataDir, "*"+tableFileSuffix))
+	assert.Len(t, tables, 3)
+}
@@ -0,0 +1,74 @@
+package disk
+
+import (
+	"sort"
+	"time"
+)
+
+/*
+FIFOCompactionStrategy keeps every table in level 0 and never merges them,
+it deletes the oldest tables instead, once the tables of level 0 hold more
+than maxSize bytes or once a table is older than ttl. A zero maxSize or ttl
+leaves that cap out. Deleted records are gone for every reader, snapshots
+included, so it suits data that may be lost, like a cache. Tables are
+checked after every flush and compaction and, with a ttl, every tenth of
+it, so an idle store drops an expired table at most a tenth of the ttl
+late. Tables left in the levels below 0 by another strategy stay where they
+are.
+*/
+type FIFOCompactionStrategy struct {
+	maxSize int64
+	ttl     time.Duration
+	now     func() time.Time
+}
+
+func NewFIFOCompactionStrategy(maxSize int64, ttl time.Duration) *FIFOCompactionStrategy {
+	return &FIFOCompactionStrategy{maxSize: max(maxSize, 0), ttl: max(ttl, 0), now: time.Now}
+}
+
+func (s *FIFOCompactionStrategy) Name() string { return "fifo" }
+
+// tables expire with time alone, they are looked at every tenth of the ttl
+func (s *FIFOCompactionStrategy) CheckInterval() time.Duration {
+	if s.ttl == 0 {
+		return 0
+	}
+
+	return max(s.ttl/10, time.Millisecond)
+}
+
+// drops the tables of level 0 past the ttl and, oldest first, as many more
+// as it takes to get them under maxSize
+func (s *FIFOCompactionStrategy) PickCompaction(levels [][]TableInfo, busy func(level int) bool) (Compaction, bool) {
+	if len(levels) == 0 || busy(0) {
+		return Compaction{}, false
+	}
+
+	tables := append([]TableInfo(nil), levels[0]...)
+	sort.SliceStable(tables, func(i, j int) bool { return tables[i].CreatedAt < tables[j].CreatedAt })
+
+	var totalSize int64
+	for _, table := range tables {
+		totalSize += table.Size
+	}
+
+	var expiredBefore int64
+	if s.ttl != 0 {
+		expiredBefore = s.now().Add(-s.ttl).UnixNano()
+	}
+
+	c := Compaction{Level: 0, OutputLevel: 0, Drop: true}
+	for _, table := range tables {
+		expired := s.ttl != 0 && table.CreatedAt < expiredBefore
+		oversized := s.maxSize != 0 && totalSize > s.maxSize
+
+		if !expired && !oversized {
+			break
+		}
+
+		c.Inputs = append(c.Inputs, table.FileNumber)
+		totalSize -= table.Size
+	}
+
+	return c, len(c.Inputs) != 0
+}
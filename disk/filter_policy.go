@@ -0,0 +1,139 @@
+package disk
+
+import (
+	"LsmStorageEngine/types"
+	"encoding/binary"
+	"fmt"
+	"sync"
+)
+
+// Filter answers whether a key may be in a table, false positives included
+type Filter interface {
+	ContainsKey(key []byte) (bool, error)
+}
+
+/*
+FilterPolicy builds the filter of every new table. Its name is recorded in
+the table so the table is read back with the policy of the same name,
+whatever policy new tables are written with by then.
+*/
+type FilterPolicy interface {
+	Name() string
+	// the serialized filter over the distinct keys
+	CreateFilter(keys [][]byte) []byte
+	// reads a filter CreateFilter serialized
+	DecodeFilter(filter []byte) (Filter, error)
+}
+
+var (
+	filterPoliciesMu sync.RWMutex
+	filterPolicies   = map[string]FilterPolicy{}
+)
+
+func init() {
+	RegisterFilterPolicy(NewBloomFilterPolicy(DefaultBloomBitsPerKey))
+	RegisterFilterPolicy(NewBlockedBloomFilterPolicy(DefaultBloomBitsPerKey))
+}
+
+// makes tables written with policy readable, the built in policies are
+// always registered
+func RegisterFilterPolicy(policy FilterPolicy) {
+	filterPoliciesMu.Lock()
+	defer filterPoliciesMu.Unlock()
+
+	filterPolicies[policy.Name()] = policy
+}
+
+func lookUpFilterPolicy(name string) (FilterPolicy, error) {
+	filterPoliciesMu.RLock()
+	defer filterPoliciesMu.RUnlock()
+
+	policy, found := filterPolicies[name]
+	if !found {
+		return nil, types.NewEngineError(
+			types.TABLE_FORMAT_ERROR,
+			fmt.Sprintf("unknown filter policy %q", name),
+		)
+	}
+
+	return policy, nil
+}
+
+func malformedFilter(policy FilterPolicy, reason string) error {
+	return types.NewEngineError(
+		types.TABLE_FORMAT_ERROR,
+		fmt.Sprintf("malformed %s filter : %s", policy.Name(), reason),
+	)
+}
+
+// the policy of the original bloom filter, hashing a key once per hash
+// function over the whole bitset
+type BloomFilterPolicy struct {
+	bitsPerKey int
+}
+
+func NewBloomFilterPolicy(bitsPerKey int) BloomFilterPolicy {
+	return BloomFilterPolicy{bitsPerKey: max(bitsPerKey, 1)}
+}
+
+func (BloomFilterPolicy) Name() string { return "bloom" }
+
+// | bitset | bit count (4) | hash function count (1) |
+func (policy BloomFilterPolicy) CreateFilter(keys [][]byte) []byte {
+	bf := NewBloomFilterForKeys(len(keys), policy.bitsPerKey)
+	for _, key := range keys {
+		bf.Put(key)
+	}
+
+	buffer := binary.LittleEndian.AppendUint32(bf.Serialize(), uint32(bf.bitSetSize))
+
+	return append(buffer, byte(bf.hashFunctionCount))
+}
+
+func (policy BloomFilterPolicy) DecodeFilter(filter []byte) (Filter, error) {
+	if len(filter) < 5 {
+		return nil, malformedFilter(policy, "missing parameters")
+	}
+
+	bitSet := filter[:len(filter)-5]
+	bitCount := int(binary.LittleEndian.Uint32(filter[len(bitSet):]))
+	hashFunctionCount := int(filter[len(filter)-1])
+
+	if bitCount <= 0 || bitCount > 8*len(bitSet) || hashFunctionCount == 0 {
+		return nil, malformedFilter(policy, fmt.Sprintf("%d bits and %d hash functions", bitCount, hashFunctionCount))
+	}
+
+	bf := NewBloomFilterFromBuffer(bitSet, bitCount, hashFunctionCount)
+
+	return &bf, nil
+}
+
+// the policy of the blocked bloom filter, every key probing a single cache
+// line
+type BlockedBloomFilterPolicy struct {
+	bitsPerKey int
+}
+
+func NewBlockedBloomFilterPolicy(bitsPerKey int) BlockedBloomFilterPolicy {
+	return BlockedBloomFilterPolicy{bitsPerKey: max(bitsPerKey, 1)}
+}
+
+func (BlockedBloomFilterPolicy) Name() string { return "blocked-bloom" }
+
+func (policy BlockedBloomFilterPolicy) CreateFilter(keys [][]byte) []byte {
+	bf := newBlockedBloomFilter(len(keys), policy.bitsPerKey)
+	for _, key := range keys {
+		bf.put(key)
+	}
+
+	return bf.serialize()
+}
+
+func (policy BlockedBloomFilterPolicy) DecodeFilter(filter []byte) (Filter, error) {
+	bf, err := decodeBlockedBloomFilter(filter)
+	if err != nil {
+		return nil, malformedFilter(policy, err.Error())
+	}
+
+	return bf, nil
+}
@@ -0,0 +1,125 @@
+package disk
+
+import (
+	"LsmStorageEngine/types"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterPoliciesRoundTrip(t *testing.T) {
+	for _, policy := range []FilterPolicy{NewBloomFilterPolicy(10), NewBlockedBloomFilterPolicy(10)} {
+		t.Run(policy.Name(), func(t *testing.T) {
+			for _, keyCount := range []int{0, 1, 1000, 50_000} {
+				var keys [][]byte
+				for i := 0; i < keyCount; i++ {
+					keys = append(keys, []byte(fmt.Sprintf("tenant/%d/user/%d", i%7, i)))
+				}
+
+				filter, err := policy.DecodeFilter(policy.CreateFilter(keys))
+				assert.NoError(t, err)
+
+				for _, key := range keys {
+					containsKey, err := filter.ContainsKey(key)
+					assert.NoError(t, err)
+					assert.True(t, containsKey)
+				}
+
+				falsePositives := 0
+				for i := 0; i < 10_000; i++ {
+					containsKey, err := filter.ContainsKey([]byte(fmt.Sprintf("absent/%d", i)))
+					assert.NoError(t, err)
+
+					if containsKey {
+						falsePositives++
+					}
+				}
+
+				// about 1% at 10 bits per key, blocked filters run a little higher
+				assert.Less(t, falsePositives, 250, "%d keys", keyCount)
+			}
+		})
+	}
+}
+
+func TestBlockedBloomFilterProbesOneBlock(t *testing.T) {
+	bf := newBlockedBloomFilter(1000, 10)
+	assert.Equal(t, 7, bf.probes)
+	assert.Equal(t, 20*filterBlockSize, len(bf.blocks))
+
+	bf.put([]byte("key"))
+
+	var touched []int
+	for i := 0; i < len(bf.blocks); i += filterBlockSize {
+		for _, b := range bf.blocks[i : i+filterBlockSize] {
+			if b != 0 {
+				touched = append(touched, i/filterBlockSize)
+				break
+			}
+		}
+	}
+	assert.Len(t, touched, 1)
+}
+
+func TestFilterPoliciesRejectMalformedFilters(t *testing.T) {
+	bloom := NewBloomFilterPolicy(10)
+	blocked := NewBlockedBloomFilterPolicy(10)
+
+	for _, c := range []struct {
+		policy FilterPolicy
+		filter []byte
+	}{
+		{bloom, nil},
+		{bloom, []byte{0, 0, 0xff, 0, 0, 0, 7}},
+		{bloom, append(make([]byte, 8), 64, 0, 0, 0, 0)},
+		{blocked, nil},
+		{blocked, make([]byte, filterBlockSize)},
+		{blocked, make([]byte, filterBlockSize+1)},
+		{blocked, make([]byte, filterBlockSize+2)},
+	} {
+		_, err := c.policy.DecodeFilter(c.filter)
+		assert.Error(t, err, "%s %v", c.policy.Name(), c.filter)
+	}
+
+	_, err := lookUpFilterPolicy("ribbon")
+	assert.Error(t, err)
+}
+
+func TestTablesOfDifferentFilterPoliciesCoexist(t *testing.T) {
+	_, err := os.Stat(dataDir)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(dataDir, 0755)
+
+		if err != nil {
+			t.Errorf("test failed due to data dir creation error : %s", err.Error())
+			return
+		}
+	}
+	defer os.RemoveAll(dataDir)
+
+	var entries []types.Record
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("k%04d", i))
+		entries = append(entries, types.NewRecordWithSeqNum(key, []byte("v"), false, uint64(i+1)))
+	}
+
+	for i, policy := range []FilterPolicy{NewBloomFilterPolicy(10), NewBlockedBloomFilterPolicy(10)} {
+		created, err := createTable(entries, dataDir, 0, i+1, TableOptions{FilterPolicy: policy})
+		assert.NoError(t, err)
+
+		table, err := ReadTablesFromDisk(created.filePath)
+		assert.NoError(t, err)
+		assert.Equal(t, policy.Name(), table.metaData.filterPolicy)
+
+		for _, entry := range entries {
+			record, err := table.get(entry.Key)
+			assert.NoError(t, err)
+			assert.Equal(t, entry, record)
+		}
+
+		_, err = table.get([]byte("absent"))
+		assert.Equal(t, types.TABLE_KEY_SEARCH_NOT_FOUND, err.(*types.EngineError).GetErrorCode())
+	}
+}
@@ -0,0 +1,545 @@
+package disk
+
+import (
+	"LsmStorageEngine/types"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+/*
+a table file is laid out as
+
+	| data block... | filter | range filter | index | properties | footer |
+
+the footer, read from the end of the file, locates the other sections and
+ends in the format version and a magic number. The range filter is optional
+and located through the properties instead. Files without the magic
+number are tables of the older header format, which starts with a header
+of four or five integers instead. From the checksum format on every data block and
+section ends in the crc32c of its bytes and the footer carries the crc32c
+of the rest of the footer.
+*/
+const (
+	// tables of the older header format whose records carry no sequence
+	// number
+	unsequencedFormatVersion = -1
+	legacyFormatVersion      = 0
+	blockFormatVersion       = 1
+	// data blocks with prefix compressed keys and restart points
+	prefixFormatVersion = 2
+	// data blocks compressed one by one, each ending in its codec id
+	compressedFormatVersion = 3
+	// blocks, sections and footer carry a crc32c
+	checksumFormatVersion = 4
+	// filters sized for the keys of the table, their parameters recorded in
+	// the properties
+	sizedFilterFormatVersion = 5
+	// filters built by a filter policy, whose name is in the properties
+	filterPolicyFormatVersion = 6
+	currentFormatVersion      = filterPolicyFormatVersion
+
+	tableMagicNumber = uint64(0x4c534d5441424c45)
+	// format version and magic number, the same for every version
+	footerTrailerSize = 8 * 2
+	blockFooterSize   = 8*6 + footerTrailerSize
+	// the checksummed footer has its crc32c in front of the trailer
+	checksumFooterSize = blockFooterSize + 8
+	checksumSize       = 4
+)
+
+func footerSize(formatVersion int) int {
+	if formatVersion >= checksumFormatVersion {
+		return checksumFooterSize
+	}
+
+	return blockFooterSize
+}
+
+// position of a section of the table file
+type blockHandle struct {
+	offset int
+	size   int
+}
+
+type footer struct {
+	filter        blockHandle
+	index         blockHandle
+	properties    blockHandle
+	formatVersion int
+}
+
+func (f *footer) encode() []byte {
+	var buffer []byte
+
+	for _, handle := range []blockHandle{f.filter, f.index, f.properties} {
+		buffer = binary.LittleEndian.AppendUint64(buffer, uint64(handle.offset))
+		buffer = binary.LittleEndian.AppendUint64(buffer, uint64(handle.size))
+	}
+
+	var trailer []byte
+	trailer = binary.LittleEndian.AppendUint64(trailer, uint64(f.formatVersion))
+	trailer = binary.LittleEndian.AppendUint64(trailer, tableMagicNumber)
+
+	if f.formatVersion >= checksumFormatVersion {
+		buffer = binary.LittleEndian.AppendUint64(buffer, uint64(footerChecksum(buffer, trailer)))
+	}
+
+	return append(buffer, trailer...)
+}
+
+// crc32c of the handles and the trailer of a footer
+func footerChecksum(handles, trailer []byte) uint32 {
+	return crc32.Update(crc32.Checksum(handles, crcTable), crcTable, trailer)
+}
+
+// reads the footer at the end of fd, found is false for a file of the older
+// header format
+func readFooter(fd *os.File, fileSize int64) (footer, bool, error) {
+	if fileSize < footerTrailerSize {
+		return footer{}, false, nil
+	}
+
+	trailer := make([]byte, footerTrailerSize)
+	if _, err := fd.ReadAt(trailer, fileSize-footerTrailerSize); err != nil {
+		return footer{}, false, types.NewEngineError(
+			types.TABLE_READ_FILE_ERROR,
+			fmt.Sprintf("footer read error : %s", err.Error()),
+		)
+	}
+
+	if binary.LittleEndian.Uint64(trailer[8:]) != tableMagicNumber {
+		return footer{}, false, nil
+	}
+
+	formatVersion := int(binary.LittleEndian.Uint64(trailer))
+	size := int64(footerSize(formatVersion))
+	if formatVersion < blockFormatVersion || formatVersion > currentFormatVersion || fileSize < size {
+		return footer{}, false, types.NewEngineError(
+			types.TABLE_FORMAT_ERROR,
+			fmt.Sprintf("unsupported table format version %d", formatVersion),
+		)
+	}
+
+	buffer := make([]byte, size)
+	if _, err := fd.ReadAt(buffer, fileSize-size); err != nil {
+		return footer{}, false, types.NewEngineError(
+			types.TABLE_READ_FILE_ERROR,
+			fmt.Sprintf("footer read error : %s", err.Error()),
+		)
+	}
+
+	if formatVersion >= checksumFormatVersion {
+		stored := binary.LittleEndian.Uint64(buffer[48:])
+		if stored != uint64(footerChecksum(buffer[:48], trailer)) {
+			return footer{}, false, corruptionError(fd.Name(), fileSize-size)
+		}
+	}
+
+	var handles [3]blockHandle
+	for i := range handles {
+		handles[i] = blockHandle{
+			offset: int(binary.LittleEndian.Uint64(buffer[16*i:])),
+			size:   int(binary.LittleEndian.Uint64(buffer[16*i+8:])),
+		}
+
+		if handles[i].offset < 0 || handles[i].size < 0 || int64(handles[i].offset+handles[i].size) > fileSize-size {
+			return footer{}, false, types.NewEngineError(
+				types.TABLE_FORMAT_ERROR,
+				fmt.Sprintf("footer points past the end of the file : %d+%d", handles[i].offset, handles[i].size),
+			)
+		}
+	}
+
+	return footer{
+		filter:        handles[0],
+		index:         handles[1],
+		properties:    handles[2],
+		formatVersion: formatVersion,
+	}, true, nil
+}
+
+func readBlock(fd *os.File, handle blockHandle) ([]byte, error) {
+	buffer := make([]byte, handle.size)
+
+	if _, err := fd.ReadAt(buffer, int64(handle.offset)); err != nil {
+		return nil, types.NewEngineError(
+			types.TABLE_READ_FILE_ERROR,
+			fmt.Sprintf("block read error at offset %d : %s", handle.offset, err.Error()),
+		)
+	}
+
+	return buffer, nil
+}
+
+// reads a filter, index or properties section and checks its crc32c when
+// the format has one
+func readSection(fd *os.File, handle blockHandle, formatVersion int) ([]byte, error) {
+	section, err := readBlock(fd, handle)
+	if err != nil {
+		return nil, err
+	}
+
+	if formatVersion < checksumFormatVersion {
+		return section, nil
+	}
+
+	return verifyChecksum(section, fd.Name(), int64(handle.offset))
+}
+
+func appendChecksum(block []byte) []byte {
+	return binary.LittleEndian.AppendUint32(block, crc32.Checksum(block, crcTable))
+}
+
+// checks the crc32c at the end of block, read from offset of fileName, and
+// strips it off
+func verifyChecksum(block []byte, fileName string, offset int64) ([]byte, error) {
+	if len(block) < checksumSize {
+		return nil, corruptionError(fileName, offset)
+	}
+
+	content := block[:len(block)-checksumSize]
+	if crc32.Checksum(content, crcTable) != binary.LittleEndian.Uint32(block[len(content):]) {
+		return nil, corruptionError(fileName, offset)
+	}
+
+	return content, nil
+}
+
+func corruptionError(fileName string, offset int64) error {
+	return types.NewEngineError(
+		types.TABLE_CORRUPTION_ERROR,
+		fmt.Sprintf("table corruption error : checksum mismatch in %s at offset %d", fileName, offset),
+	)
+}
+
+// properties are stored as | tag | length | value | triples, readers skip
+// the tags they do not know
+const (
+	propertyTagLevel       = 1
+	propertyTagCreatedAt   = 2
+	propertyTagEntryCount  = 3
+	propertyTagSmallestKey = 4
+	propertyTagLargestKey  = 5
+	// from the sized filter format on
+	propertyTagFilterBitCount      = 6
+	propertyTagFilterHashFunctions = 7
+	// from the filter policy format on
+	propertyTagFilterPolicy = 8
+	// only for tables whose filter holds the prefixes of the keys
+	propertyTagPrefixExtractor = 9
+	// offset and size of the range filter, for tables having one
+	propertyTagRangeFilter = 10
+)
+
+func encodeProperties(metaData MetaData) []byte {
+	var buffer []byte
+
+	appendProperty := func(tag uint64, value []byte) {
+		buffer = binary.AppendUvarint(buffer, tag)
+		buffer = binary.AppendUvarint(buffer, uint64(len(value)))
+		buffer = append(buffer, value...)
+	}
+
+	appendProperty(propertyTagLevel, binary.AppendUvarint(nil, uint64(metaData.level)))
+	appendProperty(propertyTagCreatedAt, binary.AppendUvarint(nil, uint64(metaData.createdAt)))
+	appendProperty(propertyTagEntryCount, binary.AppendUvarint(nil, uint64(metaData.entryCount)))
+	appendProperty(propertyTagSmallestKey, metaData.smallestKey)
+	appendProperty(propertyTagLargestKey, metaData.largestKey)
+
+	if metaData.formatVersion == sizedFilterFormatVersion {
+		appendProperty(propertyTagFilterBitCount, binary.AppendUvarint(nil, uint64(metaData.filterBitCount)))
+		appendProperty(propertyTagFilterHashFunctions, binary.AppendUvarint(nil, uint64(metaData.filterHashFunctions)))
+	}
+
+	if metaData.formatVersion >= filterPolicyFormatVersion {
+		appendProperty(propertyTagFilterPolicy, []byte(metaData.filterPolicy))
+	}
+
+	if metaData.prefixExtractor != "" {
+		appendProperty(propertyTagPrefixExtractor, []byte(metaData.prefixExtractor))
+	}
+
+	if handle := metaData.rangeFilterHandle; handle.size != 0 {
+		value := binary.AppendUvarint(nil, uint64(handle.offset))
+		appendProperty(propertyTagRangeFilter, binary.AppendUvarint(value, uint64(handle.size)))
+	}
+
+	return buffer
+}
+
+func decodeProperties(buffer []byte) (MetaData, error) {
+	invalid := func(reason string) error {
+		return types.NewEngineError(
+			types.TABLE_FORMAT_ERROR,
+			fmt.Sprintf("malformed table properties : %s", reason),
+		)
+	}
+
+	var metaData MetaData
+	for len(buffer) != 0 {
+		tag, n := binary.Uvarint(buffer)
+		if n <= 0 {
+			return MetaData{}, invalid("bad tag")
+		}
+		buffer = buffer[n:]
+
+		length, n := binary.Uvarint(buffer)
+		if n <= 0 || uint64(len(buffer)-n) < length {
+			return MetaData{}, invalid("bad length")
+		}
+		value := buffer[n : n+int(length)]
+		buffer = buffer[n+int(length):]
+
+		number, _ := binary.Uvarint(value)
+
+		switch tag {
+		case propertyTagLevel:
+			metaData.level = int(number)
+		case propertyTagCreatedAt:
+			metaData.createdAt = int64(number)
+		case propertyTagEntryCount:
+			metaData.entryCount = int(number)
+		case propertyTagSmallestKey:
+			metaData.smallestKey = value
+		case propertyTagLargestKey:
+			metaData.largestKey = value
+		case propertyTagFilterBitCount:
+			metaData.filterBitCount = int(number)
+		case propertyTagFilterHashFunctions:
+			metaData.filterHashFunctions = int(number)
+		case propertyTagFilterPolicy:
+			metaData.filterPolicy = string(value)
+		case propertyTagPrefixExtractor:
+			metaData.prefixExtractor = string(value)
+		case propertyTagRangeFilter:
+			offset, n := binary.Uvarint(value)
+			if n <= 0 {
+				return MetaData{}, invalid("bad range filter offset")
+			}
+
+			size, m := binary.Uvarint(value[n:])
+			if m <= 0 {
+				return MetaData{}, invalid("bad range filter size")
+			}
+
+			metaData.rangeFilterHandle = blockHandle{offset: int(offset), size: int(size)}
+		}
+	}
+
+	return metaData, nil
+}
+
+/*
+the header of the older format is made of little endian 8 byte integers,
+the index, filter and data sizes and the level, followed by the filter, a
+dense index and the data. The first tables end the header there, later ones
+add the creation time as a fifth integer. Neither records its layout, so the
+dense index is checked against the data for each header size.
+*/
+const (
+	baselineHeaderSize = 8 * 4
+	legacyHeaderSize   = 8 * 5
+)
+
+/*
+reads a table of the older header format into the structures of the block
+format, its data section becomes a single block. The dense index is only
+walked for the boundaries of the table.
+*/
+func readLegacyTable(fd *os.File, fileSize int64) (*Table, error) {
+	var header [5]uint64
+
+	if err := binary.Read(fd, binary.LittleEndian, &header); err != nil {
+		return nil, types.NewEngineError(
+			types.TABLE_READ_FILE_ERROR,
+			fmt.Sprintf("invalid file passed ! : %s", err.Error()),
+		)
+	}
+
+	table, err := readLegacyLayout(fd, fileSize, header, legacyHeaderSize)
+	if err == nil {
+		return table, nil
+	}
+
+	table, baselineErr := readLegacyLayout(fd, fileSize, header, baselineHeaderSize)
+	if baselineErr != nil {
+		return nil, err
+	}
+
+	// the first header has no creation time, the file keeps one
+	info, err := fd.Stat()
+	if err != nil {
+		return nil, types.NewEngineError(
+			types.TABLE_READ_FILE_ERROR,
+			fmt.Sprintf("table file stat error : %s", err.Error()),
+		)
+	}
+	table.metaData.createdAt = info.ModTime().UnixNano()
+
+	return table, nil
+}
+
+// reads the table as if its header took headerSize bytes
+func readLegacyLayout(fd *os.File, fileSize int64, header [5]uint64, headerSize int) (*Table, error) {
+	if header[0] > uint64(fileSize) || header[1] > uint64(fileSize) {
+		return nil, types.NewEngineError(
+			types.TABLE_FORMAT_ERROR,
+			"header sizes exceed the file",
+		)
+	}
+
+	indexSize, filterSize := int(header[0]), int(header[1])
+	dataOffset := headerSize + filterSize + indexSize
+
+	if int64(dataOffset) > fileSize {
+		return nil, types.NewEngineError(
+			types.TABLE_FORMAT_ERROR,
+			fmt.Sprintf("header points past the end of the file : %d", dataOffset),
+		)
+	}
+
+	filter, err := readBlock(fd, blockHandle{offset: headerSize, size: filterSize})
+	if err != nil {
+		return nil, err
+	}
+
+	denseIndex, err := readBlock(fd, blockHandle{offset: headerSize + filterSize, size: indexSize})
+	if err != nil {
+		return nil, err
+	}
+
+	// every entry is | key length | key | offset |
+	var keys [][]byte
+	var offsets []uint64
+	reader := bytes.NewReader(denseIndex)
+	for reader.Len() != 0 {
+		var keySize uint64
+		if err := binary.Read(reader, binary.LittleEndian, &keySize); err != nil || keySize > uint64(reader.Len()) {
+			return nil, types.NewEngineError(
+				types.INDEX_BLOCK_DECODE_ERROR,
+				"error decoding index block key size",
+			)
+		}
+
+		key := make([]byte, keySize)
+		io.ReadFull(reader, key)
+		keys = append(keys, key)
+
+		var offset uint64
+		if err := binary.Read(reader, binary.LittleEndian, &offset); err != nil {
+			return nil, types.NewEngineError(
+				types.INDEX_BLOCK_DECODE_ERROR,
+				fmt.Sprintf("error decoding index block offset point : %s", err.Error()),
+			)
+		}
+		offsets = append(offsets, offset)
+	}
+
+	if len(keys) == 0 {
+		return nil, types.NewEngineError(
+			types.TABLE_READ_FILE_ERROR,
+			"table file has an empty index",
+		)
+	}
+
+	dataHandle := blockHandle{offset: dataOffset, size: int(fileSize) - dataOffset}
+	formatVersion, err := legacyRecordFormat(fd, dataHandle, keys, offsets)
+	if err != nil {
+		return nil, err
+	}
+
+	bloomFilter := ReconstructBloomFilterFromBuffer(filter, legacyFilterKeyCount, legacyFilterErrorRate)
+
+	index := &TableIndex{}
+	index.add(indexRecord{key: keys[len(keys)-1], offset: dataHandle.offset, size: dataHandle.size})
+
+	var createdAt int64
+	if headerSize == legacyHeaderSize {
+		createdAt = int64(header[4])
+	}
+
+	return &Table{
+		indexBlock:  index,
+		bloomFilter: &bloomFilter,
+		dataHandle:  dataHandle,
+		metaData: MetaData{
+			formatVersion: formatVersion,
+			level:         int(header[3]),
+			createdAt:     createdAt,
+			entryCount:    len(keys),
+			smallestKey:   keys[0],
+			largestKey:    keys[len(keys)-1],
+		},
+	}, nil
+}
+
+/*
+checks the dense index against the data, the first record has to start at
+offset 0 with the first key and the last with the last key. The space left
+after the last record tells whether records carry a sequence number.
+*/
+func legacyRecordFormat(fd *os.File, data blockHandle, keys [][]byte, offsets []uint64) (int, error) {
+	mismatch := types.NewEngineError(
+		types.TABLE_FORMAT_ERROR,
+		"dense index does not match the data",
+	)
+
+	if offsets[0] != 0 {
+		return 0, mismatch
+	}
+
+	for i := 1; i < len(offsets); i++ {
+		if offsets[i] <= offsets[i-1] {
+			return 0, mismatch
+		}
+	}
+
+	// | key length | key | value length |
+	recordStart := func(i int) ([]byte, error) {
+		size := uint64(8 + len(keys[i]) + 8)
+		if offsets[i] > uint64(data.size) || size > uint64(data.size)-offsets[i] {
+			return nil, mismatch
+		}
+
+		start, err := readBlock(fd, blockHandle{offset: data.offset + int(offsets[i]), size: int(size)})
+		if err != nil {
+			return nil, err
+		}
+
+		if binary.LittleEndian.Uint64(start) != uint64(len(keys[i])) || !bytes.Equal(start[8:8+len(keys[i])], keys[i]) {
+			return nil, mismatch
+		}
+
+		return start, nil
+	}
+
+	if _, err := recordStart(0); err != nil {
+		return 0, err
+	}
+
+	last := len(keys) - 1
+	start, err := recordStart(last)
+	if err != nil {
+		return 0, err
+	}
+
+	// | value | tombstone | and the sequence number, if any
+	valueSize := binary.LittleEndian.Uint64(start[len(start)-8:])
+	left := uint64(data.size) - offsets[last] - uint64(len(start))
+	if valueSize > left || left-valueSize < 1 {
+		return 0, mismatch
+	}
+
+	switch left - valueSize - 1 {
+	case 0:
+		return unsequencedFormatVersion, nil
+	case 8:
+		return legacyFormatVersion, nil
+	}
+
+	return 0, mismatch
+}
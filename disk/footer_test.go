@@ -0,0 +1,160 @@
+package disk
+
+import (
+	"LsmStorageEngine/types"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writes a checksummed table of a few blocks and returns its file
+func writeChecksumTestTable(t *testing.T, dataDir string) (string, []types.Record) {
+	var entries []types.Record
+	for i := 0; i < 300; i++ {
+		key := []byte(fmt.Sprintf("k%04d", i))
+		entries = append(entries, types.NewRecordWithSeqNum(key, []byte(fmt.Sprintf("value %d", i)), false, uint64(i+1)))
+	}
+
+	table, err := createTable(entries, dataDir, 0, 1, TableOptions{Compression: ZlibCompression})
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, table.metaData.formatVersion, checksumFormatVersion)
+
+	return table.filePath, entries
+}
+
+func flipByte(t *testing.T, fileName string, offset int64) {
+	content, err := os.ReadFile(fileName)
+	assert.NoError(t, err)
+
+	if offset < 0 {
+		offset += int64(len(content))
+	}
+	content[offset] ^= 0x40
+
+	assert.NoError(t, os.WriteFile(fileName, content, 0644))
+}
+
+func assertCorruption(t *testing.T, err error, fileName string, offset int) {
+	if !assert.Error(t, err) {
+		return
+	}
+
+	assert.Equal(t, types.TABLE_CORRUPTION_ERROR, err.(*types.EngineError).GetErrorCode())
+	assert.True(t, strings.Contains(err.Error(), fileName), err.Error())
+	assert.True(t, strings.Contains(err.Error(), fmt.Sprintf("offset %d", offset)), err.Error())
+}
+
+func TestCorruptedDataBlockIsDetected(t *testing.T) {
+	_, err := os.Stat(dataDir)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(dataDir, 0755)
+
+		if err != nil {
+			t.Errorf("test failed due to data dir creation error : %s", err.Error())
+			return
+		}
+	}
+	defer os.RemoveAll(dataDir)
+
+	fileName, entries := writeChecksumTestTable(t, dataDir)
+
+	table, err := ReadTablesFromDisk(fileName)
+	assert.NoError(t, err)
+	assert.Greater(t, len(table.indexBlock.lookUpTable), 1)
+
+	second := table.indexBlock.lookUpTable[1]
+	flipByte(t, fileName, int64(second.offset+2))
+
+	// blocks that are intact still read fine
+	record, err := table.getAt(entries[0].Key, entries[0].SeqNum, true)
+	assert.NoError(t, err)
+	assert.Equal(t, entries[0], record)
+
+	_, err = table.getAt(second.key, entries[len(entries)-1].SeqNum, true)
+	assertCorruption(t, err, fileName, second.offset)
+
+	_, err = table.getAllEntries()
+	assertCorruption(t, err, fileName, second.offset)
+
+	level := &Level{tables: []*Table{table}}
+	_, err = level.ScanAllTablesAt(second.key, entries[len(entries)-1].SeqNum, true)
+	assertCorruption(t, err, fileName, second.offset)
+}
+
+func TestCorruptedTableSectionsAreRefused(t *testing.T) {
+	_, err := os.Stat(dataDir)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(dataDir, 0755)
+
+		if err != nil {
+			t.Errorf("test failed due to data dir creation error : %s", err.Error())
+			return
+		}
+	}
+	defer os.RemoveAll(dataDir)
+
+	fileName, _ := writeChecksumTestTable(t, dataDir)
+
+	fd, err := os.Open(fileName)
+	assert.NoError(t, err)
+	info, err := fd.Stat()
+	assert.NoError(t, err)
+	tableFooter, found, err := readFooter(fd, info.Size())
+	fd.Close()
+	assert.NoError(t, err)
+	assert.True(t, found)
+
+	original, err := os.ReadFile(fileName)
+	assert.NoError(t, err)
+
+	footerOffset := int(info.Size()) - checksumFooterSize
+	for name, position := range map[string][2]int{
+		"filter":     {tableFooter.filter.offset, tableFooter.filter.offset},
+		"index":      {tableFooter.index.offset + 3, tableFooter.index.offset},
+		"properties": {tableFooter.properties.offset + 1, tableFooter.properties.offset},
+		"footer":     {footerOffset + 9, footerOffset},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.NoError(t, os.WriteFile(fileName, original, 0644))
+			flipByte(t, fileName, int64(position[0]))
+
+			_, err := ReadTablesFromDisk(fileName)
+			assertCorruption(t, err, fileName, position[1])
+		})
+	}
+}
+
+func TestUncheckedReadDoesNotCacheCorruptedBlock(t *testing.T) {
+	_, err := os.Stat(dataDir)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(dataDir, 0755)
+
+		if err != nil {
+			t.Errorf("test failed due to data dir creation error : %s", err.Error())
+			return
+		}
+	}
+	defer os.RemoveAll(dataDir)
+
+	fileName, entries := writeChecksumTestTable(t, dataDir)
+
+	table, err := ReadTablesFromDisk(fileName)
+	assert.NoError(t, err)
+
+	cache := NewBlockCache(1 << 20)
+	table.setBlockCache(cache, false)
+
+	second := table.indexBlock.lookUpTable[1]
+	flipByte(t, fileName, int64(second.offset+2))
+
+	// a read without checksums still checks a block it caches
+	_, err = table.getAt(second.key, entries[len(entries)-1].SeqNum, false)
+	assertCorruption(t, err, fileName, second.offset)
+
+	_, err = table.getAt(second.key, entries[len(entries)-1].SeqNum, true)
+	assertCorruption(t, err, fileName, second.offset)
+	assert.Zero(t, cache.Stats().Hits)
+}
@@ -6,61 +6,30 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
-	"os"
+	"sort"
 	"unsafe"
 )
 
+// one entry per data block, key is the last key of the block
 type indexRecord struct {
 	key    []byte
 	offset int
+	size   int
 }
 
+// TableIndex is the sparse index of a table, small enough to stay in memory
 type TableIndex struct {
 	lookUpTable    []indexRecord
 	tableIndexsize int
 }
 
-func NewIndexBlock(d *Data) *TableIndex {
-	tableIndex := &TableIndex{
-		lookUpTable: make([]indexRecord, len(d.entries)),
-	}
-
-	offset := 0
-	indexSize := 0
-	for index, entry := range d.entries {
-		tableIndex.lookUpTable[index] = indexRecord{
-			key:    entry.Key,
-			offset: offset,
-		}
-
-		offset += int(unsafe.Sizeof(0))*2 + len(entry.Key) + len(entry.Value) + 1
-		indexSize += int(unsafe.Sizeof(0))*2 + len(entry.Key)
-	}
-
-	tableIndex.tableIndexsize = indexSize
-
-	return tableIndex
-}
-
-func NewIndexBlockFromFile(file *os.File, length int) (TableIndex, error) {
-	indexBuffer := make([]byte, length)
-	_, err := io.ReadFull(file, indexBuffer)
-
-	if err != nil && err != io.EOF {
-		return TableIndex{}, types.NewEngineError(
-			types.TABLE_READ_FILE_ERROR,
-			fmt.Sprintf("error reading file : %s", err.Error()),
-		)
-	}
-
-	reader := bytes.NewReader(indexBuffer)
-
-	return NewIndexBlockFromBuffer(reader)
+func (ti *TableIndex) add(record indexRecord) {
+	ti.lookUpTable = append(ti.lookUpTable, record)
+	ti.tableIndexsize += int(unsafe.Sizeof(0))*3 + len(record.key)
 }
 
 func NewIndexBlockFromBuffer(buffer *bytes.Reader) (TableIndex, error) {
-	var indexRecords []indexRecord
-	offset := 0
+	var index TableIndex
 
 	for {
 		sizeBuffer := make([]byte, unsafe.Sizeof(0))
@@ -81,7 +50,7 @@ func NewIndexBlockFromBuffer(buffer *bytes.Reader) (TableIndex, error) {
 		keySize := binary.LittleEndian.Uint64(sizeBuffer)
 		key := make([]byte, keySize)
 
-		_, err = buffer.Read(key)
+		_, err = io.ReadFull(buffer, key)
 
 		if err != nil {
 			return TableIndex{}, types.NewEngineError(
@@ -90,7 +59,7 @@ func NewIndexBlockFromBuffer(buffer *bytes.Reader) (TableIndex, error) {
 			)
 		}
 
-		_, err = buffer.Read(sizeBuffer)
+		_, err = io.ReadFull(buffer, sizeBuffer)
 
 		if err != nil {
 			return TableIndex{}, types.NewEngineError(
@@ -101,15 +70,23 @@ func NewIndexBlockFromBuffer(buffer *bytes.Reader) (TableIndex, error) {
 
 		offsetPoint := binary.LittleEndian.Uint64(sizeBuffer)
 
-		indexRecords = append(indexRecords, indexRecord{
+		_, err = io.ReadFull(buffer, sizeBuffer)
+
+		if err != nil {
+			return TableIndex{}, types.NewEngineError(
+				types.INDEX_BLOCK_DECODE_ERROR,
+				fmt.Sprintf("error decoding index block size : %s", err.Error()),
+			)
+		}
+
+		index.add(indexRecord{
 			key:    key,
 			offset: int(offsetPoint),
+			size:   int(binary.LittleEndian.Uint64(sizeBuffer)),
 		})
-
-		offset += int(unsafe.Sizeof(0))*2 + len(key)
 	}
 
-	return TableIndex{lookUpTable: indexRecords, tableIndexsize: offset}, nil
+	return index, nil
 }
 
 func (ti *TableIndex) Encode() []byte {
@@ -128,29 +105,22 @@ func (ti *TableIndex) Encode() []byte {
 		binary.LittleEndian.PutUint64(dataOffsetPoint, uint64(record.offset))
 		indexField = append(indexField, dataOffsetPoint...)
 
+		blockSize := make([]byte, unsafe.Sizeof(0))
+		binary.LittleEndian.PutUint64(blockSize, uint64(record.size))
+		indexField = append(indexField, blockSize...)
+
 		buffer = append(buffer, indexField...)
 	}
 
 	return buffer
 }
 
-func (ti *TableIndex) lookUpKeyOffset(key []byte) (int, bool) {
-	start := 0
-	end := len(ti.lookUpTable) - 1
-
-	for start <= end {
-		mid := start + ((end - start) / 2)
-		compare := bytes.Compare(key, ti.lookUpTable[mid].key)
-
-		switch compare {
-		case 0:
-			return ti.lookUpTable[mid].offset, true
-		case -1:
-			end = mid - 1
-		case 1:
-			start = mid + 1
-		}
-	}
+// position of the first block that may hold key, the one whose last key is
+// the first >= key
+func (ti *TableIndex) lookUpBlock(key []byte) (int, bool) {
+	position := sort.Search(len(ti.lookUpTable), func(i int) bool {
+		return bytes.Compare(ti.lookUpTable[i].key, key) >= 0
+	})
 
-	return -1, false
+	return position, position < len(ti.lookUpTable)
 }
@@ -3,27 +3,28 @@ package disk
 import (
 	"LsmStorageEngine/types"
 	"bytes"
-	"encoding/binary"
-	"io"
 	"testing"
-	"unsafe"
 
 	"github.com/stretchr/testify/assert"
 )
 
 func TestIndexBlockCreation(t *testing.T) {
 	testCases := map[string]struct {
-		input  []types.Record
-		output []indexRecord
+		input     []types.Record
+		blockSize int
+		output    []indexRecord
 	}{
 		"index block creation test": {
 			input: []types.Record{
 				types.NewRecord([]byte("k1"), []byte("v1"), false),
 				types.NewRecord([]byte("k2"), []byte("v2"), false),
+				types.NewRecord([]byte("k3"), []byte("v3"), false),
 			},
+			// every record takes 29 bytes, so a block is cut after two
+			blockSize: 50,
 			output: []indexRecord{
-				{key: []byte("k1"), offset: 0},
-				{key: []byte("k2"), offset: 21},
+				{key: []byte("k2"), offset: 0, size: 58},
+				{key: []byte("k3"), offset: 58, size: 29},
 			},
 		},
 	}
@@ -32,27 +33,27 @@ func TestIndexBlockCreation(t *testing.T) {
 		t.Logf("running test case : %s", testCaseName)
 
 		dataBlock := NewDataBlock(testCase.input)
-		indexBlock := NewIndexBlock(dataBlock)
+		_, indexBlock := dataBlock.EncodeBlocks(testCase.blockSize, blockFormatVersion, NoCompression)
 
-		assert.ElementsMatch(t, indexBlock.lookUpTable, testCase.output)
+		assert.Equal(t, testCase.output, indexBlock.lookUpTable)
 	}
 }
 
 func TestIndexBlockSearchAndGet(t *testing.T) {
 	testCases := map[string]struct {
-		dataBlockInput  []types.Record
-		searchKey       []byte
-		searchKeyOffset int
+		dataBlockInput []types.Record
+		searchKey      []byte
+		searchBlock    int
 	}{
-		"index block key offset search and get": {
+		"index block key block search and get": {
 			dataBlockInput: []types.Record{
 				types.NewRecord([]byte("k1"), []byte("v1"), false),
 				types.NewRecord([]byte("k2"), []byte("v1"), false),
 				types.NewRecord([]byte("k3"), []byte("v3"), false),
 				types.NewRecord([]byte("k4"), []byte("v4"), false),
 			},
-			searchKey:       []byte("k2"),
-			searchKeyOffset: 21,
+			searchKey:   []byte("k3"),
+			searchBlock: 1,
 		},
 	}
 
@@ -60,64 +61,34 @@ func TestIndexBlockSearchAndGet(t *testing.T) {
 		t.Logf("running test case : %s", testCaseName)
 
 		dataBlock := NewDataBlock(testCase.dataBlockInput)
-		indexBlock := NewIndexBlock(dataBlock)
+		encodedDataBlock, indexBlock := dataBlock.EncodeBlocks(50, blockFormatVersion, NoCompression)
 
-		offset, found := indexBlock.lookUpKeyOffset(testCase.searchKey)
+		position, found := indexBlock.lookUpBlock(testCase.searchKey)
 
 		if !found {
 			t.Errorf("%s key not found in index block", string(testCase.searchKey))
-		} else {
-			if !assert.Equal(t, testCase.searchKeyOffset, offset) {
-				t.Errorf("test failed !, offset not equal")
-				return
-			}
-
-			encodedDataBlock := dataBlock.Encode()
-
-			dataBlockReader := bytes.NewReader(encodedDataBlock)
-
-			dataBlockReader.Seek(int64(offset), io.SeekStart)
-
-			sizeBuffer := make([]byte, unsafe.Sizeof(0))
-			if _, err := dataBlockReader.Read(sizeBuffer); err == nil {
-				keySize := binary.LittleEndian.Uint64(sizeBuffer)
-				key := make([]byte, keySize)
-
-				if _, err = dataBlockReader.Read(key); err == nil {
-					if _, err = dataBlockReader.Read(sizeBuffer); err == nil {
-						valueSize := binary.LittleEndian.Uint64(sizeBuffer)
-						value := make([]byte, valueSize)
-
-						if _, err = dataBlockReader.Read(value); err == nil {
-							tombStoneByte, err := dataBlockReader.ReadByte()
-
-							if err != nil {
-								t.Errorf("test failed: error : %s", err.Error())
-							}
-
-							tombStone := false
-
-							if tombStoneByte == '1' {
-								tombStone = true
-							}
-
-							record := types.NewRecord(key, value, tombStone)
-
-							assert.Equal(t, testCase.dataBlockInput[1], record)
-						} else {
-							t.Errorf("test failed: error : %s", err.Error())
-						}
-					} else {
-						t.Errorf("test failed, error : %s", err.Error())
-					}
-				} else {
-					t.Errorf("test failed, error : %s", err.Error())
-				}
-			} else {
-				t.Errorf("test failed, error : %s", err.Error())
-			}
+			continue
+		}
+
+		if !assert.Equal(t, testCase.searchBlock, position) {
+			t.Errorf("test failed !, block not equal")
+			return
+		}
+
+		entry := indexBlock.lookUpTable[position]
+		records, err := types.DecodeRecordsFromBuffer(bytes.NewReader(encodedDataBlock[entry.offset : entry.offset+entry.size]))
+
+		if err != nil {
+			t.Errorf("test failed: error : %s", err.Error())
+			return
 		}
+
+		assert.Contains(t, records, testCase.dataBlockInput[2])
 	}
+
+	_, indexBlock := NewDataBlock(testCases["index block key block search and get"].dataBlockInput).EncodeBlocks(50, blockFormatVersion, NoCompression)
+	_, found := indexBlock.lookUpBlock([]byte("k5"))
+	assert.False(t, found)
 }
 
 func TestIndexBlockEncode(t *testing.T) {
@@ -142,7 +113,7 @@ func TestIndexBlockEncode(t *testing.T) {
 		t.Logf("running test case : %s", testCaseName)
 
 		dataBlock := NewDataBlock(testCase.dataBlockInput)
-		indexBlock := NewIndexBlock(dataBlock)
+		_, indexBlock := dataBlock.EncodeBlocks(50, blockFormatVersion, NoCompression)
 		encodedIndexBlock := indexBlock.Encode()
 
 		_indexBlock, err := testCase.outputGenerator(encodedIndexBlock)
@@ -0,0 +1,431 @@
+package disk
+
+import (
+	"LsmStorageEngine/types"
+	"bytes"
+	"sort"
+)
+
+// Iterator walks a sorted run of records in both directions
+type Iterator interface {
+	// positions at the first record whose key is >= key
+	Seek(key []byte)
+	SeekToFirst()
+	SeekToLast()
+	Next()
+	Prev()
+	Valid() bool
+	Record() types.Record
+	Err() error
+	Close() error
+}
+
+type sliceIterator struct {
+	records  []types.Record
+	position int
+}
+
+// iterates over records that are already sorted by key
+func NewSliceIterator(records []types.Record) Iterator {
+	return &sliceIterator{records: records, position: -1}
+}
+
+func (it *sliceIterator) Seek(key []byte) {
+	it.position = sort.Search(len(it.records), func(i int) bool {
+		return bytes.Compare(it.records[i].Key, key) >= 0
+	})
+}
+
+func (it *sliceIterator) SeekToFirst() { it.position = 0 }
+
+func (it *sliceIterator) SeekToLast() { it.position = len(it.records) - 1 }
+
+func (it *sliceIterator) Next() { it.position++ }
+
+func (it *sliceIterator) Prev() { it.position-- }
+
+func (it *sliceIterator) Valid() bool {
+	return it.position >= 0 && it.position < len(it.records)
+}
+
+func (it *sliceIterator) Record() types.Record { return it.records[it.position] }
+
+func (it *sliceIterator) Err() error { return nil }
+
+func (it *sliceIterator) Close() error { return nil }
+
+/*
+tableIterator holds a handle on the table file from the moment it is
+created, so a compaction deleting the file afterwards does not pull it from
+under the reader. It walks the table a data block at a time: a seek finds
+its block through the sparse index and only the block under the iterator
+is decoded, read through the block cache like a point lookup.
+*/
+type tableIterator struct {
+	handle          *tableHandle
+	table           *Table
+	verifyChecksums bool
+	index           *TableIndex
+	// position in the index of the block decoded into records
+	block   int
+	records sliceIterator
+	err     error
+}
+
+func newTableIterator(table *Table, verifyChecksums bool) (*tableIterator, error) {
+	handle, err := table.acquire()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &tableIterator{
+		handle:          handle,
+		table:           table,
+		verifyChecksums: verifyChecksums,
+		block:           -1,
+		records:         sliceIterator{position: -1},
+	}, nil
+}
+
+// the index is only read on the first positioning call
+func (it *tableIterator) loadIndex() bool {
+	if it.index != nil || it.err != nil {
+		return it.err == nil
+	}
+
+	index, err := it.table.index(it.handle)
+	if err != nil {
+		it.err = err
+		return false
+	}
+
+	it.index = index
+
+	return true
+}
+
+// decodes the block at position of the index, a position out of the index
+// leaves the iterator invalid
+func (it *tableIterator) loadBlock(position int) bool {
+	if !it.loadIndex() {
+		return false
+	}
+
+	it.block = position
+	it.records = sliceIterator{position: -1}
+
+	if position < 0 || position >= len(it.index.lookUpTable) {
+		return false
+	}
+
+	records, err := it.table.readBlockRecords(it.handle, it.index.lookUpTable[position], it.verifyChecksums)
+	if err != nil {
+		it.err = err
+		return false
+	}
+
+	it.records.records = records
+
+	return true
+}
+
+// moves on to the blocks after the current one until a record is found
+func (it *tableIterator) skipForward() {
+	for !it.records.Valid() && it.err == nil && it.index != nil && it.block+1 < len(it.index.lookUpTable) {
+		if it.loadBlock(it.block + 1) {
+			it.records.SeekToFirst()
+		}
+	}
+}
+
+// moves back to the blocks before the current one until a record is found
+func (it *tableIterator) skipBackward() {
+	for !it.records.Valid() && it.err == nil && it.index != nil && it.block > 0 {
+		if it.loadBlock(it.block - 1) {
+			it.records.SeekToLast()
+		}
+	}
+}
+
+func (it *tableIterator) Seek(key []byte) {
+	if !it.loadIndex() {
+		return
+	}
+
+	// the first block whose last key is >= key holds the first record >= key
+	position, _ := it.index.lookUpBlock(key)
+	if it.loadBlock(position) {
+		it.records.Seek(key)
+		it.skipForward()
+	}
+}
+
+func (it *tableIterator) SeekToFirst() {
+	if it.loadBlock(0) {
+		it.records.SeekToFirst()
+		it.skipForward()
+	}
+}
+
+func (it *tableIterator) SeekToLast() {
+	if it.loadIndex() && it.loadBlock(len(it.index.lookUpTable)-1) {
+		it.records.SeekToLast()
+		it.skipBackward()
+	}
+}
+
+func (it *tableIterator) Next() {
+	it.records.Next()
+	it.skipForward()
+}
+
+func (it *tableIterator) Prev() {
+	it.records.Prev()
+	it.skipBackward()
+}
+
+func (it *tableIterator) Valid() bool { return it.err == nil && it.records.Valid() }
+
+func (it *tableIterator) Record() types.Record { return it.records.Record() }
+
+func (it *tableIterator) Err() error { return it.err }
+
+func (it *tableIterator) Close() error {
+	if it.handle != nil {
+		it.table.release(it.handle)
+		it.handle = nil
+	}
+
+	return nil
+}
+
+/*
+mergingIterator yields the records of all its children in key order, for
+equal keys the version with the highest sequence number comes first. Records
+without sequence numbers fall back to the child order, so children have to
+be handed over newest first.
+*/
+type mergingIterator struct {
+	children []Iterator
+	current  int
+	forward  bool
+}
+
+func NewMergingIterator(children []Iterator) Iterator {
+	return &mergingIterator{children: children, current: -1, forward: true}
+}
+
+// total order of the merged stream
+func (it *mergingIterator) less(a types.Record, aIndex int, b types.Record, bIndex int) bool {
+	compare := types.CompareVersions(a, b)
+
+	return compare < 0 || compare == 0 && aIndex < bIndex
+}
+
+func (it *mergingIterator) findSmallest() {
+	it.current = -1
+	for index, child := range it.children {
+		if !child.Valid() {
+			continue
+		}
+
+		if it.current == -1 || it.less(child.Record(), index, it.children[it.current].Record(), it.current) {
+			it.current = index
+		}
+	}
+}
+
+func (it *mergingIterator) findLargest() {
+	it.current = -1
+	for index, child := range it.children {
+		if !child.Valid() {
+			continue
+		}
+
+		if it.current == -1 || it.less(it.children[it.current].Record(), it.current, child.Record(), index) {
+			it.current = index
+		}
+	}
+}
+
+func (it *mergingIterator) Seek(key []byte) {
+	for _, child := range it.children {
+		child.Seek(key)
+	}
+
+	it.forward = true
+	it.findSmallest()
+}
+
+func (it *mergingIterator) SeekToFirst() {
+	for _, child := range it.children {
+		child.SeekToFirst()
+	}
+
+	it.forward = true
+	it.findSmallest()
+}
+
+func (it *mergingIterator) SeekToLast() {
+	for _, child := range it.children {
+		child.SeekToLast()
+	}
+
+	it.forward = false
+	it.findLargest()
+}
+
+func (it *mergingIterator) Next() {
+	current := it.children[it.current].Record()
+
+	// every other child has to move past the current record first
+	if !it.forward {
+		for index, child := range it.children {
+			if index == it.current {
+				continue
+			}
+
+			child.Seek(current.Key)
+			for child.Valid() && !it.less(current, it.current, child.Record(), index) {
+				child.Next()
+			}
+		}
+
+		it.forward = true
+	}
+
+	it.children[it.current].Next()
+	it.findSmallest()
+}
+
+func (it *mergingIterator) Prev() {
+	current := it.children[it.current].Record()
+
+	// every other child has to move before the current record first
+	if it.forward {
+		for index, child := range it.children {
+			if index == it.current {
+				continue
+			}
+
+			child.Seek(current.Key)
+			for child.Valid() && it.less(child.Record(), index, current, it.current) {
+				child.Next()
+			}
+
+			if child.Valid() {
+				child.Prev()
+			} else {
+				child.SeekToLast()
+			}
+		}
+
+		it.forward = false
+	}
+
+	it.children[it.current].Prev()
+	it.findLargest()
+}
+
+func (it *mergingIterator) Valid() bool {
+	return it.current != -1 && it.Err() == nil
+}
+
+func (it *mergingIterator) Record() types.Record {
+	return it.children[it.current].Record()
+}
+
+func (it *mergingIterator) Err() error {
+	for _, child := range it.children {
+		if err := child.Err(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (it *mergingIterator) Close() error {
+	var err error
+	for _, child := range it.children {
+		if closeErr := child.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
+}
+
+/*
+one iterator per table that may hold keys in [start, end), newest data
+first, for merging with the memtable. nil bounds leave the range open and
+tables entirely outside the range are skipped using their boundaries, the
+tables only partly in it when their range filter rules it out. With a prefix
+only keys starting with it are wanted and tables whose filter rules the
+prefix out are skipped as well. verifyChecksums checks the blocks read
+against their crc32c.
+*/
+func (dm *DiskManager) NewTableIterators(start, end, prefix []byte, verifyChecksums bool) ([]Iterator, error) {
+	dm.mu.RLock()
+	extractor := dm.tableOptions.PrefixExtractor
+	dm.mu.RUnlock()
+
+	v := dm.acquireVersion()
+	defer v.unref()
+
+	var iterators []Iterator
+	closeAll := func() {
+		for _, opened := range iterators {
+			opened.Close()
+		}
+	}
+
+	for _, level := range v.levels {
+		for _, table := range level.getOverlappingTablesInRange(start, end) {
+			// end is exclusive, unlike the boundaries
+			first, last := table.GetBoundaries()
+			if end != nil && bytes.Equal(first, end) {
+				continue
+			}
+
+			// a table inside the range holds keys of it for sure
+			if start != nil && bytes.Compare(first, start) < 0 || end != nil && bytes.Compare(last, end) >= 0 {
+				mayContainRange, err := table.mayContainRange(start, end)
+
+				if err != nil {
+					closeAll()
+					return nil, err
+				}
+
+				if !mayContainRange {
+					continue
+				}
+			}
+
+			if prefix != nil {
+				mayContainPrefix, err := table.mayContainPrefix(prefix, extractor)
+
+				if err != nil {
+					closeAll()
+					return nil, err
+				}
+
+				if !mayContainPrefix {
+					continue
+				}
+			}
+
+			iterator, err := newTableIterator(table, verifyChecksums)
+
+			if err != nil {
+				closeAll()
+				return nil, err
+			}
+
+			iterators = append(iterators, iterator)
+		}
+	}
+
+	return iterators, nil
+}
@@ -0,0 +1,158 @@
+package disk
+
+import (
+	"LsmStorageEngine/types"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergingIteratorOrder(t *testing.T) {
+	newer := []types.Record{
+		types.NewRecord(toBytes("k2"), toBytes("new"), false),
+		types.NewRecord(toBytes("k4"), toBytes("v4"), false),
+	}
+	older := []types.Record{
+		types.NewRecord(toBytes("k1"), toBytes("v1"), false),
+		types.NewRecord(toBytes("k2"), toBytes("old"), false),
+		types.NewRecord(toBytes("k3"), toBytes("v3"), false),
+	}
+
+	it := NewMergingIterator([]Iterator{NewSliceIterator(newer), NewSliceIterator(older)})
+
+	var forward []string
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		forward = append(forward, string(it.Record().Key)+"="+string(it.Record().Value))
+	}
+
+	assert.Equal(t, []string{"k1=v1", "k2=new", "k2=old", "k3=v3", "k4=v4"}, forward)
+
+	var backward []string
+	for it.SeekToLast(); it.Valid(); it.Prev() {
+		backward = append(backward, string(it.Record().Key)+"="+string(it.Record().Value))
+	}
+
+	assert.Equal(t, []string{"k4=v4", "k3=v3", "k2=old", "k2=new", "k1=v1"}, backward)
+}
+
+func TestMergingIteratorChangesDirection(t *testing.T) {
+	first := []types.Record{
+		types.NewRecord(toBytes("k1"), toBytes("v1"), false),
+		types.NewRecord(toBytes("k3"), toBytes("v3"), false),
+	}
+	second := []types.Record{
+		types.NewRecord(toBytes("k2"), toBytes("v2"), false),
+		types.NewRecord(toBytes("k4"), toBytes("v4"), false),
+	}
+
+	it := NewMergingIterator([]Iterator{NewSliceIterator(first), NewSliceIterator(second)})
+
+	it.Seek(toBytes("k2"))
+	assert.Equal(t, toBytes("k2"), it.Record().Key)
+
+	it.Next()
+	assert.Equal(t, toBytes("k3"), it.Record().Key)
+
+	it.Prev()
+	assert.Equal(t, toBytes("k2"), it.Record().Key)
+
+	it.Prev()
+	assert.Equal(t, toBytes("k1"), it.Record().Key)
+
+	it.Next()
+	it.Next()
+	assert.Equal(t, toBytes("k3"), it.Record().Key)
+}
+
+func TestTableIterator(t *testing.T) {
+	_, err := os.Stat(dataDir)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(dataDir, 0755)
+
+		if err != nil {
+			t.Errorf("test failed due to data dir creation error : %s", err.Error())
+			return
+		}
+	}
+	defer os.RemoveAll(dataDir)
+
+	table, err := CreateNewTableToDisk(data[0].records, dataDir, 0, 1)
+	assert.NoError(t, err)
+
+	it, err := newTableIterator(table, true)
+	assert.NoError(t, err)
+	defer it.Close()
+
+	// the file stays readable through the open iterator
+	table.Delete()
+
+	it.Seek(toBytes("k3"))
+	assert.True(t, it.Valid())
+	assert.Equal(t, data[0].records[2], it.Record())
+
+	it.Prev()
+	assert.Equal(t, data[0].records[1], it.Record())
+}
+
+func TestTableIteratorReadsOneBlockAtATime(t *testing.T) {
+	_, err := os.Stat(dataDir)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(dataDir, 0755)
+
+		if err != nil {
+			t.Errorf("test failed due to data dir creation error : %s", err.Error())
+			return
+		}
+	}
+	defer os.RemoveAll(dataDir)
+
+	var records []types.Record
+	for i := 0; i < 2000; i++ {
+		key := []byte(fmt.Sprintf("k%05d", i))
+		records = append(records, types.NewRecordWithSeqNum(key, []byte(fmt.Sprintf("value %d", i)), false, uint64(i+1)))
+	}
+
+	table, err := CreateNewTableToDisk(records, dataDir, 0, 1)
+	assert.NoError(t, err)
+
+	blocks := len(table.indexBlock.lookUpTable)
+	assert.Greater(t, blocks, 5)
+
+	cache := NewBlockCache(1 << 20)
+	table.setBlockCache(cache, false)
+
+	it, err := newTableIterator(table, false)
+	assert.NoError(t, err)
+	defer it.Close()
+
+	// a short scan reads the block of its start and not the whole table
+	it.Seek(toBytes("k01000"))
+	for i := 1000; i < 1010; i++ {
+		assert.True(t, it.Valid())
+		assert.Equal(t, records[i], it.Record())
+		it.Next()
+	}
+	assert.LessOrEqual(t, cache.Stats().Misses, uint64(2))
+
+	// walks cross the blocks both ways
+	var forward []types.Record
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		forward = append(forward, it.Record())
+	}
+	assert.Equal(t, records, forward)
+
+	var backward []types.Record
+	for it.SeekToLast(); it.Valid(); it.Prev() {
+		backward = append([]types.Record{it.Record()}, backward...)
+	}
+	assert.Equal(t, records, backward)
+	assert.NoError(t, it.Err())
+
+	it.Seek(toBytes("k99999"))
+	assert.False(t, it.Valid())
+
+	it.Seek(toBytes("k"))
+	assert.Equal(t, records[0], it.Record())
+}
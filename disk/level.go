@@ -4,6 +4,7 @@ import (
 	"LsmStorageEngine/types"
 	"bytes"
 	"fmt"
+	"math"
 )
 
 type Level struct {
@@ -30,15 +31,23 @@ func (l *Level) size() int {
 }
 
 func (l *Level) ScanAllTables(key []byte) (types.Record, error) {
+	return l.ScanAllTablesAt(key, math.MaxUint64, false)
+}
+
+// looks the key up in every table of the level and returns the version with
+// the highest sequence number up to seqNum, tables of level 0 may overlap
+func (l *Level) ScanAllTablesAt(key []byte, seqNum uint64, verifyChecksums bool) (types.Record, error) {
 	searchStatus := false
 	var record types.Record
 
 	for _, table := range l.tables {
-		if r, err := table.get(key); err == nil {
-			record = r
+		if r, err := table.getAt(key, seqNum, verifyChecksums); err == nil {
+			if !searchStatus || r.SeqNum > record.SeqNum {
+				record = r
+			}
 			searchStatus = true
-			break
-		} else if err.(*types.EngineError).GetErrorCode() == types.BIT_VECTOR_SEARCH_ERROR {
+		} else if code := err.(*types.EngineError).GetErrorCode(); code == types.BIT_VECTOR_SEARCH_ERROR ||
+			code == types.TABLE_CORRUPTION_ERROR {
 			return types.Record{}, err
 		}
 	}
@@ -88,24 +97,19 @@ func (l *Level) delete(comparator func(table *Table) bool) error {
 	return nil
 }
 
+// tables whose [first key, last key] intersects [start, end], a nil end
+// leaves the range open on the right
 func getOverlap(l *Level, start, end []byte) []*Table {
 	var overlappingTables []*Table
 	for _, table := range l.tables {
-		startKey := table.indexBlock.lookUpTable[0].key
-		endKey := table.indexBlock.lookUpTable[len(table.indexBlock.lookUpTable)-1].key
+		startKey, endKey := table.GetBoundaries()
 
-		if bytes.Compare(startKey, end) == -1 && bytes.Compare(endKey, start) == 1 ||
+		if (end == nil || bytes.Compare(startKey, end) <= 0) && bytes.Compare(endKey, start) >= 0 ||
 			bytes.Equal(startKey, start) && bytes.Equal(endKey, end) {
 			overlappingTables = append(overlappingTables, table)
 		}
 	}
 
-	if len(overlappingTables) == 0 {
-		if l.size() != 0 {
-			return l.tables
-		}
-	}
-
 	return overlappingTables
 }
 
@@ -114,8 +118,7 @@ func (l *Level) GetOverlappingTables() ([]*Table, []byte, []byte) {
 		return nil, nil, nil
 	}
 
-	start := l.tables[0].indexBlock.lookUpTable[0].key
-	end := l.tables[0].indexBlock.lookUpTable[len(l.tables[0].indexBlock.lookUpTable)-1].key
+	start, end := l.tables[0].GetBoundaries()
 
 	return getOverlap(l, start, end), start, end
 }
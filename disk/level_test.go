@@ -10,8 +10,11 @@ import (
 
 const dataDir = "./data"
 
+var nextTestFileNumber = 0
+
 func generateTable(records []types.Record) (*Table, error) {
-	return CreateNewTableToDisk(records, dataDir)
+	nextTestFileNumber++
+	return CreateNewTableToDisk(records, dataDir, 0, nextTestFileNumber)
 }
 
 func toBytes(s string) []byte { return []byte(s) }
@@ -203,3 +206,37 @@ func TestGetOverlap(t *testing.T) {
 	assert.Equal(t, end, toBytes("k12"))
 	assert.Equal(t, tables, []*Table{level.tables[0]})
 }
+
+func TestGetOverlappingTablesInRange(t *testing.T) {
+	level := Level{
+		tables: make([]*Table, 0),
+	}
+
+	_, err := os.Stat(dataDir)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(dataDir, 0755)
+
+		if err != nil {
+			t.Errorf("test failed due to data dir creation error : %s", err.Error())
+			return
+		}
+	}
+	defer os.RemoveAll(dataDir)
+
+	for _, d := range data[:2] {
+		table, err := d.generator(d.records)
+
+		if err != nil {
+			t.Errorf("TestGetOverlappingTablesInRange failed due to : %s", err.Error())
+			return
+		}
+
+		level.push(table)
+	}
+
+	// tables hold k1..k4 and k5..k8
+	assert.Equal(t, []*Table{level.tables[1]}, level.getOverlappingTablesInRange(toBytes("k0"), toBytes("k2")))
+	assert.Equal(t, level.tables, level.getOverlappingTablesInRange(toBytes("k35"), toBytes("k6")))
+	assert.Equal(t, []*Table{level.tables[0]}, level.getOverlappingTablesInRange(toBytes("k8"), nil))
+	assert.Empty(t, level.getOverlappingTablesInRange(toBytes("k9"), nil))
+}
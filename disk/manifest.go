@@ -0,0 +1,389 @@
+package disk
+
+import (
+	"LsmStorageEngine/types"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	currentFileName      = "CURRENT"
+	manifestFilePrefix   = "MANIFEST-"
+	currentTempFileName  = "CURRENT.tmp"
+	editTagNextFile      = 1
+	editTagLogNumber     = 2
+	editTagAddedTable    = 3
+	editTagDeletedTable  = 4
+	editTagLastSequence  = 5
+	editFieldUnsetMarker = 0
+)
+
+type tableEdit struct {
+	level      int
+	fileNumber int
+}
+
+/*
+VersionEdit is one atomic change to the shape of the tree. Every flush and
+compaction appends one to the MANIFEST, replaying them in order gives back
+the exact level layout.
+*/
+type VersionEdit struct {
+	addedTables   []tableEdit
+	deletedTables []tableEdit
+	// zero means the edit does not change the field
+	nextFileNumber int
+	// every wal segment below this number is covered by a table
+	logNumber int
+	// newest sequence number written to a table
+	lastSequence uint64
+}
+
+func (ve *VersionEdit) AddTable(level, fileNumber int) {
+	ve.addedTables = append(ve.addedTables, tableEdit{level: level, fileNumber: fileNumber})
+}
+
+func (ve *VersionEdit) DeleteTable(level, fileNumber int) {
+	ve.deletedTables = append(ve.deletedTables, tableEdit{level: level, fileNumber: fileNumber})
+}
+
+func (ve *VersionEdit) Encode() []byte {
+	var buffer []byte
+
+	if ve.nextFileNumber != editFieldUnsetMarker {
+		buffer = binary.AppendUvarint(buffer, editTagNextFile)
+		buffer = binary.AppendUvarint(buffer, uint64(ve.nextFileNumber))
+	}
+
+	if ve.logNumber != editFieldUnsetMarker {
+		buffer = binary.AppendUvarint(buffer, editTagLogNumber)
+		buffer = binary.AppendUvarint(buffer, uint64(ve.logNumber))
+	}
+
+	if ve.lastSequence != editFieldUnsetMarker {
+		buffer = binary.AppendUvarint(buffer, editTagLastSequence)
+		buffer = binary.AppendUvarint(buffer, ve.lastSequence)
+	}
+
+	for _, table := range ve.deletedTables {
+		buffer = binary.AppendUvarint(buffer, editTagDeletedTable)
+		buffer = binary.AppendUvarint(buffer, uint64(table.level))
+		buffer = binary.AppendUvarint(buffer, uint64(table.fileNumber))
+	}
+
+	for _, table := range ve.addedTables {
+		buffer = binary.AppendUvarint(buffer, editTagAddedTable)
+		buffer = binary.AppendUvarint(buffer, uint64(table.level))
+		buffer = binary.AppendUvarint(buffer, uint64(table.fileNumber))
+	}
+
+	return buffer
+}
+
+func DecodeVersionEdit(buffer []byte) (VersionEdit, error) {
+	var edit VersionEdit
+
+	next := func() (int, bool) {
+		value, n := binary.Uvarint(buffer)
+		if n <= 0 {
+			return 0, false
+		}
+
+		buffer = buffer[n:]
+		return int(value), true
+	}
+
+	invalid := types.NewEngineError(
+		types.MANIFEST_DECODE_ERROR,
+		"malformed version edit",
+	)
+
+	for len(buffer) != 0 {
+		tag, ok := next()
+		if !ok {
+			return VersionEdit{}, invalid
+		}
+
+		switch tag {
+		case editTagNextFile:
+			if edit.nextFileNumber, ok = next(); !ok {
+				return VersionEdit{}, invalid
+			}
+		case editTagLogNumber:
+			if edit.logNumber, ok = next(); !ok {
+				return VersionEdit{}, invalid
+			}
+		case editTagLastSequence:
+			lastSequence, ok := next()
+			if !ok {
+				return VersionEdit{}, invalid
+			}
+
+			edit.lastSequence = uint64(lastSequence)
+		case editTagAddedTable, editTagDeletedTable:
+			level, ok := next()
+			if !ok {
+				return VersionEdit{}, invalid
+			}
+
+			fileNumber, ok := next()
+			if !ok {
+				return VersionEdit{}, invalid
+			}
+
+			if tag == editTagAddedTable {
+				edit.AddTable(level, fileNumber)
+			} else {
+				edit.DeleteTable(level, fileNumber)
+			}
+		default:
+			return VersionEdit{}, types.NewEngineError(
+				types.MANIFEST_DECODE_ERROR,
+				fmt.Sprintf("unknown version edit tag %d", tag),
+			)
+		}
+	}
+
+	return edit, nil
+}
+
+// the level layout a manifest describes, tables of every level are listed in
+// the order they were added
+type ManifestState struct {
+	Levels         [][]int
+	NextFileNumber int
+	LogNumber      int
+	LastSequence   uint64
+	// the last edit read was torn by a crash and left out
+	TornTail bool
+}
+
+func (ms *ManifestState) apply(edit VersionEdit) {
+	for _, table := range edit.deletedTables {
+		if table.level >= len(ms.Levels) {
+			continue
+		}
+
+		var remaining []int
+		for _, fileNumber := range ms.Levels[table.level] {
+			if fileNumber != table.fileNumber {
+				remaining = append(remaining, fileNumber)
+			}
+		}
+
+		ms.Levels[table.level] = remaining
+	}
+
+	for _, table := range edit.addedTables {
+		for len(ms.Levels) <= table.level {
+			ms.Levels = append(ms.Levels, nil)
+		}
+
+		ms.Levels[table.level] = append(ms.Levels[table.level], table.fileNumber)
+	}
+
+	if edit.nextFileNumber != editFieldUnsetMarker {
+		ms.NextFileNumber = edit.nextFileNumber
+	}
+
+	if edit.logNumber != editFieldUnsetMarker {
+		ms.LogNumber = edit.logNumber
+	}
+
+	if edit.lastSequence > ms.LastSequence {
+		ms.LastSequence = edit.lastSequence
+	}
+}
+
+// a single edit that rebuilds the whole state, written at the start of every
+// new manifest
+func (ms *ManifestState) snapshot() VersionEdit {
+	edit := VersionEdit{
+		nextFileNumber: ms.NextFileNumber,
+		logNumber:      ms.LogNumber,
+		lastSequence:   ms.LastSequence,
+	}
+
+	for level, fileNumbers := range ms.Levels {
+		for _, fileNumber := range fileNumbers {
+			edit.AddTable(level, fileNumber)
+		}
+	}
+
+	return edit
+}
+
+func manifestFileName(dir string, number int) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%06d", manifestFilePrefix, number))
+}
+
+// reads the manifest CURRENT points at, ok is false for a directory that has
+// never had a manifest
+func ReadManifest(dir string) (state ManifestState, manifestNumber int, ok bool, err error) {
+	current, err := os.ReadFile(filepath.Join(dir, currentFileName))
+
+	if os.IsNotExist(err) {
+		return ManifestState{}, 0, false, nil
+	} else if err != nil {
+		return ManifestState{}, 0, false, types.NewEngineError(
+			types.MANIFEST_READ_ERROR,
+			fmt.Sprintf("CURRENT read error : %s", err.Error()),
+		)
+	}
+
+	name := strings.TrimSpace(string(current))
+	manifestNumber, err = strconv.Atoi(strings.TrimPrefix(name, manifestFilePrefix))
+
+	if !strings.HasPrefix(name, manifestFilePrefix) || err != nil {
+		return ManifestState{}, 0, false, types.NewEngineError(
+			types.MANIFEST_READ_ERROR,
+			fmt.Sprintf("CURRENT points at an invalid manifest name %q", name),
+		)
+	}
+
+	buffer, err := os.ReadFile(manifestFileName(dir, manifestNumber))
+
+	if err != nil {
+		return ManifestState{}, 0, false, types.NewEngineError(
+			types.MANIFEST_READ_ERROR,
+			fmt.Sprintf("manifest read error : %s", err.Error()),
+		)
+	}
+
+	for offset := 0; offset < len(buffer); {
+		payload, rest, valid := decodeLogRecord(buffer[offset:])
+
+		if !valid {
+			// a torn tail is an edit that was never acknowledged, a bad edit
+			// before it would drop every later one
+			if isTornTail(buffer[offset:]) {
+				state.TornTail = true
+				break
+			}
+
+			return ManifestState{}, 0, false, types.NewEngineError(
+				types.MANIFEST_DECODE_ERROR,
+				fmt.Sprintf("corrupted edit in manifest %s at offset %d", manifestFileName(dir, manifestNumber), offset),
+			)
+		}
+
+		edit, err := DecodeVersionEdit(payload)
+
+		if err != nil {
+			return ManifestState{}, 0, false, err
+		}
+
+		state.apply(edit)
+		offset = len(buffer) - len(rest)
+	}
+
+	return state, manifestNumber, true, nil
+}
+
+type manifest struct {
+	dir    string
+	number int
+	fd     *os.File
+}
+
+// starts a new manifest holding a snapshot of state, points CURRENT at it and
+// removes the manifest it replaces
+func createManifest(dir string, number int, state ManifestState) (*manifest, error) {
+	fd, err := os.OpenFile(manifestFileName(dir, number), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+
+	if err != nil {
+		return nil, types.NewEngineError(
+			types.MANIFEST_WRITE_ERROR,
+			fmt.Sprintf("manifest creation error : %s", err.Error()),
+		)
+	}
+
+	mf := &manifest{dir: dir, number: number, fd: fd}
+	snapshot := state.snapshot()
+
+	if err := mf.append(snapshot); err != nil {
+		fd.Close()
+		return nil, err
+	}
+
+	if err := setCurrent(dir, number); err != nil {
+		fd.Close()
+		return nil, err
+	}
+
+	if number > 1 {
+		os.Remove(manifestFileName(dir, number-1))
+	}
+
+	return mf, nil
+}
+
+// CURRENT is swapped through a rename so it always names a complete manifest
+func setCurrent(dir string, number int) error {
+	tempFile := filepath.Join(dir, currentTempFileName)
+	content := fmt.Sprintf("%s%06d\n", manifestFilePrefix, number)
+
+	if err := os.WriteFile(tempFile, []byte(content), 0644); err != nil {
+		return types.NewEngineError(
+			types.MANIFEST_WRITE_ERROR,
+			fmt.Sprintf("CURRENT write error : %s", err.Error()),
+		)
+	}
+
+	if err := os.Rename(tempFile, filepath.Join(dir, currentFileName)); err != nil {
+		return types.NewEngineError(
+			types.MANIFEST_WRITE_ERROR,
+			fmt.Sprintf("CURRENT rename error : %s", err.Error()),
+		)
+	}
+
+	return syncDir(dir)
+}
+
+func syncDir(dir string) error {
+	fd, err := os.Open(dir)
+
+	if err != nil {
+		return types.NewEngineError(
+			types.MANIFEST_WRITE_ERROR,
+			fmt.Sprintf("data directory open error : %s", err.Error()),
+		)
+	}
+	defer fd.Close()
+
+	if err := fd.Sync(); err != nil {
+		return types.NewEngineError(
+			types.MANIFEST_WRITE_ERROR,
+			fmt.Sprintf("data directory sync error : %s", err.Error()),
+		)
+	}
+
+	return nil
+}
+
+// an edit only counts once it is synced, the caller applies it afterwards
+func (mf *manifest) append(edit VersionEdit) error {
+	if _, err := mf.fd.Write(encodeLogRecord(edit.Encode())); err != nil {
+		return types.NewEngineError(
+			types.MANIFEST_WRITE_ERROR,
+			fmt.Sprintf("manifest append error : %s", err.Error()),
+		)
+	}
+
+	if err := mf.fd.Sync(); err != nil {
+		return types.NewEngineError(
+			types.MANIFEST_WRITE_ERROR,
+			fmt.Sprintf("manifest sync error : %s", err.Error()),
+		)
+	}
+
+	return nil
+}
+
+func (mf *manifest) close() error {
+	return mf.fd.Close()
+}
@@ -0,0 +1,74 @@
+package disk
+
+import (
+	"bytes"
+	"fmt"
+)
+
+/*
+PrefixExtractor maps the keys of a table to the prefixes added to its filter
+next to the keys themselves. Every key starting with a key of the domain of
+the extractor has to map to the same prefix as that key, so a prefix scan
+whose prefix is in the domain can ask the filter of a table whether it holds
+any key of the scan.
+*/
+type PrefixExtractor interface {
+	// recorded in the table, the filter of a table written with another
+	// extractor is not asked about prefixes
+	Name() string
+	InDomain(key []byte) bool
+	// the prefix of a key of the domain
+	Transform(key []byte) []byte
+}
+
+// the first length bytes of the keys of at least length bytes
+type fixedPrefixExtractor struct {
+	length int
+}
+
+func NewFixedPrefixExtractor(length int) PrefixExtractor {
+	return fixedPrefixExtractor{length: max(length, 1)}
+}
+
+func (e fixedPrefixExtractor) Name() string { return fmt.Sprintf("fixed:%d", e.length) }
+
+func (e fixedPrefixExtractor) InDomain(key []byte) bool { return len(key) >= e.length }
+
+func (e fixedPrefixExtractor) Transform(key []byte) []byte { return key[:e.length] }
+
+// the keys up to and including the first delimiter, for keys holding one
+type delimiterPrefixExtractor struct {
+	delimiter byte
+}
+
+func NewDelimiterPrefixExtractor(delimiter byte) PrefixExtractor {
+	return delimiterPrefixExtractor{delimiter: delimiter}
+}
+
+func (e delimiterPrefixExtractor) Name() string { return fmt.Sprintf("delimiter:%02x", e.delimiter) }
+
+func (e delimiterPrefixExtractor) InDomain(key []byte) bool {
+	return bytes.IndexByte(key, e.delimiter) >= 0
+}
+
+func (e delimiterPrefixExtractor) Transform(key []byte) []byte {
+	return key[:bytes.IndexByte(key, e.delimiter)+1]
+}
+
+// the distinct prefixes of the sorted distinct keys, the keys sharing a
+// prefix sit next to each other
+func extractPrefixes(keys [][]byte, extractor PrefixExtractor) [][]byte {
+	var prefixes [][]byte
+	for _, key := range keys {
+		if !extractor.InDomain(key) {
+			continue
+		}
+
+		prefix := extractor.Transform(key)
+		if len(prefixes) == 0 || !bytes.Equal(prefixes[len(prefixes)-1], prefix) {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+
+	return prefixes
+}
@@ -0,0 +1,129 @@
+package disk
+
+import (
+	"LsmStorageEngine/types"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrefixExtractors(t *testing.T) {
+	fixed := NewFixedPrefixExtractor(3)
+	assert.Equal(t, "fixed:3", fixed.Name())
+	assert.False(t, fixed.InDomain([]byte("ab")))
+	assert.True(t, fixed.InDomain([]byte("abc")))
+	assert.Equal(t, []byte("abc"), fixed.Transform([]byte("abcdef")))
+
+	delimiter := NewDelimiterPrefixExtractor('/')
+	assert.Equal(t, "delimiter:2f", delimiter.Name())
+	assert.False(t, delimiter.InDomain([]byte("tenant")))
+	assert.True(t, delimiter.InDomain([]byte("tenant/")))
+	assert.Equal(t, []byte("tenant/"), delimiter.Transform([]byte("tenant/user/1")))
+
+	keys := [][]byte{[]byte("a"), []byte("a/1"), []byte("a/2"), []byte("ab/1"), []byte("b"), []byte("b/1")}
+	assert.Equal(t, [][]byte{[]byte("a/"), []byte("ab/"), []byte("b/")}, extractPrefixes(keys, delimiter))
+}
+
+func TestTableIteratorsSkipTablesWithoutPrefix(t *testing.T) {
+	_, err := os.Stat(dataDir)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(dataDir, 0755)
+
+		if err != nil {
+			t.Errorf("test failed due to data dir creation error : %s", err.Error())
+			return
+		}
+	}
+	defer os.RemoveAll(dataDir)
+
+	dm, err := OpenDiskManager(10, 10, dataDir)
+	assert.NoError(t, err)
+	defer dm.Close()
+
+	seqNum := uint64(0)
+	records := func(keys ...string) []types.Record {
+		var records []types.Record
+		for _, key := range keys {
+			seqNum++
+			records = append(records, types.NewRecordWithSeqNum([]byte(key), []byte("v"), false, seqNum))
+		}
+
+		return records
+	}
+
+	// written without an extractor, never skipped
+	assert.NoError(t, dm.Flush(records("a/1", "c/1"), 1))
+
+	dm.SetTableOptions(TableOptions{PrefixExtractor: NewDelimiterPrefixExtractor('/')})
+	assert.NoError(t, dm.Flush(records("a/2", "c/2"), 2))
+	assert.NoError(t, dm.Flush(records("b/1", "b/2"), 3))
+
+	scanned := func(prefix string) int {
+		iterators, err := dm.NewTableIterators([]byte(prefix), nil, []byte(prefix), false)
+		assert.NoError(t, err)
+
+		for _, iterator := range iterators {
+			iterator.Close()
+		}
+
+		return len(iterators)
+	}
+
+	assert.Equal(t, 2, scanned("b/"))
+	assert.Equal(t, 2, scanned("b/1"))
+	assert.Equal(t, 2, scanned("a/"))
+	assert.Equal(t, 2, scanned("c/"))
+	// out of the domain of the extractor
+	assert.Equal(t, 3, scanned("b"))
+}
+
+func TestPrefixesOfTableSurviveReopening(t *testing.T) {
+	_, err := os.Stat(dataDir)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(dataDir, 0755)
+
+		if err != nil {
+			t.Errorf("test failed due to data dir creation error : %s", err.Error())
+			return
+		}
+	}
+	defer os.RemoveAll(dataDir)
+
+	var entries []types.Record
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("tenant%02d/user%04d", i/50, i))
+		entries = append(entries, types.NewRecordWithSeqNum(key, []byte("v"), false, uint64(i+1)))
+	}
+
+	extractor := NewDelimiterPrefixExtractor('/')
+	created, err := createTable(entries, dataDir, 0, 1, TableOptions{PrefixExtractor: extractor})
+	assert.NoError(t, err)
+
+	table, err := ReadTablesFromDisk(created.filePath)
+	assert.NoError(t, err)
+	assert.Equal(t, extractor.Name(), table.metaData.prefixExtractor)
+
+	for i := 0; i < 20; i++ {
+		mayContainPrefix, err := table.mayContainPrefix([]byte(fmt.Sprintf("tenant%02d/user", i)), extractor)
+		assert.NoError(t, err)
+		assert.True(t, mayContainPrefix)
+	}
+
+	skipped := 0
+	for i := 20; i < 1020; i++ {
+		mayContainPrefix, err := table.mayContainPrefix([]byte(fmt.Sprintf("tenant%02d/", i)), extractor)
+		assert.NoError(t, err)
+
+		if !mayContainPrefix {
+			skipped++
+		}
+	}
+	assert.Greater(t, skipped, 950)
+
+	// another extractor does not know what the filter holds
+	mayContainPrefix, err := table.mayContainPrefix([]byte("tenant99"), NewFixedPrefixExtractor(8))
+	assert.NoError(t, err)
+	assert.True(t, mayContainPrefix)
+}
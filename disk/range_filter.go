@@ -0,0 +1,184 @@
+package disk
+
+import (
+	"LsmStorageEngine/types"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// bytes kept past the distinguishing prefix of a key, every byte cuts the
+// false positives of ranges ending close to a key about 256 times
+const rangeFilterSuffixLength = 2
+
+// longest prefix kept of a key, so a filter costs at most this many bytes
+// and a few more of framing per key however long its keys are. Keys alike
+// over more than that are not told apart, they share one prefix
+const rangeFilterMaxPrefixLength = 16
+
+/*
+rangeFilter answers whether a table may hold a key in [start, end) without
+reading its blocks. It keeps the sorted keys of the table cut down to the
+shortest prefix telling each apart from its neighbours plus a few bytes,
+the way a succinct trie keeps only the branching part of the keys. A prefix
+is never more than its key, so a range holding a key is never ruled out,
+while a range is taken for holding a key only when one of its bounds shares
+the whole kept prefix of the key next to it. Prefixes are cut at
+rangeFilterMaxPrefixLength and copied out of the keys, bounding the memory
+of the filter by the number of keys alone.
+*/
+type rangeFilter struct {
+	prefixes [][]byte
+	// whether the prefix is shorter than its key
+	truncated []bool
+}
+
+// the filter over the sorted distinct keys
+func newRangeFilter(keys [][]byte) *rangeFilter {
+	lengths := make([]int, len(keys))
+	total := 0
+
+	for i, key := range keys {
+		shared := 0
+		if i > 0 {
+			shared = commonPrefixLength(keys[i-1], key)
+		}
+		if i < len(keys)-1 {
+			shared = max(shared, commonPrefixLength(key, keys[i+1]))
+		}
+
+		lengths[i] = min(shared+1+rangeFilterSuffixLength, len(key), rangeFilterMaxPrefixLength)
+		total += lengths[i]
+	}
+
+	// one buffer for every prefix, the keys are not kept alive by the filter
+	buffer := make([]byte, 0, total)
+	f := &rangeFilter{}
+
+	for i, key := range keys {
+		prefix := key[:lengths[i]]
+		truncated := lengths[i] < len(key)
+
+		// keys cut to the same prefix answer the same, one of them does
+		if last := len(f.prefixes) - 1; last >= 0 && truncated && f.truncated[last] && bytes.Equal(f.prefixes[last], prefix) {
+			continue
+		}
+
+		buffer = append(buffer, prefix...)
+		f.prefixes = append(f.prefixes, buffer[len(buffer)-len(prefix):len(buffer):len(buffer)])
+		f.truncated = append(f.truncated, truncated)
+	}
+
+	return f
+}
+
+func commonPrefixLength(a, b []byte) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+
+	return n
+}
+
+/*
+false when no key of the filter is in [start, end), nil bounds leave the
+range open. The kept prefixes are ordered like their keys, so the first key
+that may be at or after start is the only one to check against end.
+*/
+func (f *rangeFilter) mayContainRange(start, end []byte) bool {
+	i := 0
+	if start != nil {
+		i = sort.Search(len(f.prefixes), func(i int) bool {
+			if f.truncated[i] {
+				// the key goes on past the prefix in an unknown way
+				return bytes.Compare(f.prefixes[i], start) >= 0 || bytes.HasPrefix(start, f.prefixes[i])
+			}
+
+			return bytes.Compare(f.prefixes[i], start) >= 0
+		})
+	}
+
+	if i == len(f.prefixes) {
+		return false
+	}
+
+	return end == nil || bytes.Compare(f.prefixes[i], end) < 0
+}
+
+// | count | per prefix : | shared | unshared << 1 | truncated | unshared bytes | |
+// with shared the length of the part in common with the prefix before
+func (f *rangeFilter) encode() []byte {
+	buffer := binary.AppendUvarint(nil, uint64(len(f.prefixes)))
+
+	var previous []byte
+	for i, prefix := range f.prefixes {
+		shared := commonPrefixLength(previous, prefix)
+
+		header := uint64(len(prefix)-shared) << 1
+		if f.truncated[i] {
+			header |= 1
+		}
+
+		buffer = binary.AppendUvarint(buffer, uint64(shared))
+		buffer = binary.AppendUvarint(buffer, header)
+		buffer = append(buffer, prefix[shared:]...)
+
+		previous = prefix
+	}
+
+	return buffer
+}
+
+func decodeRangeFilter(buffer []byte) (*rangeFilter, error) {
+	invalid := func(reason string) error {
+		return types.NewEngineError(
+			types.TABLE_FORMAT_ERROR,
+			fmt.Sprintf("malformed range filter : %s", reason),
+		)
+	}
+
+	count, n := binary.Uvarint(buffer)
+	// every prefix takes two bytes at the least
+	if n <= 0 || count > uint64(len(buffer)-n)/2 {
+		return nil, invalid("bad prefix count")
+	}
+	buffer = buffer[n:]
+
+	f := &rangeFilter{
+		prefixes:  make([][]byte, count),
+		truncated: make([]bool, count),
+	}
+
+	var previous []byte
+	for i := range f.prefixes {
+		shared, n := binary.Uvarint(buffer)
+		if n <= 0 || shared > uint64(len(previous)) {
+			return nil, invalid(fmt.Sprintf("bad shared length of prefix %d", i))
+		}
+		buffer = buffer[n:]
+
+		header, n := binary.Uvarint(buffer)
+		if n <= 0 || header>>1 > uint64(len(buffer)-n) {
+			return nil, invalid(fmt.Sprintf("bad length of prefix %d", i))
+		}
+		buffer = buffer[n:]
+
+		unshared := int(header >> 1)
+		prefix := make([]byte, 0, int(shared)+unshared)
+		prefix = append(prefix, previous[:shared]...)
+		prefix = append(prefix, buffer[:unshared]...)
+		buffer = buffer[unshared:]
+
+		f.prefixes[i] = prefix
+		f.truncated[i] = header&1 == 1
+		previous = prefix
+	}
+
+	if len(buffer) != 0 {
+		return nil, invalid("trailing bytes")
+	}
+
+	return f, nil
+}
@@ -0,0 +1,233 @@
+package disk
+
+import (
+	"LsmStorageEngine/types"
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRangeFilterHasNoFalseNegatives(t *testing.T) {
+	// the long start makes keys alike past the longest kept prefix
+	for _, start := range []string{"", "k", "0123456789abcd", "0123456789abcdef/"} {
+		t.Run(start, func(t *testing.T) {
+			testRangeFilterHasNoFalseNegatives(t, []byte(start))
+		})
+	}
+}
+
+func testRangeFilterHasNoFalseNegatives(t *testing.T, keyStart []byte) {
+	random := rand.New(rand.NewSource(1))
+	alphabet := []byte("ab/")
+
+	randomKey := func() []byte {
+		key := append([]byte(nil), keyStart[:random.Intn(len(keyStart)+1)]...)
+		for range 1 + random.Intn(6) {
+			key = append(key, alphabet[random.Intn(len(alphabet))])
+		}
+
+		return key
+	}
+
+	for round := 0; round < 200; round++ {
+		keySet := map[string]bool{}
+		for i := 0; i < 1+random.Intn(40); i++ {
+			keySet[string(randomKey())] = true
+		}
+
+		var keys [][]byte
+		for key := range keySet {
+			keys = append(keys, []byte(key))
+		}
+		sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+
+		f, err := decodeRangeFilter(newRangeFilter(keys).encode())
+		assert.NoError(t, err)
+
+		for i := 0; i < 200; i++ {
+			start, end := randomKey(), randomKey()
+			if random.Intn(10) == 0 {
+				start = nil
+			}
+			if random.Intn(10) == 0 {
+				end = nil
+			}
+
+			holdsKey := false
+			for _, key := range keys {
+				if (start == nil || bytes.Compare(key, start) >= 0) && (end == nil || bytes.Compare(key, end) < 0) {
+					holdsKey = true
+				}
+			}
+
+			if holdsKey {
+				assert.True(t, f.mayContainRange(start, end), "%q [%q, %q)", keys, start, end)
+			}
+		}
+	}
+}
+
+func TestRangeFilterRulesOutNarrowRanges(t *testing.T) {
+	var keys [][]byte
+	for user := 0; user < 1000; user += 2 {
+		for item := 0; item < 5; item++ {
+			keys = append(keys, []byte(fmt.Sprintf("user/%d/item/%d", user, item)))
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+
+	f := newRangeFilter(keys)
+	assert.Less(t, len(f.encode()), len(bytes.Join(keys, nil))/2)
+
+	falsePositives := 0
+	for user := 0; user < 1000; user++ {
+		mayContainRange := f.mayContainRange([]byte(fmt.Sprintf("user/%d/", user)), []byte(fmt.Sprintf("user/%d0", user)))
+
+		if user%2 == 0 {
+			assert.True(t, mayContainRange)
+		} else if mayContainRange {
+			falsePositives++
+		}
+	}
+
+	assert.Zero(t, falsePositives)
+	assert.False(t, f.mayContainRange([]byte("user/999/"), nil))
+	assert.False(t, f.mayContainRange(nil, []byte("user/0/")))
+}
+
+func TestRangeFilterSizeIsBoundedPerKey(t *testing.T) {
+	var keys [][]byte
+	for i := 0; i < 1000; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("%s/%06d", bytes.Repeat([]byte("tenant"), 50), i)))
+	}
+
+	f := newRangeFilter(keys)
+	assert.LessOrEqual(t, len(f.encode()), 3+rangeFilterMaxPrefixLength)
+
+	// the filter holds copies, not the keys themselves
+	held := append([]byte(nil), keys[500]...)
+	for _, key := range keys {
+		clear(key)
+	}
+
+	assert.True(t, f.mayContainRange(held, append(held, 0)))
+	assert.False(t, f.mayContainRange([]byte("u"), nil))
+	assert.False(t, f.mayContainRange(nil, []byte("tenant")))
+}
+
+func TestRangeFilterCorrupted(t *testing.T) {
+	encoded := newRangeFilter([][]byte{[]byte("a"), []byte("b"), []byte("c")}).encode()
+
+	_, err := decodeRangeFilter(encoded[:len(encoded)-1])
+	assert.Error(t, err)
+
+	_, err = decodeRangeFilter(append(encoded, 0))
+	assert.Error(t, err)
+
+	_, err = decodeRangeFilter([]byte{0xff})
+	assert.Error(t, err)
+}
+
+func TestTableIteratorsSkipTablesOutsideRange(t *testing.T) {
+	_, err := os.Stat(dataDir)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(dataDir, 0755)
+
+		if err != nil {
+			t.Errorf("test failed due to data dir creation error : %s", err.Error())
+			return
+		}
+	}
+	defer os.RemoveAll(dataDir)
+
+	dm, err := OpenDiskManager(10, 10, dataDir)
+	assert.NoError(t, err)
+	defer dm.Close()
+
+	seqNum := uint64(0)
+	records := func(users ...int) []types.Record {
+		var records []types.Record
+		for _, user := range users {
+			seqNum++
+			key := []byte(fmt.Sprintf("user/%d/", user))
+			records = append(records, types.NewRecordWithSeqNum(key, []byte("v"), false, seqNum))
+		}
+
+		return records
+	}
+
+	// written without a range filter, never skipped
+	dm.SetTableOptions(TableOptions{})
+	assert.NoError(t, dm.Flush(records(10, 90), 1))
+
+	dm.SetTableOptions(TableOptions{RangeFilter: true})
+	assert.NoError(t, dm.Flush(records(20, 80), 2))
+	assert.NoError(t, dm.Flush(records(42, 43), 3))
+
+	scanned := func(start, end string) int {
+		iterators, err := dm.NewTableIterators([]byte(start), []byte(end), nil, false)
+		assert.NoError(t, err)
+
+		for _, iterator := range iterators {
+			iterator.Close()
+		}
+
+		return len(iterators)
+	}
+
+	assert.Equal(t, 2, scanned("user/42/", "user/43/"))
+	assert.Equal(t, 3, scanned("user/20/", "user/43/"))
+	assert.Equal(t, 1, scanned("user/5", "user/6"))
+
+	// a table in the range is taken without asking its filter
+	assert.Equal(t, 3, scanned("user/", "user0"))
+}
+
+func TestRangeFilterSurvivesReopening(t *testing.T) {
+	_, err := os.Stat(dataDir)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(dataDir, 0755)
+
+		if err != nil {
+			t.Errorf("test failed due to data dir creation error : %s", err.Error())
+			return
+		}
+	}
+	defer os.RemoveAll(dataDir)
+
+	entries := []types.Record{
+		types.NewRecordWithSeqNum([]byte("user/1/a"), []byte("v"), false, 1),
+		types.NewRecordWithSeqNum([]byte("user/3/a"), []byte("v"), false, 2),
+	}
+
+	for i, options := range []TableOptions{{RangeFilter: true}, {}} {
+		created, err := createTable(entries, dataDir, 0, i+1, options)
+		assert.NoError(t, err)
+
+		table, err := ReadTablesFromDisk(created.filePath)
+		assert.NoError(t, err)
+		assert.Equal(t, created.metaData.rangeFilterHandle, table.metaData.rangeFilterHandle)
+
+		mayContainRange, err := table.mayContainRange([]byte("user/2/"), []byte("user/2/\xff"))
+		assert.NoError(t, err)
+		assert.Equal(t, !options.RangeFilter, mayContainRange)
+
+		mayContainRange, err = table.mayContainRange([]byte("user/3/"), []byte("user/4/"))
+		assert.NoError(t, err)
+		assert.True(t, mayContainRange)
+
+		// read back through the table cache and the block cache
+		table.fileNumber = i + 1
+		table.setTableCache(NewTableCache(1))
+		table.setBlockCache(NewBlockCache(1<<20), true)
+
+		mayContainRange, err = table.mayContainRange([]byte("user/2/"), []byte("user/2/\xff"))
+		assert.NoError(t, err)
+		assert.Equal(t, !options.RangeFilter, mayContainRange)
+	}
+}
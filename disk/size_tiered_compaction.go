@@ -0,0 +1,75 @@
+package disk
+
+import "sort"
+
+const (
+	// a table joins a bucket when it is at most this many times the average
+	// size of the tables already in it
+	sizeTieredBucketHigh = 1.5
+	// tables below this size all share one bucket
+	sizeTieredMinTableSize = 32 << 10
+	// tables a size tiered compaction merges at the most
+	sizeTieredMaxMergeWidth = 32
+	// tables of similar size that make a size tiered compaction by default
+	DefaultSizeTieredMinMergeWidth = 4
+)
+
+/*
+SizeTieredCompactionStrategy keeps every table in level 0 and merges
+tables of similar size into one, so a record is rewritten about once for
+every time the size of the table holding it grows minMergeWidth times.
+It trades the read cost of more overlapping tables for less rewriting
+than leveled compaction. Tables left in the levels below 0 by another
+strategy stay where they are.
+*/
+type SizeTieredCompactionStrategy struct {
+	minMergeWidth int
+}
+
+func NewSizeTieredCompactionStrategy(minMergeWidth int) *SizeTieredCompactionStrategy {
+	return &SizeTieredCompactionStrategy{minMergeWidth: max(minMergeWidth, 2)}
+}
+
+func (s *SizeTieredCompactionStrategy) Name() string { return "size-tiered" }
+
+/*
+sorts the tables of level 0 into buckets of similar size, smallest first,
+and merges the smallest tables of the first bucket holding at least
+minMergeWidth of them
+*/
+func (s *SizeTieredCompactionStrategy) PickCompaction(levels [][]TableInfo, busy func(level int) bool) (Compaction, bool) {
+	if len(levels) == 0 || busy(0) {
+		return Compaction{}, false
+	}
+
+	tables := append([]TableInfo(nil), levels[0]...)
+	sort.SliceStable(tables, func(i, j int) bool { return tables[i].Size < tables[j].Size })
+
+	var bucket []TableInfo
+	var bucketSize int64
+	for _, table := range tables {
+		// sorted by size, a table is never below the average of its bucket
+		if len(bucket) != 0 && table.Size >= sizeTieredMinTableSize &&
+			float64(table.Size) > sizeTieredBucketHigh*float64(bucketSize)/float64(len(bucket)) {
+			if len(bucket) >= s.minMergeWidth {
+				break
+			}
+
+			bucket, bucketSize = nil, 0
+		}
+
+		bucket = append(bucket, table)
+		bucketSize += table.Size
+	}
+
+	if len(bucket) < s.minMergeWidth {
+		return Compaction{}, false
+	}
+
+	c := Compaction{Level: 0, OutputLevel: 0}
+	for _, table := range bucket[:min(len(bucket), sizeTieredMaxMergeWidth)] {
+		c.Inputs = append(c.Inputs, table.FileNumber)
+	}
+
+	return c, true
+}
@@ -3,117 +3,153 @@ package disk
 import (
 	"LsmStorageEngine/types"
 	"bytes"
-	"encoding/binary"
 	"fmt"
-	"io"
+	"math"
 	"os"
-	"unsafe"
-
-	"github.com/google/uuid"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
-/*
-TODO : feed these values as config instead  of constants
-*/
+// every filter of the tables written before filters were sized per table
+// was built for this many keys at this error rate
 const (
-	m = 10000
-	p = 0.01
+	legacyFilterKeyCount  = 10000
+	legacyFilterErrorRate = 0.01
 )
 
+const tableFileSuffix = ".data"
+
 type Table struct {
-	indexBlock  *TableIndex
-	bloomFilter *BloomFilter
-	filePath    string
-	metaData    MetaData
+	// sparse index with one entry per data block, index and filters are nil
+	// when they live in the table cache or the block cache instead
+	indexBlock   *TableIndex
+	bloomFilter  Filter
+	rangeFilter  *rangeFilter
+	indexHandle  blockHandle
+	filterHandle blockHandle
+	// the data blocks, back to back
+	dataHandle blockHandle
+	// shared cache of the blocks read, nil reads every block from the file
+	blockCache          *BlockCache
+	cacheID             uint64
+	cacheIndexAndFilter bool
+	// open file handles, nil opens the file on every read
+	tableCache *TableCache
+	filePath   string
+	fileNumber int
+	metaData   MetaData
+	// versions holding the table, the file goes once the last one lets go
+	refs atomic.Int32
 }
 
 type MetaData struct {
-	indexBlockSize  int
-	dataBlockSize   int
-	bloomFilterSize int
-	level           int
+	formatVersion int
+	level         int
+	// unix nano timestamp of when the table was written, orders the
+	// overlapping tables of level 0 on recovery
+	createdAt   int64
+	entryCount  int
+	smallestKey []byte
+	largestKey  []byte
+	// parameters the filter was built with, in the sized filter format
+	filterBitCount      int
+	filterHashFunctions int
+	// name of the policy of the filter from the filter policy format on
+	filterPolicy string
+	// name of the extractor whose prefixes are in the filter, if any
+	prefixExtractor string
+	// position of the range filter, of size 0 in tables without one
+	rangeFilterHandle blockHandle
+	// bytes of the table file, taken from the file rather than its properties
+	fileSize int64
 }
 
-func ReadMetaDataFromFile(r io.Reader) (MetaData, error) {
-	var indexBlockSize int
-	var dataBlockSize int
-	var bloomFilterSize int
-	var level int
-
-	err := binary.Read(r, binary.LittleEndian, &indexBlockSize)
+// table files are named L<level>_<file number>.data
+func tableFileName(dir string, level int, fileNumber int) string {
+	return filepath.Join(dir, fmt.Sprintf("L%d_%06d%s", level, fileNumber, tableFileSuffix))
+}
 
-	if err != nil {
-		return MetaData{}, types.NewEngineError(
-			types.TABLE_READ_FILE_ERROR,
-			fmt.Sprintf("invalid file passed !"),
-		)
+// splits a table file name into its level and the part after the level, which
+// is the file number for every table written since the manifest exists
+func parseTableFileName(name string) (int, string, bool) {
+	if !strings.HasPrefix(name, "L") || !strings.HasSuffix(name, tableFileSuffix) {
+		return 0, "", false
 	}
 
-	err = binary.Read(r, binary.LittleEndian, &indexBlockSize)
+	levelPart, id, found := strings.Cut(strings.TrimSuffix(strings.TrimPrefix(name, "L"), tableFileSuffix), "_")
 
-	if err != nil {
-		return MetaData{}, types.NewEngineError(
-			types.TABLE_READ_FILE_ERROR,
-			fmt.Sprintf("invalid file passed !"),
-		)
+	if !found {
+		return 0, "", false
 	}
 
-	err = binary.Read(r, binary.LittleEndian, &dataBlockSize)
+	level, err := strconv.Atoi(levelPart)
 
-	if err != nil {
-		return MetaData{}, types.NewEngineError(
-			types.TABLE_READ_FILE_ERROR,
-			fmt.Sprintf("invalid file passed !"),
-		)
+	if err != nil || level < 0 {
+		return 0, "", false
 	}
 
-	err = binary.Read(r, binary.LittleEndian, &bloomFilterSize)
-
-	if err != nil {
-		return MetaData{}, types.NewEngineError(
-			types.TABLE_READ_FILE_ERROR,
-			fmt.Sprintf("invalid file passed !"),
-		)
-	}
+	return level, id, true
+}
 
-	err = binary.Read(r, binary.LittleEndian, &level)
+// settings new tables are written with, tables already on disk keep the
+// settings they were written with
+type TableOptions struct {
+	Compression CompressionType
+	// builds the filter of a table over the distinct keys it holds
+	FilterPolicy FilterPolicy
+	// adds the prefixes of the keys to the filter as well, nil adds none
+	PrefixExtractor PrefixExtractor
+	// writes a range filter next to the filter for range reads to skip the
+	// table with
+	RangeFilter bool
+}
 
-	if err != nil {
-		return MetaData{}, types.NewEngineError(
-			types.TABLE_READ_FILE_ERROR,
-			fmt.Sprintf("invalid file passed !"),
-		)
+func DefaultTableOptions() TableOptions {
+	return TableOptions{
+		Compression:  NoCompression,
+		FilterPolicy: NewBloomFilterPolicy(DefaultBloomBitsPerKey),
+		RangeFilter:  true,
 	}
+}
 
-	return MetaData{
-		indexBlockSize:  indexBlockSize,
-		dataBlockSize:   dataBlockSize,
-		bloomFilterSize: bloomFilterSize,
-		level:           level,
-	}, nil
+func CreateNewTableToDisk(entries []types.Record, dir string, level int, fileNumber int) (*Table, error) {
+	return createTable(entries, dir, level, fileNumber, DefaultTableOptions())
 }
 
-func CreateNewTableToDisk(entries []types.Record, dir string) (*Table, error) {
-	tableIndex, bloomFilter, metaData, tableContent := Flush(entries)
-	fileName := fmt.Sprintf("%s//L%d_%s.data", dir, metaData.level, uuid.New().String())
+func createTable(entries []types.Record, dir string, level int, fileNumber int, options TableOptions) (*Table, error) {
+	table, tableContent := Flush(entries, level, options)
+	fileName := tableFileName(dir, table.metaData.level, fileNumber)
 
 	fd, err := os.Create(fileName)
-	defer fd.Close()
 	if err != nil {
 		return nil, types.NewEngineError(
 			types.TABLE_FILE_CREATION_ERROR,
 			fmt.Sprintf("table file creation error : %s", err.Error()),
 		)
 	}
+	defer fd.Close()
+
+	if _, err := fd.Write(tableContent); err != nil {
+		return nil, types.NewEngineError(
+			types.TABLE_FILE_CREATION_ERROR,
+			fmt.Sprintf("table file write error : %s", err.Error()),
+		)
+	}
 
-	fd.Write(tableContent)
+	if err := fd.Sync(); err != nil {
+		return nil, types.NewEngineError(
+			types.TABLE_FILE_CREATION_ERROR,
+			fmt.Sprintf("table file sync error : %s", err.Error()),
+		)
+	}
 
-	return &Table{
-		indexBlock:  tableIndex,
-		bloomFilter: bloomFilter,
-		filePath:    fileName,
-		metaData:    metaData,
-	}, nil
+	table.filePath = fileName
+	table.fileNumber = fileNumber
+
+	return table, nil
 }
 
 func ReadTablesFromDisk(fileName string) (*Table, error) {
@@ -125,71 +161,269 @@ func ReadTablesFromDisk(fileName string) (*Table, error) {
 			fmt.Sprintf("table file read error : %s", err.Error()),
 		)
 	}
+	defer fd.Close()
 
-	metaData, err := ReadMetaDataFromFile(fd)
+	info, err := fd.Stat()
+
+	if err != nil {
+		return nil, types.NewEngineError(
+			types.TABLE_READ_FILE_ERROR,
+			fmt.Sprintf("table file stat error : %s", err.Error()),
+		)
+	}
+
+	tableFooter, found, err := readFooter(fd, info.Size())
 
 	if err != nil {
 		return nil, err
 	}
 
-	indexBlock, err := NewIndexBlockFromFile(fd, metaData.indexBlockSize)
+	var table *Table
+	if found {
+		table, err = readBlockTable(fd, tableFooter)
+	} else {
+		table, err = readLegacyTable(fd, info.Size())
+	}
 
 	if err != nil {
 		return nil, err
 	}
 
-	bloomFilter, err := ReconstructBloomFilterFromFile(fd, m, p)
+	if len(table.indexBlock.lookUpTable) == 0 {
+		return nil, types.NewEngineError(
+			types.TABLE_READ_FILE_ERROR,
+			fmt.Sprintf("table file %s has an empty index", fileName),
+		)
+	}
+
+	table.filePath = fileName
+	table.metaData.fileSize = info.Size()
 
+	return table, nil
+}
+
+func readBlockTable(fd *os.File, tableFooter footer) (*Table, error) {
+	properties, err := readSection(fd, tableFooter.properties, tableFooter.formatVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	metaData, err := decodeProperties(properties)
+	if err != nil {
+		return nil, err
+	}
+	metaData.formatVersion = tableFooter.formatVersion
+
+	filter, err := readSection(fd, tableFooter.filter, tableFooter.formatVersion)
+	if err != nil {
+		return nil, err
+	}
+	bloomFilter, err := decodeFilter(filter, metaData)
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := readSection(fd, tableFooter.index, tableFooter.formatVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	indexBlock, err := NewIndexBlockFromBuffer(bytes.NewReader(index))
+	if err != nil {
+		return nil, err
+	}
+
+	keysRangeFilter, err := readRangeFilter(fd, metaData)
 	if err != nil {
 		return nil, err
 	}
 
 	return &Table{
-		metaData:    metaData,
-		bloomFilter: &bloomFilter,
-		indexBlock:  &indexBlock,
-		filePath:    fileName,
+		indexBlock:   &indexBlock,
+		bloomFilter:  bloomFilter,
+		rangeFilter:  keysRangeFilter,
+		indexHandle:  tableFooter.index,
+		filterHandle: tableFooter.filter,
+		dataHandle:   blockHandle{offset: 0, size: tableFooter.filter.offset},
+		metaData:     metaData,
 	}, nil
 }
 
-func Flush(entries []types.Record) (*TableIndex, *BloomFilter, MetaData, []byte) {
+// builds the content of a table file of the current format for the sorted
+// entries, the returned table still lacks its file
+func Flush(entries []types.Record, level int, options TableOptions) (*Table, []byte) {
+	return buildTable(entries, level, currentFormatVersion, options)
+}
+
+func buildTable(entries []types.Record, level int, formatVersion int, options TableOptions) (*Table, []byte) {
 	dataBlock := NewDataBlock(entries)
-	bloomFilter := NewBloomFilterFromEntries(m, p, entries)
-	indexBlock := NewIndexBlock(dataBlock)
+
+	buffer, indexBlock := dataBlock.EncodeBlocks(dataBlockSize, formatVersion, options.Compression)
+	dataHandle := blockHandle{offset: 0, size: len(buffer)}
 
 	metaData := MetaData{
-		indexBlockSize:  indexBlock.tableIndexsize,
-		dataBlockSize:   dataBlock.dataBlockSize,
-		bloomFilterSize: bloomFilter.getBufferSize(),
-		level:           0,
+		formatVersion: formatVersion,
+		level:         level,
+		createdAt:     time.Now().UnixNano(),
+		entryCount:    len(entries),
+	}
+
+	if len(entries) != 0 {
+		metaData.smallestKey = entries[0].Key
+		metaData.largestKey = entries[len(entries)-1].Key
 	}
 
-	var buffer []byte
+	keys := distinctKeys(entries)
+
+	filter := buildFilter(entries, keys, options, &metaData)
+	// a filter just built always decodes
+	bloomFilter, _ := decodeFilter(filter, metaData)
 
-	var s []byte = make([]byte, 8)
+	var tableFooter footer
+	tableFooter.formatVersion = formatVersion
 
-	binary.LittleEndian.PutUint64(s, uint64(metaData.indexBlockSize))
-	buffer = append(buffer, s...)
+	appendSection := func(section []byte) blockHandle {
+		if formatVersion >= checksumFormatVersion {
+			section = appendChecksum(section)
+		}
 
-	binary.LittleEndian.PutUint64(s, uint64(metaData.bloomFilterSize))
-	buffer = append(buffer, s...)
+		handle := blockHandle{offset: len(buffer), size: len(section)}
+		buffer = append(buffer, section...)
 
-	binary.LittleEndian.PutUint64(s, uint64(metaData.dataBlockSize))
-	buffer = append(buffer, s...)
+		return handle
+	}
 
-	binary.LittleEndian.PutUint64(s, uint64(metaData.level))
-	buffer = append(buffer, s...)
+	tableFooter.filter = appendSection(filter)
+
+	var keysRangeFilter *rangeFilter
+	if options.RangeFilter && formatVersion >= filterPolicyFormatVersion {
+		keysRangeFilter = newRangeFilter(keys)
+		metaData.rangeFilterHandle = appendSection(keysRangeFilter.encode())
+	}
 
-	buffer = append(append(append(buffer, bloomFilter.Serialize()...), indexBlock.Encode()...), dataBlock.Encode()...)
+	tableFooter.index = appendSection(indexBlock.Encode())
+	tableFooter.properties = appendSection(encodeProperties(metaData))
 
-	return indexBlock, &bloomFilter, metaData, buffer
+	buffer = append(buffer, tableFooter.encode()...)
+	metaData.fileSize = int64(len(buffer))
+
+	return &Table{
+		indexBlock:   indexBlock,
+		bloomFilter:  bloomFilter,
+		rangeFilter:  keysRangeFilter,
+		indexHandle:  tableFooter.index,
+		filterHandle: tableFooter.filter,
+		dataHandle:   dataHandle,
+		metaData:     metaData,
+	}, buffer
+}
+
+// the keys of the sorted entries, once per key
+func distinctKeys(entries []types.Record) [][]byte {
+	var keys [][]byte
+	for i, entry := range entries {
+		if i == 0 || !bytes.Equal(entries[i-1].Key, entry.Key) {
+			keys = append(keys, entry.Key)
+		}
+	}
+
+	return keys
+}
+
+/*
+the serialized filter over keys, the distinct keys of the sorted entries,
+in the layout of the format version of metaData, which records what the
+filter has to be read back with. From the filter policy format on the filter is
+built by the policy of options over the keys and the prefixes the prefix
+extractor of options takes from them, before it is a bloom filter sized for
+the keys and before that one of the legacy size.
+*/
+func buildFilter(entries []types.Record, keys [][]byte, options TableOptions, metaData *MetaData) []byte {
+	if metaData.formatVersion < sizedFilterFormatVersion {
+		bloomFilter := NewBloomFilterFromEntries(legacyFilterKeyCount, legacyFilterErrorRate, entries)
+		return bloomFilter.Serialize()
+	}
+
+	if metaData.formatVersion < filterPolicyFormatVersion {
+		bloomFilter := NewBloomFilterForKeys(len(keys), DefaultBloomBitsPerKey)
+		for _, key := range keys {
+			bloomFilter.Put(key)
+		}
+
+		metaData.filterBitCount = bloomFilter.bitSetSize
+		metaData.filterHashFunctions = bloomFilter.hashFunctionCount
+
+		return bloomFilter.Serialize()
+	}
+
+	policy := options.FilterPolicy
+	if policy == nil {
+		policy = NewBloomFilterPolicy(DefaultBloomBitsPerKey)
+	}
+	metaData.filterPolicy = policy.Name()
+
+	if options.PrefixExtractor != nil {
+		keys = append(keys[:len(keys):len(keys)], extractPrefixes(keys, options.PrefixExtractor)...)
+		metaData.prefixExtractor = options.PrefixExtractor.Name()
+	}
+
+	return policy.CreateFilter(keys)
+}
+
+// the filter of a table from its serialized form, read the way the format
+// version of the table wrote it
+func decodeFilter(buffer []byte, metaData MetaData) (Filter, error) {
+	if metaData.formatVersion < sizedFilterFormatVersion {
+		bloomFilter := ReconstructBloomFilterFromBuffer(buffer, legacyFilterKeyCount, legacyFilterErrorRate)
+		return &bloomFilter, nil
+	}
+
+	if metaData.formatVersion >= filterPolicyFormatVersion {
+		policy, err := lookUpFilterPolicy(metaData.filterPolicy)
+		if err != nil {
+			return nil, err
+		}
+
+		return policy.DecodeFilter(buffer)
+	}
+
+	if metaData.filterHashFunctions <= 0 || metaData.filterBitCount <= 0 || metaData.filterBitCount > 8*len(buffer) {
+		return nil, types.NewEngineError(
+			types.TABLE_FORMAT_ERROR,
+			fmt.Sprintf(
+				"filter of %d bytes does not fit %d bits and %d hash functions",
+				len(buffer), metaData.filterBitCount, metaData.filterHashFunctions,
+			),
+		)
+	}
+
+	bloomFilter := NewBloomFilterFromBuffer(buffer, metaData.filterBitCount, metaData.filterHashFunctions)
+
+	return &bloomFilter, nil
 }
 
 func (t *Table) get(key []byte) (types.Record, error) {
-	// search index block
-	// find key location through fd
-	// read the entry
-	if containsKey, err := t.bloomFilter.ContainsKey(key); err == nil && !containsKey {
+	return t.getAt(key, math.MaxUint64, false)
+}
+
+// the newest version of key with a sequence number of at most seqNum, the
+// checksums of the blocks read are only checked with verifyChecksums
+func (t *Table) getAt(key []byte, seqNum uint64, verifyChecksums bool) (types.Record, error) {
+	// check the bloom filter
+	// find the block through the sparse index
+	// read the block and walk the versions of the key until one is old enough
+	handle, err := t.acquire()
+	if err != nil {
+		return types.Record{}, err
+	}
+	defer t.release(handle)
+
+	bloomFilter, err := t.filter(handle)
+	if err != nil {
+		return types.Record{}, err
+	}
+
+	if containsKey, err := bloomFilter.ContainsKey(key); err == nil && !containsKey {
 		return types.Record{}, types.NewEngineError(
 			types.TABLE_KEY_SEARCH_NOT_FOUND,
 			"key not found index table",
@@ -201,7 +435,12 @@ func (t *Table) get(key []byte) (types.Record, error) {
 		)
 	}
 
-	tableFileOffset, found := t.indexBlock.lookUpKeyOffset(key)
+	index, err := t.index(handle)
+	if err != nil {
+		return types.Record{}, err
+	}
+
+	position, found := index.lookUpBlock(key)
 
 	if !found {
 		return types.Record{}, types.NewEngineError(
@@ -210,62 +449,291 @@ func (t *Table) get(key []byte) (types.Record, error) {
 		)
 	}
 
-	fd, err := os.OpenFile(t.filePath, os.O_RDONLY, os.FileMode(os.O_RDONLY))
-	defer fd.Close()
+	// the versions of a key may run over into the following blocks
+	for ; position < len(index.lookUpTable); position++ {
+		block, err := t.readDataBlock(handle.fd, index.lookUpTable[position], verifyChecksums)
+
+		if err != nil {
+			return types.Record{}, err
+		}
 
+		records, err := seekBlock(block, key, t.metaData.formatVersion)
+
+		if err != nil {
+			return types.Record{}, err
+		}
+
+		for _, record := range records {
+			if bytes.Equal(record.Key, key) && record.SeqNum <= seqNum {
+				return record, nil
+			}
+		}
+
+		if !bytes.Equal(index.lookUpTable[position].key, key) {
+			break
+		}
+	}
+
+	return types.Record{}, types.NewEngineError(
+		types.TABLE_KEY_SEARCH_NOT_FOUND,
+		"key has no version visible at the sequence number",
+	)
+}
+
+// false when the filter rules out every key starting with prefix, which it
+// only does for tables written with the same extractor
+func (t *Table) mayContainPrefix(prefix []byte, extractor PrefixExtractor) (bool, error) {
+	if extractor == nil || t.metaData.prefixExtractor != extractor.Name() || !extractor.InDomain(prefix) {
+		return true, nil
+	}
+
+	handle, err := t.acquire()
 	if err != nil {
-		return types.Record{}, types.NewEngineError(
-			types.TABLE_FILE_OPEN_ERROR,
-			fmt.Sprintf("unable to open file %s : %s", t.filePath, err.Error()),
-		)
+		return false, err
 	}
+	defer t.release(handle)
 
-	skipLengths := int(unsafe.Sizeof(0))*4 + t.metaData.bloomFilterSize + t.metaData.indexBlockSize
-	_, err = fd.Seek(int64(skipLengths+tableFileOffset), io.SeekStart)
+	filter, err := t.filter(handle)
+	if err != nil {
+		return false, err
+	}
 
+	containsPrefix, err := filter.ContainsKey(extractor.Transform(prefix))
 	if err != nil {
-		return types.Record{}, types.NewEngineError(
-			types.TABLE_KEY_FILE_SEEK_ERR,
-			fmt.Sprintf("index block seeek error : %s", err.Error()),
+		return false, types.NewEngineError(
+			types.BIT_VECTOR_SEARCH_ERROR,
+			fmt.Sprintf("error searching bloom filter : %s", err.Error()),
 		)
 	}
 
-	record, err := types.DecocodeRecordFromFile(fd)
+	return containsPrefix, nil
+}
+
+// false when the range filter rules out every key in [start, end), tables
+// without one may always hold some
+func (t *Table) mayContainRange(start, end []byte) (bool, error) {
+	if t.metaData.rangeFilterHandle.size == 0 {
+		return true, nil
+	}
+
+	handle, err := t.acquire()
+	if err != nil {
+		return false, err
+	}
+	defer t.release(handle)
 
+	keysRangeFilter, err := t.keysRangeFilter(handle)
 	if err != nil {
-		return types.Record{}, types.NewEngineError(
-			types.TABLE_RECORD_READ_ERROR,
-			fmt.Sprintf("record decode error : %s", err.Error()),
-		)
+		return false, err
 	}
 
-	return record, nil
+	return keysRangeFilter.mayContainRange(start, end), nil
 }
 
-func (t *Table) getAllEntries() ([]types.Record, error) {
-	fd, err := os.Open(t.filePath)
-	defer fd.Close()
+// reads the data block of the index entry, through the block cache when the
+// table has one. a block is always checked before it goes into the cache,
+// where readers asking for checksums find it, so cached blocks are checked
+func (t *Table) readDataBlock(fd *os.File, entry indexRecord, verifyChecksums bool) ([]byte, error) {
+	key := blockCacheKey{tableID: t.cacheID, offset: entry.offset}
 
+	if t.blockCache != nil {
+		if block, found := t.blockCache.get(key); found {
+			return block.([]byte), nil
+		}
+	}
+
+	block, err := readBlock(fd, blockHandle{offset: entry.offset, size: entry.size})
 	if err != nil {
-		return nil, types.NewEngineError(
-			types.TABLE_READ_FILE_ERROR,
-			fmt.Sprintf("file read error : %s", err.Error()),
-		)
+		return nil, err
+	}
+
+	block, err = t.unwrapBlock(block, entry.offset, verifyChecksums || t.blockCache != nil)
+	if err != nil {
+		return nil, err
 	}
 
-	skipLength := int(unsafe.Sizeof(0))*4 + t.metaData.bloomFilterSize + t.metaData.indexBlockSize
-	fd.Seek(int64(skipLength), io.SeekStart)
+	if t.blockCache != nil {
+		t.blockCache.insert(key, block, len(block))
+	}
+
+	return block, nil
+}
 
-	dataBlockBuffer, err := io.ReadAll(fd)
+/*
+attaches the table to cache. With cacheIndexAndFilter the index and the
+filter leave the table and are read back through the cache, competing with
+the data blocks for its space. Tables of the older header format keep
+them, having no sections to read them back from.
+*/
+func (t *Table) setBlockCache(cache *BlockCache, cacheIndexAndFilter bool) {
+	t.blockCache = cache
+	t.cacheID = cache.newTableID()
+	t.cacheIndexAndFilter = cacheIndexAndFilter && t.metaData.formatVersion >= blockFormatVersion
+
+	if t.cacheIndexAndFilter && t.indexBlock != nil {
+		t.blockCache.insert(blockCacheKey{tableID: t.cacheID, offset: t.indexHandle.offset}, t.indexBlock, t.indexHandle.size)
+		t.blockCache.insert(blockCacheKey{tableID: t.cacheID, offset: t.filterHandle.offset}, t.bloomFilter, t.filterHandle.size)
+
+		if t.rangeFilter != nil {
+			rangeFilterHandle := t.metaData.rangeFilterHandle
+			t.blockCache.insert(blockCacheKey{tableID: t.cacheID, offset: rangeFilterHandle.offset}, t.rangeFilter, rangeFilterHandle.size)
+		}
+
+		t.indexBlock = nil
+		t.bloomFilter = nil
+		t.rangeFilter = nil
+	}
+}
 
+// the sparse index of the table, wherever it is kept
+func (t *Table) index(handle *tableHandle) (*TableIndex, error) {
+	if t.indexBlock != nil {
+		return t.indexBlock, nil
+	}
+
+	if handle.index != nil {
+		return handle.index, nil
+	}
+
+	index, err := t.cachedSection(handle.fd, t.indexHandle, func(section []byte) (any, error) {
+		index, err := NewIndexBlockFromBuffer(bytes.NewReader(section))
+		return &index, err
+	})
 	if err != nil {
-		return nil, types.NewEngineError(
-			types.TABLE_READ_FILE_ERROR,
-			fmt.Sprintf("file read error : %s", err.Error()),
-		)
+		return nil, err
 	}
 
-	records, err := types.DecodeRecordsFromBuffer(bytes.NewReader(dataBlockBuffer))
+	return index.(*TableIndex), nil
+}
+
+// the bloom filter of the table, wherever it is kept
+func (t *Table) filter(handle *tableHandle) (Filter, error) {
+	if t.bloomFilter != nil {
+		return t.bloomFilter, nil
+	}
+
+	if handle.filter != nil {
+		return handle.filter, nil
+	}
+
+	bloomFilter, err := t.cachedSection(handle.fd, t.filterHandle, func(section []byte) (any, error) {
+		return decodeFilter(section, t.metaData)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return bloomFilter.(Filter), nil
+}
+
+// the range filter of the table wherever it is kept, nil when it has none
+func (t *Table) keysRangeFilter(handle *tableHandle) (*rangeFilter, error) {
+	if t.metaData.rangeFilterHandle.size == 0 {
+		return nil, nil
+	}
+
+	if t.rangeFilter != nil {
+		return t.rangeFilter, nil
+	}
+
+	if handle.rangeFilter != nil {
+		return handle.rangeFilter, nil
+	}
+
+	keysRangeFilter, err := t.cachedSection(handle.fd, t.metaData.rangeFilterHandle, func(section []byte) (any, error) {
+		return decodeRangeFilter(section)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return keysRangeFilter.(*rangeFilter), nil
+}
+
+// reads the range filter metaData points to, nil for tables without one
+func readRangeFilter(fd *os.File, metaData MetaData) (*rangeFilter, error) {
+	if metaData.rangeFilterHandle.size == 0 {
+		return nil, nil
+	}
+
+	section, err := readSection(fd, metaData.rangeFilterHandle, metaData.formatVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeRangeFilter(section)
+}
+
+// looks a section up in the block cache, on a miss it is read from fd and
+// parsed into what the cache keeps
+func (t *Table) cachedSection(fd *os.File, handle blockHandle, parse func([]byte) (any, error)) (any, error) {
+	key := blockCacheKey{tableID: t.cacheID, offset: handle.offset}
+
+	if value, found := t.blockCache.get(key); found {
+		return value, nil
+	}
+
+	section, err := readSection(fd, handle, t.metaData.formatVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := parse(section)
+	if err != nil {
+		return nil, err
+	}
+
+	t.blockCache.insert(key, value, handle.size)
+
+	return value, nil
+}
+
+// strips the checksum and the codec off a stored data block, blocks of the
+// older formats lack them
+func (t *Table) unwrapBlock(block []byte, offset int, verifyChecksums bool) ([]byte, error) {
+	if t.metaData.formatVersion >= checksumFormatVersion {
+		if len(block) < checksumSize {
+			return nil, corruptionError(t.filePath, int64(offset))
+		}
+
+		if verifyChecksums {
+			var err error
+			if block, err = verifyChecksum(block, t.filePath, int64(offset)); err != nil {
+				return nil, err
+			}
+		} else {
+			block = block[:len(block)-checksumSize]
+		}
+	}
+
+	if t.metaData.formatVersion < compressedFormatVersion {
+		return block, nil
+	}
+
+	return uncompressBlock(block)
+}
+
+// every record of the table, checksums are always verified as the records
+// are rewritten by compactions
+func (t *Table) getAllEntries() ([]types.Record, error) {
+	handle, err := t.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer t.release(handle)
+
+	return t.readEntries(handle, true)
+}
+
+// decodes the records of the data block of the index entry, read through
+// the block cache
+func (t *Table) readBlockRecords(handle *tableHandle, entry indexRecord, verifyChecksums bool) ([]types.Record, error) {
+	block, err := t.readDataBlock(handle.fd, entry, verifyChecksums)
+	if err != nil {
+		return nil, err
+	}
+
+	records, err := decodeBlock(block, t.metaData.formatVersion)
 	if err != nil {
 		return nil, types.NewEngineError(
 			types.BUFFER_READ_ERROR,
@@ -276,7 +744,64 @@ func (t *Table) getAllEntries() ([]types.Record, error) {
 	return records, nil
 }
 
+// decodes every record of the data blocks of the table open as handle
+func (t *Table) readEntries(handle *tableHandle, verifyChecksums bool) ([]types.Record, error) {
+	index, err := t.index(handle)
+	if err != nil {
+		return nil, err
+	}
+
+	dataBlockBuffer, err := readBlock(handle.fd, t.dataHandle)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var records []types.Record
+	for _, entry := range index.lookUpTable {
+		start := entry.offset - t.dataHandle.offset
+
+		if start < 0 || start+entry.size > len(dataBlockBuffer) {
+			return nil, types.NewEngineError(
+				types.TABLE_FORMAT_ERROR,
+				fmt.Sprintf("index points outside the data blocks : %d+%d", entry.offset, entry.size),
+			)
+		}
+
+		block, err := t.unwrapBlock(dataBlockBuffer[start:start+entry.size], entry.offset, verifyChecksums)
+		if err != nil {
+			return nil, err
+		}
+
+		blockRecords, err := decodeBlock(block, t.metaData.formatVersion)
+		if err != nil {
+			return nil, types.NewEngineError(
+				types.BUFFER_READ_ERROR,
+				err.Error(),
+			)
+		}
+
+		records = append(records, blockRecords...)
+	}
+
+	return records, nil
+}
+
+func (t *Table) ref() {
+	t.refs.Add(1)
+}
+
+func (t *Table) unref() {
+	if t.refs.Add(-1) == 0 {
+		t.Delete()
+	}
+}
+
 func (t *Table) Delete() error {
+	if t.tableCache != nil {
+		t.tableCache.evict(t.fileNumber)
+	}
+
 	err := os.Remove(t.filePath)
 
 	if err != nil {
@@ -289,6 +814,7 @@ func (t *Table) Delete() error {
 	return nil
 }
 
+// the first and the last key of the table
 func (t *Table) GetBoundaries() ([]byte, []byte) {
-	return t.indexBlock.lookUpTable[0].key, t.indexBlock.lookUpTable[len(t.indexBlock.lookUpTable)-1].key
+	return t.metaData.smallestKey, t.metaData.largestKey
 }
@@ -0,0 +1,250 @@
+package disk
+
+import (
+	"LsmStorageEngine/types"
+	"bytes"
+	"container/list"
+	"fmt"
+	"os"
+	"sync"
+)
+
+/*
+tableHandle is an open table file, together with its index and filters
+when neither the table nor the block cache keeps them. Reads go through ReadAt,
+so one handle serves any number of concurrent readers.
+*/
+type tableHandle struct {
+	fd          *os.File
+	index       *TableIndex
+	filter      Filter
+	rangeFilter *rangeFilter
+	// guarded by the table cache, the file is closed once the handle is
+	// evicted and the last reader released it
+	fileNumber int
+	refs       int
+	evicted    bool
+}
+
+/*
+TableCache keeps the handles of the most recently read tables open, keyed
+by file number, and closes the least recently used ones once more than
+capacity are open. A handle evicted while readers still hold it stays open
+until they release it.
+*/
+type TableCache struct {
+	mu        sync.Mutex
+	capacity  int
+	handles   map[int]*list.Element
+	lru       *list.List
+	openFiles int
+	hits      uint64
+	misses    uint64
+}
+
+type TableCacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	OpenFiles int
+	Capacity  int
+}
+
+// a cache keeping at most capacity table files open
+func NewTableCache(capacity int) *TableCache {
+	return &TableCache{
+		capacity: max(capacity, 1),
+		handles:  map[int]*list.Element{},
+		lru:      list.New(),
+	}
+}
+
+// the handle of table, to be given back with release
+func (c *TableCache) acquire(t *Table) (*tableHandle, error) {
+	c.mu.Lock()
+	if element, found := c.handles[t.fileNumber]; found {
+		c.hits++
+		c.lru.MoveToFront(element)
+
+		handle := element.Value.(*tableHandle)
+		handle.refs++
+		c.mu.Unlock()
+
+		return handle, nil
+	}
+	c.misses++
+	c.mu.Unlock()
+
+	// opened without the lock, hits on other tables go on meanwhile
+	handle, err := t.openHandle()
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// another reader opened it first
+	if element, found := c.handles[t.fileNumber]; found {
+		handle.fd.Close()
+
+		handle = element.Value.(*tableHandle)
+		handle.refs++
+
+		return handle, nil
+	}
+
+	handle.refs = 1
+	c.openFiles++
+	c.handles[t.fileNumber] = c.lru.PushFront(handle)
+
+	for c.lru.Len() > c.capacity {
+		c.remove(c.lru.Back())
+	}
+
+	return handle, nil
+}
+
+func (c *TableCache) release(handle *tableHandle) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	handle.refs--
+	if handle.evicted && handle.refs == 0 {
+		c.close(handle)
+	}
+}
+
+// drops the handle of a table whose file is going away
+func (c *TableCache) evict(fileNumber int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, found := c.handles[fileNumber]; found {
+		c.remove(element)
+	}
+}
+
+// closes every handle no reader holds, the others once they are released
+func (c *TableCache) evictAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for c.lru.Len() != 0 {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *TableCache) remove(element *list.Element) {
+	handle := c.lru.Remove(element).(*tableHandle)
+	delete(c.handles, handle.fileNumber)
+
+	handle.evicted = true
+	if handle.refs == 0 {
+		c.close(handle)
+	}
+}
+
+func (c *TableCache) close(handle *tableHandle) {
+	handle.fd.Close()
+	c.openFiles--
+}
+
+func (c *TableCache) Stats() TableCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return TableCacheStats{
+		Hits:      c.hits,
+		Misses:    c.misses,
+		OpenFiles: c.openFiles,
+		Capacity:  c.capacity,
+	}
+}
+
+// opens the file of the table and parses the index and filter the handle
+// has to keep
+func (t *Table) openHandle() (*tableHandle, error) {
+	fd, err := os.Open(t.filePath)
+
+	if err != nil {
+		return nil, types.NewEngineError(
+			types.TABLE_FILE_OPEN_ERROR,
+			fmt.Sprintf("unable to open file %s : %s", t.filePath, err.Error()),
+		)
+	}
+
+	handle := &tableHandle{fd: fd, fileNumber: t.fileNumber}
+
+	if t.indexBlock == nil && !t.cacheIndexAndFilter {
+		if err := handle.load(t); err != nil {
+			fd.Close()
+			return nil, err
+		}
+	}
+
+	return handle, nil
+}
+
+func (h *tableHandle) load(t *Table) error {
+	index, err := readSection(h.fd, t.indexHandle, t.metaData.formatVersion)
+	if err != nil {
+		return err
+	}
+
+	indexBlock, err := NewIndexBlockFromBuffer(bytes.NewReader(index))
+	if err != nil {
+		return err
+	}
+
+	filter, err := readSection(h.fd, t.filterHandle, t.metaData.formatVersion)
+	if err != nil {
+		return err
+	}
+
+	bloomFilter, err := decodeFilter(filter, t.metaData)
+	if err != nil {
+		return err
+	}
+
+	keysRangeFilter, err := readRangeFilter(h.fd, t.metaData)
+	if err != nil {
+		return err
+	}
+
+	h.index = &indexBlock
+	h.filter = bloomFilter
+	h.rangeFilter = keysRangeFilter
+
+	return nil
+}
+
+// a handle on the file of the table, from the table cache when it has one
+func (t *Table) acquire() (*tableHandle, error) {
+	if t.tableCache == nil {
+		return t.openHandle()
+	}
+
+	return t.tableCache.acquire(t)
+}
+
+func (t *Table) release(handle *tableHandle) {
+	if t.tableCache == nil {
+		handle.fd.Close()
+		return
+	}
+
+	t.tableCache.release(handle)
+}
+
+// the table cache keeps the file of the table open and its index and filter
+// as well, unless the block cache holds them. Tables of the older header
+// format keep theirs
+func (t *Table) setTableCache(cache *TableCache) {
+	t.tableCache = cache
+
+	if t.metaData.formatVersion >= blockFormatVersion {
+		t.indexBlock = nil
+		t.bloomFilter = nil
+		t.rangeFilter = nil
+	}
+}
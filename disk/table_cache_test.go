@@ -0,0 +1,120 @@
+package disk
+
+import (
+	"LsmStorageEngine/types"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func createTableCacheTestTables(t *testing.T, count int) ([]*Table, []types.Record) {
+	var entries []types.Record
+	for i := 0; i < 200; i++ {
+		key := []byte(fmt.Sprintf("k%04d", i))
+		entries = append(entries, types.NewRecordWithSeqNum(key, []byte(fmt.Sprintf("value %d", i)), false, uint64(i+1)))
+	}
+
+	var tables []*Table
+	for i := 1; i <= count; i++ {
+		table, err := createTable(entries, dataDir, 0, i, DefaultTableOptions())
+		assert.NoError(t, err)
+
+		table.fileNumber = i
+		tables = append(tables, table)
+	}
+
+	return tables, entries
+}
+
+func TestTableCacheKeepsAtMostCapacityFilesOpen(t *testing.T) {
+	_, err := os.Stat(dataDir)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(dataDir, 0755)
+
+		if err != nil {
+			t.Errorf("test failed due to data dir creation error : %s", err.Error())
+			return
+		}
+	}
+	defer os.RemoveAll(dataDir)
+
+	tables, entries := createTableCacheTestTables(t, 3)
+
+	cache := NewTableCache(2)
+	for _, table := range tables {
+		table.setTableCache(cache)
+
+		// the index and filter moved into the cached handle
+		assert.Nil(t, table.indexBlock)
+		assert.Nil(t, table.bloomFilter)
+	}
+
+	for _, table := range tables {
+		record, err := table.get(entries[100].Key)
+		assert.NoError(t, err)
+		assert.Equal(t, entries[100], record)
+	}
+
+	stats := cache.Stats()
+	assert.Equal(t, uint64(3), stats.Misses)
+	assert.Equal(t, 2, stats.OpenFiles)
+
+	// the two most recent stay open
+	_, err = tables[2].get(entries[0].Key)
+	assert.NoError(t, err)
+	_, err = tables[1].get(entries[0].Key)
+	assert.NoError(t, err)
+
+	stats = cache.Stats()
+	assert.Equal(t, uint64(2), stats.Hits)
+	assert.Equal(t, uint64(3), stats.Misses)
+
+	cache.evictAll()
+	assert.Equal(t, 0, cache.Stats().OpenFiles)
+}
+
+func TestTableCacheHandleOutlivesEviction(t *testing.T) {
+	_, err := os.Stat(dataDir)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(dataDir, 0755)
+
+		if err != nil {
+			t.Errorf("test failed due to data dir creation error : %s", err.Error())
+			return
+		}
+	}
+	defer os.RemoveAll(dataDir)
+
+	tables, entries := createTableCacheTestTables(t, 2)
+
+	cache := NewTableCache(1)
+	for _, table := range tables {
+		table.setTableCache(cache)
+	}
+
+	it, err := newTableIterator(tables[0], true)
+	assert.NoError(t, err)
+
+	// evicts the handle the iterator holds and deletes its file
+	_, err = tables[1].get(entries[0].Key)
+	assert.NoError(t, err)
+	assert.NoError(t, tables[0].Delete())
+	assert.Equal(t, 2, cache.Stats().OpenFiles)
+
+	var keys int
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		keys++
+	}
+	assert.NoError(t, it.Err())
+	assert.Equal(t, len(entries), keys)
+
+	assert.NoError(t, it.Close())
+	assert.NoError(t, it.Close())
+	assert.Equal(t, 1, cache.Stats().OpenFiles)
+
+	// a deleted table is not served from the cache anymore
+	_, err = tables[0].get(entries[0].Key)
+	assert.Error(t, err)
+}
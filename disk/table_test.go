@@ -2,6 +2,8 @@ package disk
 
 import (
 	"LsmStorageEngine/types"
+	"encoding/binary"
+	"fmt"
 	"os"
 	"testing"
 
@@ -28,7 +30,7 @@ func TestTableCreation(t *testing.T) {
 		types.NewRecord(toBytes("k4"), toBytes("v4"), false),
 	}
 
-	table, err := CreateNewTableToDisk(entries, dataDir)
+	table, err := CreateNewTableToDisk(entries, dataDir, 0, 1)
 
 	if err != nil {
 		t.Errorf("test failed due table creation error : %s", err.Error())
@@ -69,7 +71,7 @@ func TestTableGet(t *testing.T) {
 		types.NewRecord(toBytes("k4"), toBytes("v4"), false),
 	}
 
-	table, err := CreateNewTableToDisk(entries, dataDir)
+	table, err := CreateNewTableToDisk(entries, dataDir, 0, 1)
 
 	if err != nil {
 		t.Errorf("test failed due table creation error : %s", err.Error())
@@ -116,7 +118,7 @@ func TestGetBoundaries(t *testing.T) {
 		types.NewRecord(toBytes("k4"), toBytes("v4"), false),
 	}
 
-	table, err := CreateNewTableToDisk(entries, dataDir)
+	table, err := CreateNewTableToDisk(entries, dataDir, 0, 1)
 
 	if err != nil {
 		t.Errorf("test failed due table creation error : %s", err.Error())
@@ -133,3 +135,235 @@ func TestGetBoundaries(t *testing.T) {
 		t.Errorf("test failed due to data dir deleting error : %s", err.Error())
 	}
 }
+
+func TestTableGetAcrossBlocks(t *testing.T) {
+	dataDir := "./data"
+
+	_, err := os.Stat(dataDir)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(dataDir, 0755)
+
+		if err != nil {
+			t.Errorf("test failed due to data dir creation error : %s", err.Error())
+		}
+	}
+	defer os.RemoveAll(dataDir)
+
+	var entries []types.Record
+	for i := 0; i < 300; i++ {
+		key := []byte(fmt.Sprintf("k%04d", i))
+
+		// the versions of k0100 fill more than a block on their own
+		if i == 100 {
+			for seqNum := uint64(400); seqNum > 200; seqNum-- {
+				entries = append(entries, types.NewRecordWithSeqNum(key, []byte(fmt.Sprintf("v%d", seqNum)), false, seqNum))
+			}
+			continue
+		}
+
+		entries = append(entries, types.NewRecordWithSeqNum(key, []byte(fmt.Sprintf("v%d", i)), false, uint64(i)))
+	}
+
+	table, err := CreateNewTableToDisk(entries, dataDir, 0, 1)
+	assert.NoError(t, err)
+	assert.Greater(t, len(table.indexBlock.lookUpTable), 2)
+
+	table, err = ReadTablesFromDisk(table.filePath)
+	assert.NoError(t, err)
+	assert.Equal(t, len(entries), table.metaData.entryCount)
+
+	record, err := table.get([]byte("k0299"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v299"), record.Value)
+
+	record, err = table.get([]byte("k0100"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v400"), record.Value)
+
+	record, err = table.getAt([]byte("k0100"), 201, true)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v201"), record.Value)
+
+	_, err = table.getAt([]byte("k0100"), 200, true)
+	assert.Error(t, err)
+
+	allEntries, err := table.getAllEntries()
+	assert.NoError(t, err)
+	assert.Equal(t, entries, allEntries)
+}
+
+func TestReadLegacyTable(t *testing.T) {
+	dataDir := "./data"
+	toBytes := func(str string) []byte { return []byte(str) }
+
+	_, err := os.Stat(dataDir)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(dataDir, 0755)
+
+		if err != nil {
+			t.Errorf("test failed due to data dir creation error : %s", err.Error())
+		}
+	}
+	defer os.RemoveAll(dataDir)
+
+	entries := []types.Record{
+		types.NewRecordWithSeqNum(toBytes("k1"), toBytes("v1"), false, 1),
+		types.NewRecordWithSeqNum(toBytes("k2"), toBytes("v2"), false, 2),
+		types.NewRecordWithSeqNum(toBytes("k3"), []byte{}, true, 3),
+	}
+
+	// | header | bloom filter | dense index | data |
+	bloomFilter := NewBloomFilterFromEntries(legacyFilterKeyCount, legacyFilterErrorRate, entries)
+	data := NewDataBlock(entries).Encode()
+
+	var index []byte
+	offset := 0
+	for _, entry := range entries {
+		index = binary.LittleEndian.AppendUint64(index, uint64(len(entry.Key)))
+		index = append(index, entry.Key...)
+		index = binary.LittleEndian.AppendUint64(index, uint64(offset))
+		offset += len(encodeRecord(nil, entry))
+	}
+
+	var content []byte
+	for _, field := range []uint64{uint64(len(index)), uint64(bloomFilter.getBufferSize()), uint64(len(data)), 1, 42} {
+		content = binary.LittleEndian.AppendUint64(content, field)
+	}
+	content = append(append(append(content, bloomFilter.Serialize()...), index...), data...)
+
+	fileName := tableFileName(dataDir, 1, 1)
+	assert.NoError(t, os.WriteFile(fileName, content, 0644))
+
+	table, err := ReadTablesFromDisk(fileName)
+	assert.NoError(t, err)
+	assert.Equal(t, legacyFormatVersion, table.metaData.formatVersion)
+	assert.Equal(t, 1, table.metaData.level)
+
+	start, end := table.GetBoundaries()
+	assert.Equal(t, toBytes("k1"), start)
+	assert.Equal(t, toBytes("k3"), end)
+
+	record, err := table.get(toBytes("k2"))
+	assert.NoError(t, err)
+	assert.Equal(t, entries[1], record)
+
+	allEntries, err := table.getAllEntries()
+	assert.NoError(t, err)
+	assert.Equal(t, entries, allEntries)
+}
+
+func TestReadOlderBlockFormatTable(t *testing.T) {
+	dataDir := "./data"
+	toBytes := func(str string) []byte { return []byte(str) }
+
+	_, err := os.Stat(dataDir)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(dataDir, 0755)
+
+		if err != nil {
+			t.Errorf("test failed due to data dir creation error : %s", err.Error())
+		}
+	}
+	defer os.RemoveAll(dataDir)
+
+	entries := []types.Record{
+		types.NewRecordWithSeqNum(toBytes("k1"), toBytes("v1"), false, 1),
+		types.NewRecordWithSeqNum(toBytes("k2"), toBytes("v2"), false, 2),
+	}
+
+	_, content := buildTable(entries, 0, blockFormatVersion, DefaultTableOptions())
+
+	fileName := tableFileName(dataDir, 0, 1)
+	assert.NoError(t, os.WriteFile(fileName, content, 0644))
+
+	table, err := ReadTablesFromDisk(fileName)
+	assert.NoError(t, err)
+	assert.Equal(t, blockFormatVersion, table.metaData.formatVersion)
+
+	record, err := table.get(toBytes("k2"))
+	assert.NoError(t, err)
+	assert.Equal(t, entries[1], record)
+
+	allEntries, err := table.getAllEntries()
+	assert.NoError(t, err)
+	assert.Equal(t, entries, allEntries)
+}
+
+func TestTableFilterIsSizedForItsKeys(t *testing.T) {
+	_, err := os.Stat(dataDir)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(dataDir, 0755)
+
+		if err != nil {
+			t.Errorf("test failed due to data dir creation error : %s", err.Error())
+		}
+	}
+	defer os.RemoveAll(dataDir)
+
+	// two versions of every key
+	var entries []types.Record
+	for i := 0; i < 20_000; i++ {
+		key := []byte(fmt.Sprintf("k%06d", i))
+		entries = append(entries,
+			types.NewRecordWithSeqNum(key, []byte("new"), false, uint64(2*i+2)),
+			types.NewRecordWithSeqNum(key, []byte("old"), false, uint64(2*i+1)),
+		)
+	}
+
+	created, err := createTable(entries, dataDir, 0, 1, TableOptions{FilterPolicy: NewBloomFilterPolicy(12)})
+	assert.NoError(t, err)
+
+	table, err := ReadTablesFromDisk(created.filePath)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "bloom", table.metaData.filterPolicy)
+	bloomFilter := table.bloomFilter.(*BloomFilter)
+	assert.Equal(t, 20_000*12, bloomFilter.bitSetSize)
+	assert.Equal(t, 8, bloomFilter.hashFunctionCount)
+
+	record, err := table.get([]byte("k019999"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("new"), record.Value)
+
+	falsePositives := 0
+	for i := 0; i < 10_000; i++ {
+		containsKey, err := table.bloomFilter.ContainsKey([]byte(fmt.Sprintf("absent%06d", i)))
+		assert.NoError(t, err)
+
+		if containsKey {
+			falsePositives++
+		}
+	}
+	assert.Less(t, falsePositives, 100)
+
+	// the sized filter format keeps the parameters in the properties
+	sized, _ := buildTable(entries, 0, sizedFilterFormatVersion, DefaultTableOptions())
+	assert.Equal(t, 20_000*DefaultBloomBitsPerKey, sized.metaData.filterBitCount)
+	assert.Equal(t, 7, sized.metaData.filterHashFunctions)
+
+	decoded, err := decodeProperties(encodeProperties(sized.metaData))
+	assert.NoError(t, err)
+	assert.Equal(t, sized.metaData.filterBitCount, decoded.filterBitCount)
+	assert.Equal(t, sized.metaData.filterHashFunctions, decoded.filterHashFunctions)
+
+	// parameters that do not fit the filter are refused
+	serialized := sized.bloomFilter.(*BloomFilter).Serialize()
+	metaData := sized.metaData
+	metaData.filterBitCount = 8*len(serialized) + 1
+	_, err = decodeFilter(serialized, metaData)
+	assert.Error(t, err)
+
+	// tables of the formats before keep the legacy filter
+	_, content := buildTable(entries[:10], 0, checksumFormatVersion, DefaultTableOptions())
+	fileName := tableFileName(dataDir, 0, 2)
+	assert.NoError(t, os.WriteFile(fileName, content, 0644))
+
+	older, err := ReadTablesFromDisk(fileName)
+	assert.NoError(t, err)
+	legacyFilter := NewBloomFilterFromEntries(legacyFilterKeyCount, legacyFilterErrorRate, entries[:10])
+	assert.Equal(t, &legacyFilter, older.bloomFilter)
+
+	record, err = older.get(entries[8].Key)
+	assert.NoError(t, err)
+	assert.Equal(t, entries[8], record)
+}
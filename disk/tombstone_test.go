@@ -0,0 +1,245 @@
+package disk
+
+import (
+	"LsmStorageEngine/types"
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// a deleted key is either not found or found as its tombstone
+func assertDeleted(t *testing.T, dm *DiskManager, key []byte) {
+	record, err := dm.Get(key)
+
+	if err != nil {
+		assert.Equal(t, types.DISKMANAGER_KEY_NOT_FOUND_ERROR, err.(*types.EngineError).GetErrorCode(), string(key))
+		return
+	}
+
+	assert.True(t, record.TombStone, "%s resurrected as %q", key, record.Value)
+}
+
+func tombstoneCount(dm *DiskManager, levelIndex int) int {
+	count := 0
+	for _, table := range dm.current.levels[levelIndex].tables {
+		records, _ := table.getAllEntries()
+
+		for _, record := range records {
+			if record.TombStone {
+				count++
+			}
+		}
+	}
+
+	return count
+}
+
+func TestTombstoneOutlivesCompactionsAboveTheOldValue(t *testing.T) {
+	_, err := os.Stat(dataDir)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(dataDir, 0755)
+
+		if err != nil {
+			t.Errorf("test failed due to data dir creation error : %s", err.Error())
+			return
+		}
+	}
+	defer os.RemoveAll(dataDir)
+
+	dm, err := OpenDiskManager(10, 100, dataDir)
+	assert.NoError(t, err)
+	defer dm.Close()
+
+	// the old value sinks to level 2
+	assert.NoError(t, dm.Flush([]types.Record{
+		types.NewRecordWithSeqNum(toBytes("a"), toBytes("a1"), false, 1),
+		types.NewRecordWithSeqNum(toBytes("k"), toBytes("old"), false, 2),
+	}, 2))
+	assert.NoError(t, compactLevel(dm, 0))
+	assert.NoError(t, compactLevel(dm, 1))
+
+	assert.NoError(t, dm.Flush([]types.Record{
+		types.NewRecordWithSeqNum(toBytes("k"), nil, true, 3),
+		types.NewRecordWithSeqNum(toBytes("z"), toBytes("z1"), false, 4),
+	}, 3))
+	assertDeleted(t, dm, toBytes("k"))
+
+	// level 2 still holds the old value below level 1
+	assert.NoError(t, compactLevel(dm, 0))
+	assert.Equal(t, 1, tombstoneCount(dm, 1))
+	assertDeleted(t, dm, toBytes("k"))
+
+	// merged with the old value the tombstone has nothing left to hide
+	assert.NoError(t, compactLevel(dm, 1))
+	assert.Equal(t, 0, tombstoneCount(dm, 2))
+	assertDeleted(t, dm, toBytes("k"))
+
+	record, err := dm.Get(toBytes("z"))
+	assert.NoError(t, err)
+	assert.Equal(t, toBytes("z1"), record.Value)
+}
+
+func TestTombstoneDroppedWhenNothingOlderOverlaps(t *testing.T) {
+	_, err := os.Stat(dataDir)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(dataDir, 0755)
+
+		if err != nil {
+			t.Errorf("test failed due to data dir creation error : %s", err.Error())
+			return
+		}
+	}
+	defer os.RemoveAll(dataDir)
+
+	dm, err := OpenDiskManager(10, 100, dataDir)
+	assert.NoError(t, err)
+	defer dm.Close()
+
+	// the table of level 2 is out of the range of the tombstone
+	assert.NoError(t, dm.Flush([]types.Record{types.NewRecordWithSeqNum(toBytes("x"), toBytes("x1"), false, 1)}, 2))
+	assert.NoError(t, compactLevel(dm, 0))
+	assert.NoError(t, compactLevel(dm, 1))
+
+	assert.NoError(t, dm.Flush([]types.Record{types.NewRecordWithSeqNum(toBytes("k"), toBytes("old"), false, 2)}, 3))
+	assert.NoError(t, dm.Flush([]types.Record{types.NewRecordWithSeqNum(toBytes("k"), nil, true, 3)}, 4))
+
+	assert.NoError(t, compactLevel(dm, 0))
+	assert.Equal(t, 0, tombstoneCount(dm, 1))
+	assertDeleted(t, dm, toBytes("k"))
+}
+
+func TestTombstoneKeptForSnapshots(t *testing.T) {
+	_, err := os.Stat(dataDir)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(dataDir, 0755)
+
+		if err != nil {
+			t.Errorf("test failed due to data dir creation error : %s", err.Error())
+			return
+		}
+	}
+	defer os.RemoveAll(dataDir)
+
+	dm, err := OpenDiskManager(10, 100, dataDir)
+	assert.NoError(t, err)
+	defer dm.Close()
+
+	snapshots := []uint64{2}
+	dm.SetSnapshotSource(func() []uint64 { return append([]uint64(nil), snapshots...) })
+
+	assert.NoError(t, dm.Flush([]types.Record{types.NewRecordWithSeqNum(toBytes("k"), toBytes("old"), false, 1)}, 2))
+	assert.NoError(t, dm.Flush([]types.Record{types.NewRecordWithSeqNum(toBytes("j"), toBytes("j1"), false, 2)}, 3))
+	assert.NoError(t, dm.Flush([]types.Record{types.NewRecordWithSeqNum(toBytes("k"), nil, true, 3)}, 4))
+
+	// everything is merged, but the snapshot still sees the old value
+	assert.NoError(t, compactLevel(dm, 0))
+
+	record, err := dm.GetAt(toBytes("k"), 2, false)
+	assert.NoError(t, err)
+	assert.Equal(t, toBytes("old"), record.Value)
+	assertDeleted(t, dm, toBytes("k"))
+
+	snapshots = nil
+	assert.NoError(t, compactLevel(dm, 1))
+	assert.Equal(t, 0, tombstoneCount(dm, 2))
+	assertDeleted(t, dm, toBytes("k"))
+}
+
+func TestDeletesNeverResurrect(t *testing.T) {
+	strategies := map[string]func() CompactionStrategy{
+		"leveled": func() CompactionStrategy {
+			s := NewLeveledCompactionStrategy(2, 2)
+			s.SetLevelBaseBytes(4 << 10)
+			return s
+		},
+		"dynamic-leveled": func() CompactionStrategy {
+			s := NewLeveledCompactionStrategy(2, 2)
+			s.SetLevelBaseBytes(4 << 10)
+			s.SetDynamicLevelBytes(true)
+			return s
+		},
+		"size-tiered": func() CompactionStrategy { return NewSizeTieredCompactionStrategy(3) },
+	}
+
+	for name, strategy := range strategies {
+		t.Run(name, func(t *testing.T) {
+			_, err := os.Stat(dataDir)
+			if os.IsNotExist(err) {
+				err = os.Mkdir(dataDir, 0755)
+
+				if err != nil {
+					t.Errorf("test failed due to data dir creation error : %s", err.Error())
+					return
+				}
+			}
+			defer os.RemoveAll(dataDir)
+
+			dm, err := OpenDiskManager(2, 2, dataDir)
+			assert.NoError(t, err)
+
+			dm.SetCompactionStrategy(strategy())
+			dm.SetTargetFileSize(512)
+
+			random := rand.New(rand.NewSource(24))
+			latest := map[string]types.Record{}
+			seqNum := uint64(0)
+
+			check := func() {
+				for key, record := range latest {
+					if record.TombStone {
+						assertDeleted(t, dm, []byte(key))
+						continue
+					}
+
+					found, err := dm.Get([]byte(key))
+					assert.NoError(t, err, key)
+					assert.Equal(t, record.Value, found.Value, key)
+				}
+			}
+
+			for batch := 0; batch < 80; batch++ {
+				batchRecords := map[string]types.Record{}
+				for i := 0; i < 30; i++ {
+					seqNum++
+					key := fmt.Sprintf("key%04d", random.Intn(2000))
+					record := types.NewRecordWithSeqNum([]byte(key), []byte(fmt.Sprintf("v%d", seqNum)), false, seqNum)
+
+					// keys are seldom written twice, so a delete mostly hits a
+					// value written long ago, which sank the deepest
+					if random.Intn(3) == 0 {
+						record = types.NewRecordWithSeqNum([]byte(key), nil, true, seqNum)
+					}
+
+					batchRecords[key] = record
+				}
+
+				var records []types.Record
+				for key, record := range batchRecords {
+					records = append(records, record)
+					latest[key] = record
+				}
+				sort.Slice(records, func(i, j int) bool { return bytes.Compare(records[i].Key, records[j].Key) < 0 })
+
+				assert.NoError(t, dm.Flush(records, batch+2))
+				assert.NoError(t, dm.WaitForCompactions())
+
+				if batch%10 == 9 {
+					check()
+				}
+			}
+
+			assert.NoError(t, dm.Close())
+
+			dm, err = OpenDiskManager(2, 2, dataDir)
+			assert.NoError(t, err)
+			defer dm.Close()
+
+			check()
+		})
+	}
+}
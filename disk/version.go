@@ -0,0 +1,86 @@
+package disk
+
+import (
+	"bytes"
+	"sort"
+	"sync/atomic"
+)
+
+/*
+version is an immutable view of the levels. Readers hold a reference to the
+version they started on, so a compaction installing a new version neither
+changes what they see nor deletes the tables under them. The disk manager
+holds a reference to its current version until the next one replaces it.
+*/
+type version struct {
+	levels []*Level
+	refs   atomic.Int32
+}
+
+func newVersion(levels []*Level) *version {
+	v := &version{levels: levels}
+	v.refs.Store(1)
+
+	for _, level := range levels {
+		for _, table := range level.tables {
+			table.ref()
+		}
+	}
+
+	return v
+}
+
+func (v *version) ref() {
+	v.refs.Add(1)
+}
+
+func (v *version) unref() {
+	if v.refs.Add(-1) != 0 {
+		return
+	}
+
+	for _, level := range v.levels {
+		for _, table := range level.tables {
+			table.unref()
+		}
+	}
+}
+
+// the version that follows v once removed is dropped and added is placed on
+// the level of every table, newest first in level 0 and by key range below
+func (v *version) next(added []*Table, removed []*Table) *version {
+	dropped := map[*Table]bool{}
+	for _, table := range removed {
+		dropped[table] = true
+	}
+
+	levels := make([]*Level, len(v.levels))
+	for levelIndex, level := range v.levels {
+		levels[levelIndex] = &Level{}
+
+		for _, table := range level.tables {
+			if !dropped[table] {
+				levels[levelIndex].tables = append(levels[levelIndex].tables, table)
+			}
+		}
+	}
+
+	for _, table := range added {
+		for len(levels) <= table.metaData.level {
+			levels = append(levels, &Level{})
+		}
+
+		levels[table.metaData.level].push(table)
+	}
+
+	for _, level := range levels[1:] {
+		sort.Slice(level.tables, func(i, j int) bool {
+			iStart, _ := level.tables[i].GetBoundaries()
+			jStart, _ := level.tables[j].GetBoundaries()
+
+			return bytes.Compare(iStart, jStart) < 0
+		})
+	}
+
+	return newVersion(levels)
+}
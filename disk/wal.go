@@ -0,0 +1,405 @@
+package disk
+
+import (
+	"LsmStorageEngine/types"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type SyncPolicy int
+
+const (
+	// fsync the segment before every append returns
+	SyncEveryWrite SyncPolicy = iota
+	// fsync the segment periodically from a background goroutine
+	SyncInterval
+	// leave it to the os to write the segment back
+	SyncNone
+)
+
+const (
+	walSegmentSuffix = ".log"
+	// crc32c of the payload followed by the payload length
+	walRecordHeaderSize = 8
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+/*
+WriteAheadLog appends every mutation to a segment file before it is applied
+to the memtable. A segment is sealed when the memtable it covers is flushed
+and is only deleted once the resulting table is safely on disk.
+
+every record is laid out as | crc32c (4) | length (4) | payload (length) |
+*/
+type WriteAheadLog struct {
+	mu       sync.Mutex
+	dir      string
+	segment  *os.File
+	current  int
+	sealed   []int
+	policy   SyncPolicy
+	dirty    bool
+	stopSync chan struct{}
+	syncDone chan struct{}
+}
+
+func segmentFileName(dir string, number int) string {
+	return filepath.Join(dir, fmt.Sprintf("%06d%s", number, walSegmentSuffix))
+}
+
+func listSegments(dir string) ([]int, error) {
+	entries, err := os.ReadDir(dir)
+
+	if err != nil {
+		return nil, types.NewEngineError(
+			types.WAL_FILE_OPEN_ERROR,
+			fmt.Sprintf("wal directory read error : %s", err.Error()),
+		)
+	}
+
+	var segments []int
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, walSegmentSuffix) {
+			continue
+		}
+
+		number, err := strconv.Atoi(strings.TrimSuffix(name, walSegmentSuffix))
+		if err != nil {
+			continue
+		}
+
+		segments = append(segments, number)
+	}
+
+	sort.Ints(segments)
+
+	return segments, nil
+}
+
+// opens the log in dir, every segment already present is kept for Replay and
+// new records go to a fresh segment
+func OpenWriteAheadLog(dir string, policy SyncPolicy, syncInterval time.Duration) (*WriteAheadLog, error) {
+	segments, err := listSegments(dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	current := 1
+	if len(segments) != 0 {
+		current = segments[len(segments)-1] + 1
+	}
+
+	wal := &WriteAheadLog{
+		dir:     dir,
+		current: current,
+		sealed:  segments,
+		policy:  policy,
+	}
+
+	wal.segment, err = wal.createSegment(current)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if policy == SyncInterval {
+		wal.stopSync = make(chan struct{})
+		wal.syncDone = make(chan struct{})
+		go wal.syncLoop(syncInterval)
+	}
+
+	return wal, nil
+}
+
+func (w *WriteAheadLog) createSegment(number int) (*os.File, error) {
+	fd, err := os.OpenFile(segmentFileName(w.dir, number), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+
+	if err != nil {
+		return nil, types.NewEngineError(
+			types.WAL_FILE_OPEN_ERROR,
+			fmt.Sprintf("wal segment creation error : %s", err.Error()),
+		)
+	}
+
+	return fd, nil
+}
+
+func (w *WriteAheadLog) syncLoop(interval time.Duration) {
+	defer close(w.syncDone)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			w.mu.Lock()
+			w.sync()
+			w.mu.Unlock()
+		case <-w.stopSync:
+			return
+		}
+	}
+}
+
+func (w *WriteAheadLog) sync() error {
+	if !w.dirty {
+		return nil
+	}
+
+	if err := w.segment.Sync(); err != nil {
+		return types.NewEngineError(
+			types.WAL_WRITE_ERROR,
+			fmt.Sprintf("wal segment sync error : %s", err.Error()),
+		)
+	}
+
+	w.dirty = false
+
+	return nil
+}
+
+/*
+feeds the payload of every record of the segments that existed when the
+log was opened, oldest first. a torn record at the tail of the last segment
+holding records is what a crash mid append leaves behind and ends the
+replay, it is cut off the segment so the segments of later opens stay
+behind intact ones. any other bad record is corruption.
+*/
+func (w *WriteAheadLog) Replay(apply func(payload []byte) error) error {
+	w.mu.Lock()
+	segments := append([]int(nil), w.sealed...)
+	w.mu.Unlock()
+
+	// a crash right after an open leaves the segment it started empty
+	lastWritten := -1
+	for i, number := range segments {
+		if info, err := os.Stat(segmentFileName(w.dir, number)); err == nil && info.Size() != 0 {
+			lastWritten = i
+		}
+	}
+
+	for i, number := range segments {
+		buffer, err := os.ReadFile(segmentFileName(w.dir, number))
+
+		if err != nil {
+			return types.NewEngineError(
+				types.WAL_READ_ERROR,
+				fmt.Sprintf("wal segment read error : %s", err.Error()),
+			)
+		}
+
+		for offset := 0; offset < len(buffer); {
+			payload, rest, ok := decodeLogRecord(buffer[offset:])
+
+			if !ok {
+				if i == lastWritten && isTornTail(buffer[offset:]) {
+					if err := truncateSegment(segmentFileName(w.dir, number), offset); err != nil {
+						return err
+					}
+
+					break
+				}
+
+				return types.NewEngineError(
+					types.WAL_RECORD_CORRUPTED_ERROR,
+					fmt.Sprintf(
+						"corrupted record in wal segment %s at offset %d",
+						segmentFileName(w.dir, number),
+						offset,
+					),
+				)
+			}
+
+			if err := apply(payload); err != nil {
+				return err
+			}
+
+			offset = len(buffer) - len(rest)
+		}
+	}
+
+	return nil
+}
+
+func truncateSegment(fileName string, size int) error {
+	fd, err := os.OpenFile(fileName, os.O_WRONLY, 0644)
+
+	if err == nil {
+		defer fd.Close()
+
+		if err = fd.Truncate(int64(size)); err == nil {
+			err = fd.Sync()
+		}
+	}
+
+	if err != nil {
+		return types.NewEngineError(
+			types.WAL_WRITE_ERROR,
+			fmt.Sprintf("wal segment truncate error : %s", err.Error()),
+		)
+	}
+
+	return nil
+}
+
+// frames payload as | crc32c (4) | length (4) | payload (length) |, shared by
+// the wal and the manifest
+func encodeLogRecord(payload []byte) []byte {
+	record := make([]byte, walRecordHeaderSize, walRecordHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(record[0:4], crc32.Checksum(payload, crcTable))
+	binary.LittleEndian.PutUint32(record[4:8], uint32(len(payload)))
+
+	return append(record, payload...)
+}
+
+func decodeLogRecord(buffer []byte) ([]byte, []byte, bool) {
+	if len(buffer) < walRecordHeaderSize {
+		return nil, buffer, false
+	}
+
+	checksum := binary.LittleEndian.Uint32(buffer[0:4])
+	length := int(binary.LittleEndian.Uint32(buffer[4:8]))
+
+	// every record carries a payload, a zeroed header is space a crash left
+	// unwritten
+	if length == 0 || len(buffer)-walRecordHeaderSize < length {
+		return nil, buffer, false
+	}
+
+	payload := buffer[walRecordHeaderSize : walRecordHeaderSize+length]
+
+	if crc32.Checksum(payload, crcTable) != checksum {
+		return nil, buffer, false
+	}
+
+	return payload, buffer[walRecordHeaderSize+length:], true
+}
+
+/*
+whether a record that fails to decode at the start of buffer may be the
+last one, torn by a crash mid append: either nothing but zeros follow, or
+it reaches the end of the buffer and no intact record starts within it. a
+damaged length reaching past the end still has the records after it.
+*/
+func isTornTail(buffer []byte) bool {
+	zeros := true
+	for _, b := range buffer {
+		zeros = zeros && b == 0
+	}
+
+	if zeros || len(buffer) < walRecordHeaderSize {
+		return true
+	}
+
+	length := int(binary.LittleEndian.Uint32(buffer[4:8]))
+	if len(buffer)-walRecordHeaderSize > length {
+		return false
+	}
+
+	for offset := 1; offset+walRecordHeaderSize < len(buffer); offset++ {
+		if _, _, ok := decodeLogRecord(buffer[offset:]); ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (w *WriteAheadLog) Append(payload []byte) error {
+	record := encodeLogRecord(payload)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, err := w.segment.Write(record); err != nil {
+		return types.NewEngineError(
+			types.WAL_WRITE_ERROR,
+			fmt.Sprintf("wal append error : %s", err.Error()),
+		)
+	}
+
+	w.dirty = true
+
+	if w.policy == SyncEveryWrite {
+		return w.sync()
+	}
+
+	return nil
+}
+
+// seals the current segment and starts a new one, the returned number is the
+// newest segment the memtable being flushed depends on
+func (w *WriteAheadLog) Rotate() (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.sync(); err != nil {
+		return 0, err
+	}
+
+	segment, err := w.createSegment(w.current + 1)
+
+	if err != nil {
+		return 0, err
+	}
+
+	w.segment.Close()
+	w.sealed = append(w.sealed, w.current)
+	w.segment = segment
+	w.current++
+
+	return w.current - 1, nil
+}
+
+// deletes every sealed segment up to and including number, must only be
+// called once the memtable covering them has been flushed
+func (w *WriteAheadLog) DeleteSegmentsUpTo(number int) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var remaining []int
+	for _, segment := range w.sealed {
+		if segment > number {
+			remaining = append(remaining, segment)
+			continue
+		}
+
+		if err := os.Remove(segmentFileName(w.dir, segment)); err != nil && !os.IsNotExist(err) {
+			return types.NewEngineError(
+				types.WAL_FILE_DELETE_ERROR,
+				fmt.Sprintf("wal segment delete error : %s", err.Error()),
+			)
+		}
+	}
+
+	w.sealed = remaining
+
+	return nil
+}
+
+func (w *WriteAheadLog) Close() error {
+	if w.stopSync != nil {
+		close(w.stopSync)
+		<-w.syncDone
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	err := w.sync()
+	w.segment.Close()
+
+	return err
+}
@@ -0,0 +1,351 @@
+package disk
+
+import (
+	"LsmStorageEngine/types"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWalAppendAndReplay(t *testing.T) {
+	_, err := os.Stat(dataDir)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(dataDir, 0755)
+
+		if err != nil {
+			t.Errorf("test failed due to data dir creation error : %s", err.Error())
+			return
+		}
+	}
+	defer os.RemoveAll(dataDir)
+
+	wal, err := OpenWriteAheadLog(dataDir, SyncEveryWrite, time.Millisecond)
+
+	if err != nil {
+		t.Errorf("test failed due to wal open error : %s", err.Error())
+		return
+	}
+
+	payloads := [][]byte{toBytes("p1"), toBytes("p2"), toBytes("p3")}
+	for _, payload := range payloads {
+		if err := wal.Append(payload); err != nil {
+			t.Errorf("test failed due to wal append error : %s", err.Error())
+			return
+		}
+	}
+
+	wal.Close()
+
+	wal, err = OpenWriteAheadLog(dataDir, SyncNone, time.Millisecond)
+
+	if err != nil {
+		t.Errorf("test failed due to wal open error : %s", err.Error())
+		return
+	}
+	defer wal.Close()
+
+	var replayed [][]byte
+	err = wal.Replay(func(payload []byte) error {
+		replayed = append(replayed, payload)
+		return nil
+	})
+
+	if err != nil {
+		t.Errorf("test failed due to wal replay error : %s", err.Error())
+		return
+	}
+
+	assert.Equal(t, payloads, replayed)
+}
+
+func TestWalReplayIgnoresTornTail(t *testing.T) {
+	_, err := os.Stat(dataDir)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(dataDir, 0755)
+
+		if err != nil {
+			t.Errorf("test failed due to data dir creation error : %s", err.Error())
+			return
+		}
+	}
+	defer os.RemoveAll(dataDir)
+
+	wal, err := OpenWriteAheadLog(dataDir, SyncEveryWrite, time.Millisecond)
+
+	if err != nil {
+		t.Errorf("test failed due to wal open error : %s", err.Error())
+		return
+	}
+
+	wal.Append(toBytes("p1"))
+	wal.Append(toBytes("p2"))
+	wal.Close()
+
+	// cut the last record in half the way a crash mid write would
+	segment := segmentFileName(dataDir, 1)
+	info, _ := os.Stat(segment)
+	os.Truncate(segment, info.Size()-1)
+
+	wal, err = OpenWriteAheadLog(dataDir, SyncEveryWrite, time.Millisecond)
+
+	if err != nil {
+		t.Errorf("test failed due to wal open error : %s", err.Error())
+		return
+	}
+	defer wal.Close()
+
+	var replayed [][]byte
+	err = wal.Replay(func(payload []byte) error {
+		replayed = append(replayed, payload)
+		return nil
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{toBytes("p1")}, replayed)
+}
+
+func TestWalDeleteSegmentsAfterRotate(t *testing.T) {
+	_, err := os.Stat(dataDir)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(dataDir, 0755)
+
+		if err != nil {
+			t.Errorf("test failed due to data dir creation error : %s", err.Error())
+			return
+		}
+	}
+	defer os.RemoveAll(dataDir)
+
+	wal, err := OpenWriteAheadLog(dataDir, SyncInterval, time.Millisecond)
+
+	if err != nil {
+		t.Errorf("test failed due to wal open error : %s", err.Error())
+		return
+	}
+	defer wal.Close()
+
+	wal.Append(toBytes("p1"))
+
+	sealed, err := wal.Rotate()
+
+	if err != nil {
+		t.Errorf("test failed due to wal rotate error : %s", err.Error())
+		return
+	}
+
+	wal.Append(toBytes("p2"))
+
+	err = wal.DeleteSegmentsUpTo(sealed)
+	assert.NoError(t, err)
+
+	segments, err := listSegments(dataDir)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{sealed + 1}, segments)
+}
+
+func TestWalReplaySurvivesCrashesInARow(t *testing.T) {
+	_, err := os.Stat(dataDir)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(dataDir, 0755)
+
+		if err != nil {
+			t.Errorf("test failed due to data dir creation error : %s", err.Error())
+			return
+		}
+	}
+	defer os.RemoveAll(dataDir)
+
+	// every session replays the log the way opening the engine does and
+	// crashes mid append, before anything is flushed. one more crashes right
+	// after opening, leaving an empty segment behind the torn one
+	var expected [][]byte
+	for session := 1; session <= 2; session++ {
+		wal, err := OpenWriteAheadLog(dataDir, SyncEveryWrite, time.Millisecond)
+		assert.NoError(t, err)
+		assert.NoError(t, wal.Replay(func(payload []byte) error { return nil }))
+
+		payload := toBytes(fmt.Sprintf("session-%d", session))
+		assert.NoError(t, wal.Append(payload))
+		assert.NoError(t, wal.Append(toBytes("torn")))
+		wal.Close()
+
+		segment := segmentFileName(dataDir, session)
+		info, _ := os.Stat(segment)
+		os.Truncate(segment, info.Size()-2)
+
+		expected = append(expected, payload)
+	}
+
+	wal, err := OpenWriteAheadLog(dataDir, SyncEveryWrite, time.Millisecond)
+	assert.NoError(t, err)
+	wal.Close()
+
+	wal, err = OpenWriteAheadLog(dataDir, SyncEveryWrite, time.Millisecond)
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	var replayed [][]byte
+	err = wal.Replay(func(payload []byte) error {
+		replayed = append(replayed, payload)
+		return nil
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, expected, replayed)
+}
+
+func TestWalReplayReportsCorruptionBeforeTheTail(t *testing.T) {
+	_, err := os.Stat(dataDir)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(dataDir, 0755)
+
+		if err != nil {
+			t.Errorf("test failed due to data dir creation error : %s", err.Error())
+			return
+		}
+	}
+	defer os.RemoveAll(dataDir)
+
+	wal, err := OpenWriteAheadLog(dataDir, SyncEveryWrite, time.Millisecond)
+	assert.NoError(t, err)
+
+	wal.Append(toBytes("p1"))
+	wal.Append(toBytes("p2"))
+	wal.Append(toBytes("p3"))
+	wal.Close()
+
+	// flip a payload byte of the second record
+	segment := segmentFileName(dataDir, 1)
+	buffer, _ := os.ReadFile(segment)
+	recordSize := len(encodeLogRecord(toBytes("p1")))
+	buffer[recordSize+walRecordHeaderSize] ^= 0xff
+	os.WriteFile(segment, buffer, 0644)
+
+	wal, err = OpenWriteAheadLog(dataDir, SyncEveryWrite, time.Millisecond)
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	err = wal.Replay(func(payload []byte) error { return nil })
+
+	assert.Equal(t, types.WAL_RECORD_CORRUPTED_ERROR, err.(*types.EngineError).GetErrorCode())
+	assert.Contains(t, err.Error(), fmt.Sprintf("at offset %d", recordSize))
+}
+
+func TestWalReplayReportsTornRecordBeforeTheLastSegment(t *testing.T) {
+	_, err := os.Stat(dataDir)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(dataDir, 0755)
+
+		if err != nil {
+			t.Errorf("test failed due to data dir creation error : %s", err.Error())
+			return
+		}
+	}
+	defer os.RemoveAll(dataDir)
+
+	wal, err := OpenWriteAheadLog(dataDir, SyncEveryWrite, time.Millisecond)
+	assert.NoError(t, err)
+
+	wal.Append(toBytes("p1"))
+	wal.Append(toBytes("p2"))
+	_, err = wal.Rotate()
+	assert.NoError(t, err)
+	wal.Append(toBytes("p3"))
+	wal.Close()
+
+	// only the newest segment may end in a torn record
+	segment := segmentFileName(dataDir, 1)
+	info, _ := os.Stat(segment)
+	os.Truncate(segment, info.Size()-1)
+
+	wal, err = OpenWriteAheadLog(dataDir, SyncEveryWrite, time.Millisecond)
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	err = wal.Replay(func(payload []byte) error { return nil })
+
+	assert.Equal(t, types.WAL_RECORD_CORRUPTED_ERROR, err.(*types.EngineError).GetErrorCode())
+	assert.Contains(t, err.Error(), fmt.Sprintf("at offset %d", len(encodeLogRecord(toBytes("p1")))))
+}
+
+func TestWalReplayReportsDamagedLengthBeforeTheTail(t *testing.T) {
+	_, err := os.Stat(dataDir)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(dataDir, 0755)
+
+		if err != nil {
+			t.Errorf("test failed due to data dir creation error : %s", err.Error())
+			return
+		}
+	}
+	defer os.RemoveAll(dataDir)
+
+	wal, err := OpenWriteAheadLog(dataDir, SyncEveryWrite, time.Millisecond)
+	assert.NoError(t, err)
+
+	wal.Append(toBytes("p1"))
+	wal.Append(toBytes("p2"))
+	wal.Append(toBytes("p3"))
+	wal.Close()
+
+	// a length of the first record reaching past the end of the segment
+	// looks like a torn tail, but intact records follow it
+	segment := segmentFileName(dataDir, 1)
+	buffer, _ := os.ReadFile(segment)
+	binary.LittleEndian.PutUint32(buffer[4:8], uint32(len(buffer)))
+	os.WriteFile(segment, buffer, 0644)
+
+	wal, err = OpenWriteAheadLog(dataDir, SyncEveryWrite, time.Millisecond)
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	err = wal.Replay(func(payload []byte) error { return nil })
+
+	assert.Equal(t, types.WAL_RECORD_CORRUPTED_ERROR, err.(*types.EngineError).GetErrorCode())
+	assert.Contains(t, err.Error(), "at offset 0")
+}
+
+func TestWalReplayIgnoresZeroedTail(t *testing.T) {
+	_, err := os.Stat(dataDir)
+	if os.IsNotExist(err) {
+		err = os.Mkdir(dataDir, 0755)
+
+		if err != nil {
+			t.Errorf("test failed due to data dir creation error : %s", err.Error())
+			return
+		}
+	}
+	defer os.RemoveAll(dataDir)
+
+	wal, err := OpenWriteAheadLog(dataDir, SyncEveryWrite, time.Millisecond)
+	assert.NoError(t, err)
+
+	wal.Append(toBytes("p1"))
+	wal.Close()
+
+	// space the file system allocated but the crash never wrote
+	segment := segmentFileName(dataDir, 1)
+	buffer, _ := os.ReadFile(segment)
+	os.WriteFile(segment, append(buffer, make([]byte, 64)...), 0644)
+
+	wal, err = OpenWriteAheadLog(dataDir, SyncEveryWrite, time.Millisecond)
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	var replayed [][]byte
+	err = wal.Replay(func(payload []byte) error {
+		replayed = append(replayed, payload)
+		return nil
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{toBytes("p1")}, replayed)
+
+	// the tail is cut off, the segment ends after the last record
+	info, _ := os.Stat(segment)
+	assert.Equal(t, int64(len(buffer)), info.Size())
+}
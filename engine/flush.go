@@ -0,0 +1,113 @@
+package engine
+
+import (
+	"LsmStorageEngine/mem"
+)
+
+// a full memtable waiting for the background flusher, segment is the last
+// wal segment holding its writes
+type immutableMemtable struct {
+	memtable *mem.Memtable
+	segment  int
+}
+
+// the mutable memtable followed by the immutable ones, newest first
+func (engine *storageEngine) memtables() []*mem.Memtable {
+	engine.memMu.RLock()
+	defer engine.memMu.RUnlock()
+
+	memtables := []*mem.Memtable{engine.m}
+	for _, immutable := range engine.immutables {
+		memtables = append(memtables, immutable.memtable)
+	}
+
+	return memtables
+}
+
+/*
+makeRoomForWrite freezes a full memtable into the immutable list and hands
+writers a fresh one, the wal is rotated so the frozen writes end in a segment
+of their own. Writes stall while maxImmutableMemtables are waiting for the
+flusher already. Callers hold writeMu.
+*/
+func (engine *storageEngine) makeRoomForWrite() error {
+	engine.memMu.Lock()
+	defer engine.memMu.Unlock()
+
+	if engine.backgroundErr != nil {
+		return engine.backgroundErr
+	}
+
+	if !engine.m.IsFull() {
+		return nil
+	}
+
+	for len(engine.immutables) >= engine.maxImmutableMemtables && engine.backgroundErr == nil {
+		engine.memChanged.Wait()
+	}
+
+	if engine.backgroundErr != nil {
+		return engine.backgroundErr
+	}
+
+	segment, err := engine.wal.Rotate()
+
+	if err != nil {
+		return err
+	}
+
+	engine.immutables = append([]immutableMemtable{{memtable: engine.m, segment: segment}}, engine.immutables...)
+	engine.m = mem.NewMemtable(engine.memTableSize)
+	engine.memChanged.Broadcast()
+
+	return nil
+}
+
+// turns the immutable memtables into level 0 tables oldest first, until the
+// engine closes or a flush fails
+func (engine *storageEngine) flushImmutables() {
+	defer close(engine.flusherDone)
+
+	engine.memMu.Lock()
+	defer engine.memMu.Unlock()
+
+	for {
+		for len(engine.immutables) == 0 && !engine.closing {
+			engine.memChanged.Wait()
+		}
+
+		if engine.closing {
+			return
+		}
+
+		oldest := engine.immutables[len(engine.immutables)-1]
+		engine.memMu.Unlock()
+
+		err := oldest.memtable.Flush(engine.dm, oldest.segment+1)
+		if err == nil {
+			err = engine.wal.DeleteSegmentsUpTo(oldest.segment)
+		}
+
+		engine.memMu.Lock()
+
+		if err != nil {
+			engine.backgroundErr = err
+			engine.memChanged.Broadcast()
+			return
+		}
+
+		engine.immutables = engine.immutables[:len(engine.immutables)-1]
+		engine.memChanged.Broadcast()
+	}
+}
+
+// stops the flusher after the flush it is running, memtables still waiting
+// are recovered from the wal on the next open
+func (engine *storageEngine) stopFlusher() {
+	engine.memMu.Lock()
+	engine.closing = true
+	engine.memChanged.Broadcast()
+	engine.memMu.Unlock()
+
+	<-engine.flusherDone
+}
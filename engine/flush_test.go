@@ -0,0 +1,178 @@
+package engine
+
+import (
+	"LsmStorageEngine/types"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// stops the flusher so frozen memtables pile up in the immutable list
+func pauseFlusher(engine *storageEngine) {
+	engine.stopFlusher()
+}
+
+func resumeFlusher(engine *storageEngine) {
+	engine.memMu.Lock()
+	engine.closing = false
+	engine.flusherDone = make(chan struct{})
+	engine.memMu.Unlock()
+
+	go engine.flushImmutables()
+}
+
+func immutableCount(engine *storageEngine) int {
+	engine.memMu.RLock()
+	defer engine.memMu.RUnlock()
+
+	return len(engine.immutables)
+}
+
+// waits until the flusher emptied the immutable list or failed
+func waitForFlushes(engine *storageEngine) error {
+	engine.memMu.Lock()
+	defer engine.memMu.Unlock()
+
+	for len(engine.immutables) != 0 && engine.backgroundErr == nil {
+		engine.memChanged.Wait()
+	}
+
+	return engine.backgroundErr
+}
+
+// writes padding keys until the memtable is full, the next write freezes it
+func fillMemtable(t *testing.T, engine *storageEngine, prefix string) {
+	for i := 0; !engine.m.IsFull(); i++ {
+		put(t, engine, fmt.Sprintf("%s%03d", prefix, i), "v")
+	}
+}
+
+func assertValue(t *testing.T, engine *storageEngine, key, value string) {
+	result := <-engine.Get([]byte(key), nil)
+
+	if assert.NoError(t, result.Err, key) {
+		assert.Equal(t, value, string(result.Record.Value), key)
+	}
+}
+
+func TestWritesStallOnFullImmutableQueue(t *testing.T) {
+	engine := openTestEngine(t, WithMemTableSize(256), WithMaxImmutableMemtables(2))
+	defer os.RemoveAll(dataDir)
+	defer engine.Close()
+
+	pauseFlusher(engine)
+
+	// a memtable is frozen by the first write that finds it full, the one
+	// after the queue is full has to wait
+	written := 0
+	for immutableCount(engine) < 2 || !engine.m.IsFull() {
+		assert.LessOrEqual(t, immutableCount(engine), 2)
+		put(t, engine, fmt.Sprintf("k%03d", written), "v")
+		written++
+	}
+
+	stalled := make(chan Result)
+	go func() {
+		stalled <- <-engine.Put(types.NewRecord([]byte(fmt.Sprintf("k%03d", written)), []byte("v"), false))
+	}()
+
+	select {
+	case <-stalled:
+		t.Fatal("write went through with the immutable queue full")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// reads go on while the writer waits, finding the queued memtables
+	for i := 0; i < written; i++ {
+		assertValue(t, engine, fmt.Sprintf("k%03d", i), "v")
+	}
+
+	resumeFlusher(engine)
+
+	select {
+	case result := <-stalled:
+		assert.NoError(t, result.Err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("write still stalled after the flusher resumed")
+	}
+
+	assert.NoError(t, waitForFlushes(engine))
+	assert.Zero(t, immutableCount(engine))
+
+	for i := 0; i <= written; i++ {
+		assertValue(t, engine, fmt.Sprintf("k%03d", i), "v")
+	}
+}
+
+func TestImmutablesFlushOldestFirst(t *testing.T) {
+	engine := openTestEngine(t, WithMemTableSize(256), WithMaxImmutableMemtables(3))
+	defer os.RemoveAll(dataDir)
+
+	pauseFlusher(engine)
+
+	// every memtable holds a newer version of k than the one before it
+	for version := 1; version <= 3; version++ {
+		put(t, engine, "k", fmt.Sprintf("v%d", version))
+		fillMemtable(t, engine, fmt.Sprintf("pad%d/", version))
+	}
+	put(t, engine, "last", "v")
+	assert.Equal(t, 3, immutableCount(engine))
+
+	// queued memtables are read newest first
+	assertValue(t, engine, "k", "v3")
+
+	it := engine.NewIterator(nil)
+	it.Seek([]byte("k"))
+	assert.Equal(t, "k=v3", string(it.Key())+"="+string(it.Value()))
+	it.Close()
+
+	newestSegment := engine.immutables[0].segment
+
+	resumeFlusher(engine)
+	assert.NoError(t, waitForFlushes(engine))
+
+	// the segments are covered in the order they were written, a newer
+	// memtable flushed first would leave the log number behind its segment
+	assert.Equal(t, newestSegment+1, engine.dm.LogNumber())
+	assertValue(t, engine, "k", "v3")
+	assert.NoError(t, engine.Close())
+
+	se, err := Open(dataDir, WithMemTableSize(256))
+	assert.NoError(t, err)
+	engine = se.(*storageEngine)
+	defer engine.Close()
+
+	assertValue(t, engine, "k", "v3")
+	assertValue(t, engine, "last", "v")
+}
+
+func TestFlushErrorFailsLaterWrites(t *testing.T) {
+	engine := openTestEngine(t, WithMemTableSize(256))
+	defer os.RemoveAll(dataDir)
+
+	pauseFlusher(engine)
+
+	put(t, engine, "k00", "v")
+	fillMemtable(t, engine, "pad/")
+	put(t, engine, "k01", "v")
+	assert.Equal(t, 1, immutableCount(engine))
+
+	// the table of the frozen memtable has nowhere to go
+	assert.NoError(t, os.RemoveAll(dataDir))
+	resumeFlusher(engine)
+
+	err := waitForFlushes(engine)
+	assert.Error(t, err)
+
+	result := <-engine.Put(types.NewRecord([]byte("k02"), []byte("v"), false))
+	assert.Equal(t, err, result.Err)
+
+	// what the flusher could not write is still there to read
+	assertValue(t, engine, "k00", "v")
+	assertValue(t, engine, "k01", "v")
+
+	engine.Close()
+}
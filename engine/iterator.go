@@ -0,0 +1,219 @@
+package engine
+
+import (
+	"LsmStorageEngine/disk"
+	"bytes"
+)
+
+// Iterator walks the live keys of the store in order, a fresh iterator is
+// not positioned until one of the Seek calls. An iterator bounded to a
+// prefix is only valid on keys starting with it
+type Iterator interface {
+	Seek(key []byte)
+	SeekToFirst()
+	SeekToLast()
+	Next()
+	Prev()
+	Valid() bool
+	Key() []byte
+	Value() []byte
+	Err() error
+	Close() error
+}
+
+/*
+storeIterator sits on top of the merge of the memtable and every table and
+only exposes the newest version of every key written up to seqNum, skipping
+keys whose newest such version is a tombstone.
+
+moving forward the merged iterator sits on the entry being exposed, moving
+backwards it sits before every version of the exposed key which is kept in
+savedKey and savedValue instead. With a prefix the iterator turns invalid
+once it leaves the keys starting with it.
+*/
+type storeIterator struct {
+	merged     disk.Iterator
+	forward    bool
+	valid      bool
+	savedKey   []byte
+	savedValue []byte
+	seqNum     uint64
+	prefix     []byte
+	err        error
+}
+
+func newStoreIterator(merged disk.Iterator, seqNum uint64, prefix []byte) *storeIterator {
+	return &storeIterator{merged: merged, forward: true, seqNum: seqNum, prefix: prefix}
+}
+
+func (it *storeIterator) Seek(key []byte) {
+	// keys before the prefix are outside of it, the first one inside is not
+	if bytes.Compare(key, it.prefix) < 0 {
+		key = it.prefix
+	}
+
+	it.forward = true
+	it.merged.Seek(key)
+	it.findNextUserEntry(nil, false)
+}
+
+func (it *storeIterator) SeekToFirst() {
+	if it.prefix != nil {
+		it.Seek(it.prefix)
+		return
+	}
+
+	it.forward = true
+	it.merged.SeekToFirst()
+	it.findNextUserEntry(nil, false)
+}
+
+func (it *storeIterator) SeekToLast() {
+	it.forward = false
+
+	// step back from the first key after the prefix
+	if successor := prefixSuccessor(it.prefix); successor != nil {
+		it.merged.Seek(successor)
+		if it.merged.Valid() {
+			it.merged.Prev()
+		} else {
+			it.merged.SeekToLast()
+		}
+	} else {
+		it.merged.SeekToLast()
+	}
+
+	it.findPrevUserEntry()
+}
+
+func (it *storeIterator) Next() {
+	if !it.valid {
+		return
+	}
+
+	if !it.forward {
+		// the merged iterator is before the exposed key, step back onto it
+		it.forward = true
+		if it.merged.Valid() {
+			it.merged.Next()
+		} else {
+			it.merged.SeekToFirst()
+		}
+
+		it.findNextUserEntry(it.savedKey, true)
+		return
+	}
+
+	skip := append([]byte(nil), it.merged.Record().Key...)
+	it.merged.Next()
+	it.findNextUserEntry(skip, true)
+}
+
+func (it *storeIterator) Prev() {
+	if !it.valid {
+		return
+	}
+
+	if it.forward {
+		// the newest version comes first, so one step back leaves the key
+		it.merged.Prev()
+		it.forward = false
+	}
+
+	it.findPrevUserEntry()
+}
+
+func (it *storeIterator) findNextUserEntry(skip []byte, skipping bool) {
+	for it.merged.Valid() {
+		record := it.merged.Record()
+
+		if skipping && bytes.Compare(record.Key, skip) <= 0 || record.SeqNum > it.seqNum {
+			it.merged.Next()
+			continue
+		}
+
+		if record.TombStone {
+			skip = record.Key
+			skipping = true
+			it.merged.Next()
+			continue
+		}
+
+		it.valid = true
+		return
+	}
+
+	it.valid = false
+}
+
+func (it *storeIterator) findPrevUserEntry() {
+	deleted := true
+
+	for it.merged.Valid() {
+		record := it.merged.Record()
+
+		// written after the view of the iterator
+		if record.SeqNum > it.seqNum {
+			it.merged.Prev()
+			continue
+		}
+
+		if !deleted && bytes.Compare(record.Key, it.savedKey) < 0 {
+			break
+		}
+
+		// walking backwards the versions of a key come oldest first
+		deleted = record.TombStone
+		if deleted {
+			it.savedKey = nil
+			it.savedValue = nil
+		} else {
+			it.savedKey = append(it.savedKey[:0], record.Key...)
+			it.savedValue = append(it.savedValue[:0], record.Value...)
+		}
+
+		it.merged.Prev()
+	}
+
+	if deleted {
+		it.valid = false
+		it.savedKey = nil
+		it.savedValue = nil
+		it.forward = true
+		return
+	}
+
+	it.valid = true
+}
+
+func (it *storeIterator) Valid() bool {
+	return it.valid && it.Err() == nil && bytes.HasPrefix(it.Key(), it.prefix)
+}
+
+func (it *storeIterator) Key() []byte {
+	if it.forward {
+		return it.merged.Record().Key
+	}
+
+	return it.savedKey
+}
+
+func (it *storeIterator) Value() []byte {
+	if it.forward {
+		return it.merged.Record().Value
+	}
+
+	return it.savedValue
+}
+
+func (it *storeIterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+
+	return it.merged.Err()
+}
+
+func (it *storeIterator) Close() error {
+	return it.merged.Close()
+}
@@ -0,0 +1,282 @@
+package engine
+
+import (
+	"LsmStorageEngine/mem"
+	"LsmStorageEngine/types"
+	"fmt"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const dataDir = "./data"
+
+func openTestEngine(t *testing.T, opts ...StorageEngineOption) *storageEngine {
+	os.RemoveAll(dataDir)
+
+	se, err := Open(dataDir, opts...)
+	if err != nil {
+		t.Fatalf("test failed due to engine open error : %s", err.Error())
+	}
+
+	return se.(*storageEngine)
+}
+
+// freezes the memtable the way a full one is and waits for the flusher to
+// turn it into a table
+func flushMemtable(t *testing.T, engine *storageEngine) {
+	engine.writeMu.Lock()
+	defer engine.writeMu.Unlock()
+
+	engine.memMu.Lock()
+	defer engine.memMu.Unlock()
+
+	segment, err := engine.wal.Rotate()
+	assert.NoError(t, err)
+
+	engine.immutables = append([]immutableMemtable{{memtable: engine.m, segment: segment}}, engine.immutables...)
+	engine.m = mem.NewMemtable(engine.memTableSize)
+	engine.memChanged.Broadcast()
+
+	for len(engine.immutables) != 0 && engine.backgroundErr == nil {
+		engine.memChanged.Wait()
+	}
+	assert.NoError(t, engine.backgroundErr)
+}
+
+func put(t *testing.T, engine *storageEngine, key, value string) {
+	assert.NoError(t, (<-engine.Put(types.NewRecord([]byte(key), []byte(value), false))).Err)
+}
+
+func del(t *testing.T, engine *storageEngine, key string) {
+	assert.NoError(t, (<-engine.Delete([]byte(key))).Err)
+}
+
+func keyValues(it Iterator, forward bool) []string {
+	var walked []string
+	for ; it.Valid(); func() {
+		if forward {
+			it.Next()
+		} else {
+			it.Prev()
+		}
+	}() {
+		walked = append(walked, string(it.Key())+"="+string(it.Value()))
+	}
+
+	return walked
+}
+
+// a store whose live keys are spread over two tables and the memtable, with
+// overwrites and deletes shadowing older versions in every one of them
+func writeLayeredStore(t *testing.T, engine *storageEngine) []string {
+	latest := map[string]string{}
+	write := func(key, value string) {
+		if value == "" {
+			del(t, engine, key)
+			delete(latest, key)
+			return
+		}
+
+		put(t, engine, key, value)
+		latest[key] = value
+	}
+
+	for i := 0; i < 20; i++ {
+		write(fmt.Sprintf("k%02d", i), "v1")
+	}
+	flushMemtable(t, engine)
+
+	for i := 0; i < 20; i += 3 {
+		write(fmt.Sprintf("k%02d", i), "v2")
+	}
+	write("k01", "")
+	write("k02", "")
+	flushMemtable(t, engine)
+
+	write("k02", "v3")
+	write("k03", "")
+	write("k04", "v3")
+	write("k04", "v4")
+	write("k19", "")
+	write("k20", "v3")
+	write("k21", "")
+
+	var expected []string
+	for key, value := range latest {
+		expected = append(expected, key+"="+value)
+	}
+	sort.Strings(expected)
+
+	return expected
+}
+
+func reversed(values []string) []string {
+	out := make([]string, len(values))
+	for i, value := range values {
+		out[len(values)-1-i] = value
+	}
+
+	return out
+}
+
+func TestIteratorWalksMemtableAndTables(t *testing.T) {
+	engine := openTestEngine(t)
+	defer os.RemoveAll(dataDir)
+	defer engine.Close()
+
+	expected := writeLayeredStore(t, engine)
+
+	it := engine.NewIterator(nil)
+	defer it.Close()
+
+	it.SeekToFirst()
+	assert.Equal(t, expected, keyValues(it, true))
+
+	it.SeekToLast()
+	assert.Equal(t, reversed(expected), keyValues(it, false))
+	assert.NoError(t, it.Err())
+
+	// a seek lands on the first live key at or after the target
+	it.Seek([]byte("k01"))
+	assert.True(t, it.Valid())
+	assert.Equal(t, "k02", string(it.Key()))
+	assert.Equal(t, "v3", string(it.Value()))
+
+	it.Seek([]byte("k21"))
+	assert.False(t, it.Valid())
+}
+
+func TestIteratorChangesDirection(t *testing.T) {
+	engine := openTestEngine(t)
+	defer os.RemoveAll(dataDir)
+	defer engine.Close()
+
+	expected := writeLayeredStore(t, engine)
+	position := func(key string) int {
+		return sort.Search(len(expected), func(i int) bool { return expected[i] >= key })
+	}
+
+	it := engine.NewIterator(nil)
+	defer it.Close()
+
+	// every step compared against the expected position
+	i := position("k05")
+	it.Seek([]byte("k05"))
+	for _, forward := range []bool{true, true, false, false, false, true, false, false, true, true, true} {
+		if forward {
+			it.Next()
+			i++
+		} else {
+			it.Prev()
+			i--
+		}
+
+		if !assert.True(t, it.Valid(), "step to %d", i) {
+			return
+		}
+		assert.Equal(t, expected[i], string(it.Key())+"="+string(it.Value()))
+	}
+
+	// turning around at both ends
+	it.SeekToFirst()
+	it.Prev()
+	assert.False(t, it.Valid())
+
+	it.SeekToLast()
+	it.Next()
+	assert.False(t, it.Valid())
+
+	it.SeekToLast()
+	it.Prev()
+	it.Next()
+	assert.Equal(t, expected[len(expected)-1], string(it.Key())+"="+string(it.Value()))
+}
+
+func TestIteratorReadsSnapshot(t *testing.T) {
+	engine := openTestEngine(t)
+	defer os.RemoveAll(dataDir)
+	defer engine.Close()
+
+	expected := writeLayeredStore(t, engine)
+	snapshot := engine.GetSnapshot()
+	defer engine.ReleaseSnapshot(snapshot)
+
+	put(t, engine, "k00", "after")
+	del(t, engine, "k05")
+	put(t, engine, "k99", "after")
+	flushMemtable(t, engine)
+
+	it := engine.NewIterator(&ReadOptions{Snapshot: snapshot})
+	defer it.Close()
+
+	it.SeekToFirst()
+	assert.Equal(t, expected, keyValues(it, true))
+
+	it.SeekToLast()
+	assert.Equal(t, reversed(expected), keyValues(it, false))
+}
+
+func TestIteratorStaysWithinPrefix(t *testing.T) {
+	engine := openTestEngine(t)
+	defer os.RemoveAll(dataDir)
+	defer engine.Close()
+
+	for _, key := range []string{"a/1", "b/1", "b/2", "b/3", "c/1"} {
+		put(t, engine, key, "v")
+	}
+	flushMemtable(t, engine)
+	del(t, engine, "b/3")
+	put(t, engine, "b/0", "v")
+
+	it := engine.NewIterator(&ReadOptions{Prefix: []byte("b/")})
+	defer it.Close()
+
+	it.SeekToFirst()
+	assert.Equal(t, []string{"b/0=v", "b/1=v", "b/2=v"}, keyValues(it, true))
+
+	it.SeekToLast()
+	assert.Equal(t, []string{"b/2=v", "b/1=v", "b/0=v"}, keyValues(it, false))
+
+	it.Seek([]byte("a"))
+	assert.True(t, it.Valid())
+	assert.Equal(t, "b/0", string(it.Key()))
+
+	it.Seek([]byte("b/3"))
+	assert.False(t, it.Valid())
+}
+
+func TestScanLimits(t *testing.T) {
+	engine := openTestEngine(t)
+	defer os.RemoveAll(dataDir)
+	defer engine.Close()
+
+	for _, key := range []string{"a/1", "b/1", "b/2", "b/3", "b/4", "c/1"} {
+		put(t, engine, key, "v")
+	}
+	flushMemtable(t, engine)
+	del(t, engine, "b/2")
+
+	keys := func(result ScanResult) []string {
+		assert.NoError(t, result.Err)
+
+		var scanned []string
+		for _, record := range result.Records {
+			scanned = append(scanned, string(record.Key))
+		}
+
+		return scanned
+	}
+
+	// deleted keys do not count against the limit
+	assert.Equal(t, []string{"b/1", "b/3"}, keys(<-engine.Scan([]byte("b"), []byte("c"), 2)))
+	assert.Equal(t, []string{"b/1", "b/3", "b/4"}, keys(<-engine.Scan([]byte("b"), []byte("c"), 0)))
+	assert.Equal(t, []string{"b/3", "b/4", "c/1"}, keys(<-engine.Scan([]byte("b/3"), nil, 0)))
+	assert.Empty(t, keys(<-engine.Scan([]byte("b/2"), []byte("b/3"), 0)))
+
+	assert.Equal(t, []string{"b/1"}, keys(<-engine.ScanPrefix([]byte("b/"), 1)))
+	assert.Equal(t, []string{"b/1", "b/3", "b/4"}, keys(<-engine.ScanPrefix([]byte("b/"), 10)))
+	assert.Empty(t, keys(<-engine.ScanPrefix([]byte("d/"), 0)))
+}
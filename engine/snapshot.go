@@ -0,0 +1,75 @@
+package engine
+
+import "math"
+
+// Snapshot is a frozen point-in-time view of the store, the versions it sees
+// survive flushes and compactions until it is released
+type Snapshot struct {
+	seqNum uint64
+}
+
+// ReadOptions tune a single read, a nil *ReadOptions reads the newest data
+type ReadOptions struct {
+	// read the store as it was when the snapshot was taken
+	Snapshot *Snapshot
+	// check every table block read against its checksum, corrupted blocks
+	// fail the read with types.TABLE_CORRUPTION_ERROR
+	VerifyChecksums bool
+	// bounds an iterator to the keys starting with Prefix, skipping the
+	// tables whose filter rules it out when the engine has a prefix extractor
+	Prefix []byte
+}
+
+// sequence number up to which a read sees writes
+func (ro *ReadOptions) readSeqNum() uint64 {
+	if ro == nil || ro.Snapshot == nil {
+		return math.MaxUint64
+	}
+
+	return ro.Snapshot.seqNum
+}
+
+func (ro *ReadOptions) verifyChecksums() bool {
+	return ro != nil && ro.VerifyChecksums
+}
+
+func (ro *ReadOptions) prefix() []byte {
+	if ro == nil {
+		return nil
+	}
+
+	return ro.Prefix
+}
+
+func (engine *storageEngine) GetSnapshot() *Snapshot {
+	engine.writeMu.Lock()
+	defer engine.writeMu.Unlock()
+
+	snapshot := &Snapshot{seqNum: engine.lastSeqNum}
+
+	engine.snapshotsMu.Lock()
+	engine.snapshots[snapshot] = struct{}{}
+	engine.snapshotsMu.Unlock()
+
+	return snapshot
+}
+
+func (engine *storageEngine) ReleaseSnapshot(snapshot *Snapshot) {
+	engine.snapshotsMu.Lock()
+	defer engine.snapshotsMu.Unlock()
+
+	delete(engine.snapshots, snapshot)
+}
+
+// sequence numbers of the snapshots still held, handed to the disk manager
+func (engine *storageEngine) liveSnapshots() []uint64 {
+	engine.snapshotsMu.Lock()
+	defer engine.snapshotsMu.Unlock()
+
+	seqNums := make([]uint64, 0, len(engine.snapshots))
+	for snapshot := range engine.snapshots {
+		seqNums = append(seqNums, snapshot.seqNum)
+	}
+
+	return seqNums
+}
@@ -4,30 +4,79 @@ import (
 	"LsmStorageEngine/disk"
 	"LsmStorageEngine/mem"
 	"LsmStorageEngine/types"
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"time"
 )
 
 const (
 	memTableSize             = 8_000
-	bloomFilterErrorRate     = 0.01
-	bloomFilterElementsCount = 10_000
+	bloomFilterBitsPerKey    = disk.DefaultBloomBitsPerKey
 	l0Target                 = 4
 	levelRatio               = 10
 	dir                      = "./data"
+	walSyncPolicy            = disk.SyncEveryWrite
+	walSyncInterval          = 100 * time.Millisecond
+	maxBackgroundCompactions = 1
+	maxImmutableMemtables    = 2
+	compression              = disk.NoCompression
+	blockCacheSize           = 8 << 20
+	maxOpenFiles             = 1000
+	rangeFilter              = true
+	targetFileSize           = 2 << 20
+	levelBaseBytes           = disk.DefaultLevelBaseBytes
 )
 
 type StorageEngine interface {
-	Get(key []byte) <-chan Result
+	// a nil ro reads the newest data
+	Get(key []byte, ro *ReadOptions) <-chan Result
 	Put(record types.Record) <-chan Result
 	Delete(key []byte) <-chan Result
+	// applies every operation of the batch or none of them
+	Write(batch *WriteBatch) <-chan Result
+	// live records with start <= key < end in key order, a nil end scans to
+	// the last key and a limit <= 0 returns every match
+	Scan(start, end []byte, limit int) <-chan ScanResult
+	ScanPrefix(prefix []byte, limit int) <-chan ScanResult
+	NewIterator(ro *ReadOptions) Iterator
+	// pins the current state of the store for reads through ReadOptions,
+	// every snapshot has to be released to let compaction drop its versions
+	GetSnapshot() *Snapshot
+	ReleaseSnapshot(snapshot *Snapshot)
+	Stats() Stats
+	Close() error
+}
+
+// counters of the caches of the engine
+type Stats struct {
+	BlockCache disk.BlockCacheStats
+	TableCache disk.TableCacheStats
 }
 
 type storageEngineOpts struct {
 	memTableSize             int
-	bloomFilterErrorRate     float64
-	bloomFilterElementsCount float64
+	bloomFilterBitsPerKey    int
+	filterPolicy             disk.FilterPolicy
+	prefixExtractor          disk.PrefixExtractor
+	rangeFilter              bool
+	targetFileSize           int
+	compactionStrategy       disk.CompactionStrategy
 	levelRatio               int
 	l0Target                 int
+	levelBaseBytes           int64
+	dynamicLevelBytes        bool
 	dir                      string
+	walSyncPolicy            disk.SyncPolicy
+	walSyncInterval          time.Duration
+	maxBackgroundCompactions int
+	maxImmutableMemtables    int
+	compression              disk.CompressionType
+	blockCacheSize           int
+	cacheIndexAndFilter      bool
+	maxOpenFiles             int
 }
 
 type Result struct {
@@ -35,18 +84,31 @@ type Result struct {
 	Err    error
 }
 
+type ScanResult struct {
+	Records []types.Record
+	Err     error
+}
+
 type StorageEngineOption func(*storageEngineOpts)
 
 func WithMemTableSize(memTableSize int) StorageEngineOption {
 	return func(seo *storageEngineOpts) { seo.memTableSize = memTableSize }
 }
 
+// sizes the filters of new tables for about errorRate false positives, the
+// same as WithBloomFilterBitsPerKey with the bits per key it takes
 func WithBloomFilterErrorRate(errorRate float64) StorageEngineOption {
-	return func(seo *storageEngineOpts) { seo.bloomFilterErrorRate = errorRate }
+	return func(seo *storageEngineOpts) { seo.bloomFilterBitsPerKey = disk.BitsPerKeyForErrorRate(errorRate) }
 }
 
+// Deprecated: the filter of every table is sized for the keys it holds.
 func WithBloomFilterElementsCount(elementCount float64) StorageEngineOption {
-	return func(seo *storageEngineOpts) { seo.bloomFilterElementsCount = elementCount }
+	return func(seo *storageEngineOpts) {}
+}
+
+// bits of filter per key of a table, more bits give fewer false positives
+func WithBloomFilterBitsPerKey(bitsPerKey int) StorageEngineOption {
+	return func(seo *storageEngineOpts) { seo.bloomFilterBitsPerKey = max(bitsPerKey, 1) }
 }
 
 func WithLevelRatio(ratio int) StorageEngineOption {
@@ -57,81 +119,482 @@ func WithL0Target(target int) StorageEngineOption {
 	return func(seo *storageEngineOpts) { seo.l0Target = target }
 }
 
+// bytes level 1 holds before it is compacted into level 2, every level
+// below holds WithLevelRatio times more
+func WithLevelBaseBytes(bytes int64) StorageEngineOption {
+	return func(seo *storageEngineOpts) { seo.levelBaseBytes = bytes }
+}
+
+// sizes the levels above the last one from the bytes it holds, so it keeps
+// most of the data however small the store is. level 0 is compacted into the
+// first level sized WithLevelBaseBytes or more and the levels above it stay
+// empty
+func WithDynamicLevelBytes(enabled bool) StorageEngineOption {
+	return func(seo *storageEngineOpts) { seo.dynamicLevelBytes = enabled }
+}
+
 func WithDataDirLocation(dirLocaiton string) StorageEngineOption {
 	return func(seo *storageEngineOpts) { seo.dir = dirLocaiton }
 }
 
+func WithWALSyncPolicy(policy disk.SyncPolicy) StorageEngineOption {
+	return func(seo *storageEngineOpts) { seo.walSyncPolicy = policy }
+}
+
+// only used with the disk.SyncInterval policy
+func WithWALSyncInterval(interval time.Duration) StorageEngineOption {
+	return func(seo *storageEngineOpts) { seo.walSyncInterval = interval }
+}
+
+// number of compactions that may run in the background at once
+func WithMaxBackgroundCompactions(n int) StorageEngineOption {
+	return func(seo *storageEngineOpts) { seo.maxBackgroundCompactions = n }
+}
+
+// number of full memtables that may wait for the flusher before writes stall
+func WithMaxImmutableMemtables(n int) StorageEngineOption {
+	return func(seo *storageEngineOpts) { seo.maxImmutableMemtables = max(n, 1) }
+}
+
+// codec of the data blocks of new tables, compactions rewrite the tables
+// written with another codec
+func WithCompression(codec disk.CompressionType) StorageEngineOption {
+	return func(seo *storageEngineOpts) { seo.compression = codec }
+}
+
+// bytes of uncompressed data blocks kept in memory for reads, 0 turns the
+// block cache off
+func WithBlockCacheSize(size int) StorageEngineOption {
+	return func(seo *storageEngineOpts) { seo.blockCacheSize = size }
+}
+
+// keep the index and filter of the tables in the block cache too instead of
+// always in memory, bounding their memory by the cache size
+func WithCacheIndexAndFilterBlocks(cache bool) StorageEngineOption {
+	return func(seo *storageEngineOpts) { seo.cacheIndexAndFilter = cache }
+}
+
+// number of table files kept open between reads, the least recently read
+// are closed past it
+func WithMaxOpenFiles(n int) StorageEngineOption {
+	return func(seo *storageEngineOpts) { seo.maxOpenFiles = max(n, 1) }
+}
+
+// builds the filters of new tables, e.g. disk.NewBlockedBloomFilterPolicy,
+// in place of a bloom filter of the configured bits per key. Tables are
+// always read back with the policy they were written with, Open registers
+// policy for that
+func WithFilterPolicy(policy disk.FilterPolicy) StorageEngineOption {
+	return func(seo *storageEngineOpts) { seo.filterPolicy = policy }
+}
+
+// adds the prefixes extractor takes from the keys to the filters of new
+// tables, letting prefix scans and iterators skip the tables whose filter
+// rules their prefix out
+func WithPrefixExtractor(extractor disk.PrefixExtractor) StorageEngineOption {
+	return func(seo *storageEngineOpts) { seo.prefixExtractor = extractor }
+}
+
+// writes a range filter into new tables, letting scans skip the tables
+// holding no key of their range even when the range falls between the
+// smallest and the largest key of the table
+func WithRangeFilter(enabled bool) StorageEngineOption {
+	return func(seo *storageEngineOpts) { seo.rangeFilter = enabled }
+}
+
+// size of the keys and values compactions write to a table before starting
+// the next one, the tables of every level below 0 hold disjoint key ranges
+func WithTargetFileSize(size int) StorageEngineOption {
+	return func(seo *storageEngineOpts) { seo.targetFileSize = size }
+}
+
+// picks the tables compactions merge, e.g.
+// disk.NewSizeTieredCompactionStrategy for write heavy workloads. nil keeps
+// leveled compaction driven by WithL0Target, WithLevelRatio,
+// WithLevelBaseBytes and WithDynamicLevelBytes
+func WithCompactionStrategy(strategy disk.CompactionStrategy) StorageEngineOption {
+	return func(seo *storageEngineOpts) { seo.compactionStrategy = strategy }
+}
+
 func defaultOptions() StorageEngineOption {
 	return func(seo *storageEngineOpts) {
-		seo.bloomFilterElementsCount = bloomFilterElementsCount
-		seo.bloomFilterErrorRate = bloomFilterErrorRate
+		seo.bloomFilterBitsPerKey = bloomFilterBitsPerKey
 		seo.memTableSize = memTableSize
 		seo.levelRatio = levelRatio
 		seo.l0Target = l0Target
 		seo.dir = dir
+		seo.walSyncPolicy = walSyncPolicy
+		seo.walSyncInterval = walSyncInterval
+		seo.maxBackgroundCompactions = maxBackgroundCompactions
+		seo.maxImmutableMemtables = maxImmutableMemtables
+		seo.compression = compression
+		seo.blockCacheSize = blockCacheSize
+		seo.maxOpenFiles = maxOpenFiles
+		seo.rangeFilter = rangeFilter
+		seo.targetFileSize = targetFileSize
+		seo.levelBaseBytes = levelBaseBytes
 	}
 }
 
 type storageEngine struct {
 	storageEngineOpts
-	m  *mem.Memtable
-	dm *disk.DiskManager
+	// serializes writers so the wal and the memtable see the same order
+	writeMu sync.Mutex
+	// sequence number of the newest write, guarded by writeMu
+	lastSeqNum  uint64
+	snapshotsMu sync.Mutex
+	snapshots   map[*Snapshot]struct{}
+	// guards the memtables, memChanged is signalled whenever one is frozen
+	// or flushed
+	memMu      sync.RWMutex
+	memChanged *sync.Cond
+	m          *mem.Memtable
+	// frozen memtables waiting for the flusher, newest first
+	immutables []immutableMemtable
+	// first error of the flusher, fails every later write
+	backgroundErr error
+	closing       bool
+	flusherDone   chan struct{}
+	dm            *disk.DiskManager
+	wal           *disk.WriteAheadLog
 }
 
-func CreateNewEngine(opts ...StorageEngineOption) StorageEngine {
+// opens the engine on its configured data directory
+func CreateNewEngine(opts ...StorageEngineOption) (StorageEngine, error) {
 	var o storageEngineOpts
 
-	if len(opts) == 0 {
-		defaultOptions()(&o)
-	} else {
-		for _, option := range opts {
-			option(&o)
-		}
+	defaultOptions()(&o)
+	for _, option := range opts {
+		option(&o)
+	}
+
+	return Open(o.dir, opts...)
+}
+
+// opens the engine on dir, recovering the tables and the wal left there by a
+// previous run. a directory whose tables do not form a valid tree is refused.
+func Open(dir string, opts ...StorageEngineOption) (StorageEngine, error) {
+	var o storageEngineOpts
+
+	defaultOptions()(&o)
+	for _, option := range opts {
+		option(&o)
 	}
+	o.dir = dir
 
 	engine := &storageEngine{
 		storageEngineOpts: o,
+		snapshots:         make(map[*Snapshot]struct{}),
+		flusherDone:       make(chan struct{}),
 	}
+	engine.memChanged = sync.NewCond(&engine.memMu)
 
-	engine.m = mem.NewMemtable(engine.memTableSize)
-	engine.dm = disk.CreateDiskManager(
+	if err := os.MkdirAll(engine.dir, 0755); err != nil {
+		return nil, fmt.Errorf("data directory creation error : %s", err.Error())
+	}
+
+	// tables written with the policy are read back by its name, the ones
+	// already in the directory included
+	if engine.filterPolicy != nil {
+		disk.RegisterFilterPolicy(engine.filterPolicy)
+	}
+
+	dm, err := disk.OpenDiskManager(
 		engine.levelRatio,
 		engine.l0Target,
 		engine.dir,
 	)
 
-	return engine
+	if err != nil {
+		return nil, err
+	}
+
+	wal, err := disk.OpenWriteAheadLog(engine.dir, engine.walSyncPolicy, engine.walSyncInterval)
+
+	if err != nil {
+		dm.Close()
+		return nil, err
+	}
+
+	dm.SetSnapshotSource(engine.liveSnapshots)
+	dm.SetMaxBackgroundCompactions(engine.maxBackgroundCompactions)
+	dm.SetTargetFileSize(engine.targetFileSize)
+	compactionStrategy := engine.compactionStrategy
+	if compactionStrategy == nil {
+		leveled := disk.NewLeveledCompactionStrategy(engine.levelRatio, engine.l0Target)
+		leveled.SetLevelBaseBytes(engine.levelBaseBytes)
+		leveled.SetDynamicLevelBytes(engine.dynamicLevelBytes)
+		compactionStrategy = leveled
+	}
+	dm.SetCompactionStrategy(compactionStrategy)
+	filterPolicy := engine.filterPolicy
+	if filterPolicy == nil {
+		filterPolicy = disk.NewBloomFilterPolicy(engine.bloomFilterBitsPerKey)
+	}
+	dm.SetTableOptions(disk.TableOptions{
+		Compression:     engine.compression,
+		FilterPolicy:    filterPolicy,
+		PrefixExtractor: engine.prefixExtractor,
+		RangeFilter:     engine.rangeFilter,
+	})
+	if engine.blockCacheSize > 0 {
+		dm.SetBlockCache(disk.NewBlockCache(engine.blockCacheSize), engine.cacheIndexAndFilter)
+	}
+	dm.SetTableCache(disk.NewTableCache(engine.maxOpenFiles))
+
+	engine.dm = dm
+	engine.wal = wal
+	engine.m = mem.NewMemtable(engine.memTableSize)
+
+	go engine.flushImmutables()
+
+	if err := engine.recover(); err != nil {
+		engine.stopFlusher()
+		wal.Close()
+		dm.Close()
+		return nil, err
+	}
+
+	return engine, nil
 }
 
-func (engine *storageEngine) Get(key []byte) <-chan Result {
+// replays the wal into the memtable before any request is served, segments
+// the manifest says were flushed already are dropped instead
+func (engine *storageEngine) recover() error {
+	if err := engine.wal.DeleteSegmentsUpTo(engine.dm.LogNumber() - 1); err != nil {
+		return err
+	}
+
+	engine.lastSeqNum = engine.dm.LastSequence()
+
+	err := engine.wal.Replay(func(payload []byte) error {
+		batch, err := DecodeWriteBatch(payload)
+
+		if err != nil {
+			return err
+		}
+
+		engine.m.Put(batch.records()...)
+
+		if last := batch.seqNum + uint64(batch.Count()) - 1; batch.Count() != 0 && last > engine.lastSeqNum {
+			engine.lastSeqNum = last
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return engine.makeRoomForWrite()
+}
+
+// logs the batch as a single wal record and then applies it to the memtable
+// under one lock, so neither a crash nor a reader sees half of it
+func (engine *storageEngine) write(batch *WriteBatch) error {
+	engine.writeMu.Lock()
+	defer engine.writeMu.Unlock()
+
+	batch, err := batch.expandRangeDeletes(func(start, end []byte, limit int) ([]types.Record, error) {
+		return engine.scan(start, end, nil, limit)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if batch.Count() == 0 {
+		return nil
+	}
+
+	if err := engine.makeRoomForWrite(); err != nil {
+		return err
+	}
+
+	batch.seqNum = engine.lastSeqNum + 1
+
+	if err := engine.wal.Append(batch.Encode()); err != nil {
+		return err
+	}
+
+	engine.lastSeqNum += uint64(batch.Count())
+	engine.m.Put(batch.records()...)
+
+	return nil
+}
+
+func (engine *storageEngine) Get(key []byte, ro *ReadOptions) <-chan Result {
 	c := make(chan Result, 1)
 
 	go func() {
-		record, err := engine.m.Get(key, engine.dm)
+		record, err := engine.get(key, ro.readSeqNum(), ro.verifyChecksums())
+
+		if isNotFound(err) || err == nil && record.TombStone {
+			c <- Result{}
+			return
+		}
+
 		c <- Result{Record: record, Err: err}
 	}()
 
 	return c
 }
 
+// looks in the memtables newest first before going to disk, a memtable is
+// only emptied once its table is in place so nothing falls in between
+func (engine *storageEngine) get(key []byte, seqNum uint64, verifyChecksums bool) (types.Record, error) {
+	for _, memtable := range engine.memtables() {
+		if record, found := memtable.Get(key, seqNum); found {
+			return record, nil
+		}
+	}
+
+	return engine.dm.GetAt(key, seqNum, verifyChecksums)
+}
+
+func isNotFound(err error) bool {
+	engineError, ok := err.(*types.EngineError)
+
+	return ok && engineError.GetErrorCode() == types.DISKMANAGER_KEY_NOT_FOUND_ERROR
+}
+
 func (engine *storageEngine) Put(record types.Record) <-chan Result {
+	batch := NewWriteBatch()
+	if record.TombStone {
+		batch.Delete(record.Key)
+	} else {
+		batch.Put(record.Key, record.Value)
+	}
+
+	return engine.Write(batch)
+}
+
+func (engine *storageEngine) Delete(key []byte) <-chan Result {
+	batch := NewWriteBatch()
+	batch.Delete(key)
+
+	return engine.Write(batch)
+}
+
+func (engine *storageEngine) Write(batch *WriteBatch) <-chan Result {
 	c := make(chan Result, 1)
 
 	go func() {
-		err := engine.m.Put(record, engine.dm)
+		err := engine.write(batch)
 		c <- Result{Err: err}
 	}()
 
 	return c
 }
 
-func (engine *storageEngine) Delete(key []byte) <-chan Result {
-	c := make(chan Result, 1)
+func (engine *storageEngine) NewIterator(ro *ReadOptions) Iterator {
+	if prefix := ro.prefix(); prefix != nil {
+		return engine.newIterator(prefix, prefixSuccessor(prefix), prefix, ro.readSeqNum(), ro.verifyChecksums())
+	}
+
+	return engine.newIterator(nil, nil, nil, ro.readSeqNum(), ro.verifyChecksums())
+}
+
+// iterator over the memtable and the tables that may hold keys in
+// [start, end) seeing writes up to seqNum, the bounds only decide which
+// tables are read. A prefix bounds the iterator to the keys starting with it
+func (engine *storageEngine) newIterator(start, end, prefix []byte, seqNum uint64, verifyChecksums bool) Iterator {
+	// the memtables are captured before the tables, a flush in between shows
+	// the same records twice instead of losing them
+	var children []disk.Iterator
+	for _, memtable := range engine.memtables() {
+		children = append(children, disk.NewSliceIterator(memtable.GetAll()))
+	}
+
+	tableIterators, err := engine.dm.NewTableIterators(start, end, prefix, verifyChecksums)
+
+	if err != nil {
+		it := newStoreIterator(disk.NewMergingIterator(nil), seqNum, prefix)
+		it.err = err
+		return it
+	}
+
+	return newStoreIterator(disk.NewMergingIterator(append(children, tableIterators...)), seqNum, prefix)
+}
+
+func (engine *storageEngine) Scan(start, end []byte, limit int) <-chan ScanResult {
+	c := make(chan ScanResult, 1)
 
 	go func() {
-		err := engine.m.Delete(key, engine.dm)
-		c <- Result{Err: err}
+		records, err := engine.scan(start, end, nil, limit)
+		c <- ScanResult{Records: records, Err: err}
 	}()
 
 	return c
 }
+
+func (engine *storageEngine) ScanPrefix(prefix []byte, limit int) <-chan ScanResult {
+	c := make(chan ScanResult, 1)
+
+	go func() {
+		records, err := engine.scan(prefix, prefixSuccessor(prefix), prefix, limit)
+		c <- ScanResult{Records: records, Err: err}
+	}()
+
+	return c
+}
+
+func (engine *storageEngine) scan(start, end, prefix []byte, limit int) ([]types.Record, error) {
+	it := engine.newIterator(start, end, prefix, math.MaxUint64, false)
+	defer it.Close()
+
+	var records []types.Record
+	for it.Seek(start); it.Valid(); it.Next() {
+		if end != nil && bytes.Compare(it.Key(), end) >= 0 {
+			break
+		}
+
+		if limit > 0 && len(records) == limit {
+			break
+		}
+
+		records = append(records, types.NewRecord(
+			append([]byte(nil), it.Key()...),
+			append([]byte(nil), it.Value()...),
+			false,
+		))
+	}
+
+	return records, it.Err()
+}
+
+// the smallest key greater than every key starting with prefix, nil when no
+// such key exists
+func prefixSuccessor(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			successor := append([]byte(nil), prefix[:i+1]...)
+			successor[i]++
+			return successor
+		}
+	}
+
+	return nil
+}
+
+func (engine *storageEngine) Stats() Stats {
+	return Stats{
+		BlockCache: engine.dm.BlockCacheStats(),
+		TableCache: engine.dm.TableCacheStats(),
+	}
+}
+
+func (engine *storageEngine) Close() error {
+	engine.writeMu.Lock()
+	defer engine.writeMu.Unlock()
+
+	engine.stopFlusher()
+
+	if err := engine.wal.Close(); err != nil {
+		engine.dm.Close()
+		return err
+	}
+
+	return engine.dm.Close()
+}
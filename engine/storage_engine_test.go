@@ -0,0 +1,44 @@
+package engine
+
+import (
+	"LsmStorageEngine/disk"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// a policy under a name of its own, counting the filters it reads back
+type countingFilterPolicy struct {
+	disk.FilterPolicy
+	decoded atomic.Int32
+}
+
+func (*countingFilterPolicy) Name() string { return "engine-test-counting" }
+
+func (policy *countingFilterPolicy) DecodeFilter(filter []byte) (disk.Filter, error) {
+	policy.decoded.Add(1)
+	return policy.FilterPolicy.DecodeFilter(filter)
+}
+
+func TestCustomFilterPolicyReadsBack(t *testing.T) {
+	policy := &countingFilterPolicy{FilterPolicy: disk.NewBlockedBloomFilterPolicy(10)}
+	engine := openTestEngine(t, WithFilterPolicy(policy), WithL0Target(2), WithMaxOpenFiles(1))
+	defer os.RemoveAll(dataDir)
+	defer engine.Close()
+
+	for batch := 0; batch < 4; batch++ {
+		for i := 0; i < 20; i++ {
+			put(t, engine, fmt.Sprintf("k%02d", i), fmt.Sprintf("v%d", batch))
+		}
+		flushMemtable(t, engine)
+	}
+	assert.NoError(t, engine.dm.WaitForCompactions())
+
+	for i := 0; i < 20; i++ {
+		assertValue(t, engine, fmt.Sprintf("k%02d", i), "v3")
+	}
+	assert.NotZero(t, policy.decoded.Load())
+}
@@ -0,0 +1,227 @@
+package engine
+
+import (
+	"LsmStorageEngine/types"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+type batchOperationType byte
+
+const (
+	batchPut         batchOperationType = 1
+	batchDelete      batchOperationType = 2
+	batchDeleteRange batchOperationType = 3
+)
+
+type batchOperation struct {
+	operation batchOperationType
+	key       []byte
+	// the value of a put or the exclusive end of a range delete
+	value []byte
+}
+
+/*
+WriteBatch collects puts and deletes that StorageEngine.Write applies as one
+atomic unit, later operations in the batch win over earlier ones.
+
+serialized as | sequence number (8) | count (uvarint) | operation... | with
+every operation being
+| type (1) | key length (uvarint) | key | value length (uvarint) | value |
+*/
+type WriteBatch struct {
+	operations []batchOperation
+	// sequence number of the first operation, the engine assigns it on write
+	seqNum uint64
+}
+
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+func (wb *WriteBatch) Put(key, value []byte) {
+	wb.operations = append(wb.operations, batchOperation{operation: batchPut, key: key, value: value})
+}
+
+func (wb *WriteBatch) Delete(key []byte) {
+	wb.operations = append(wb.operations, batchOperation{operation: batchDelete, key: key})
+}
+
+/*
+MaxRangeDeleteKeys caps the keys a batch deletes through its range deletes.
+A range delete is written as one tombstone per live key it covers, found by
+a scan that runs while every other writer waits, so a batch that would
+cover more keys is refused as a whole and the range has to be deleted in
+smaller pieces.
+*/
+const MaxRangeDeleteKeys = 10_000
+
+/*
+deletes every key in [start, end), a nil end deletes up to the last key.
+This is no range tombstone: when the batch is written the range is scanned
+and every live key in it gets a tombstone of its own, keys written into the
+range afterwards are not deleted. A batch whose range deletes cover more than
+MaxRangeDeleteKeys keys fails with WRITE_BATCH_TOO_LARGE_ERROR and none of
+its operations are applied.
+*/
+func (wb *WriteBatch) DeleteRange(start, end []byte) {
+	wb.operations = append(wb.operations, batchOperation{operation: batchDeleteRange, key: start, value: end})
+}
+
+func (wb *WriteBatch) Clear() {
+	wb.operations = nil
+}
+
+func (wb *WriteBatch) Count() int {
+	return len(wb.operations)
+}
+
+func (wb *WriteBatch) Encode() []byte {
+	buffer := binary.LittleEndian.AppendUint64(nil, wb.seqNum)
+	buffer = binary.AppendUvarint(buffer, uint64(len(wb.operations)))
+
+	for _, operation := range wb.operations {
+		buffer = append(buffer, byte(operation.operation))
+		buffer = binary.AppendUvarint(buffer, uint64(len(operation.key)))
+		buffer = append(buffer, operation.key...)
+		buffer = binary.AppendUvarint(buffer, uint64(len(operation.value)))
+		buffer = append(buffer, operation.value...)
+	}
+
+	return buffer
+}
+
+func DecodeWriteBatch(buffer []byte) (*WriteBatch, error) {
+	invalid := func(reason string) error {
+		return types.NewEngineError(
+			types.WRITE_BATCH_DECODE_ERROR,
+			fmt.Sprintf("malformed write batch : %s", reason),
+		)
+	}
+
+	readBytes := func() ([]byte, bool) {
+		length, n := binary.Uvarint(buffer)
+		if n <= 0 || uint64(len(buffer)-n) < length {
+			return nil, false
+		}
+
+		field := buffer[n : n+int(length)]
+		buffer = buffer[n+int(length):]
+
+		return field, true
+	}
+
+	if len(buffer) < 8 {
+		return nil, invalid("missing sequence number")
+	}
+	seqNum := binary.LittleEndian.Uint64(buffer)
+	buffer = buffer[8:]
+
+	count, n := binary.Uvarint(buffer)
+	if n <= 0 {
+		return nil, invalid("missing operation count")
+	}
+	buffer = buffer[n:]
+
+	batch := NewWriteBatch()
+	batch.seqNum = seqNum
+	for range count {
+		if len(buffer) == 0 {
+			return nil, invalid("fewer operations than its count")
+		}
+
+		operation := batchOperationType(buffer[0])
+		buffer = buffer[1:]
+
+		if operation != batchPut && operation != batchDelete && operation != batchDeleteRange {
+			return nil, invalid(fmt.Sprintf("unknown operation %d", operation))
+		}
+
+		key, ok := readBytes()
+		if !ok {
+			return nil, invalid("truncated key")
+		}
+
+		value, ok := readBytes()
+		if !ok {
+			return nil, invalid("truncated value")
+		}
+
+		// an empty end is encoded the same as a missing one
+		if operation == batchDeleteRange && len(value) == 0 {
+			value = nil
+		}
+
+		batch.operations = append(batch.operations, batchOperation{operation: operation, key: key, value: value})
+	}
+
+	if len(buffer) != 0 {
+		return nil, invalid("trailing bytes")
+	}
+
+	return batch, nil
+}
+
+// replaces every range delete with a tombstone per key it covers, reading the
+// keys of the store through scan and the puts that precede it in the batch,
+// scan returns at most limit records
+func (wb *WriteBatch) expandRangeDeletes(scan func(start, end []byte, limit int) ([]types.Record, error)) (*WriteBatch, error) {
+	expanded := NewWriteBatch()
+	covered := 0
+
+	for i, operation := range wb.operations {
+		if operation.operation != batchDeleteRange {
+			expanded.operations = append(expanded.operations, operation)
+			continue
+		}
+
+		start, end := operation.key, operation.value
+
+		// one record past the cap is enough to know the batch is over it
+		records, err := scan(start, end, MaxRangeDeleteKeys-covered+1)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, record := range records {
+			expanded.Delete(record.Key)
+		}
+
+		for _, earlier := range wb.operations[:i] {
+			if earlier.operation == batchPut && bytes.Compare(earlier.key, start) >= 0 &&
+				(end == nil || bytes.Compare(earlier.key, end) < 0) {
+				expanded.Delete(earlier.key)
+				covered++
+			}
+		}
+
+		if covered += len(records); covered > MaxRangeDeleteKeys {
+			return nil, types.NewEngineError(
+				types.WRITE_BATCH_TOO_LARGE_ERROR,
+				fmt.Sprintf("range deletes of the batch cover more than %d keys", MaxRangeDeleteKeys),
+			)
+		}
+	}
+
+	return expanded, nil
+}
+
+// the records a batch without range deletes applies, in batch order and
+// numbered from the sequence number of the batch
+func (wb *WriteBatch) records() []types.Record {
+	records := make([]types.Record, 0, len(wb.operations))
+
+	for i, operation := range wb.operations {
+		seqNum := wb.seqNum + uint64(i)
+
+		switch operation.operation {
+		case batchPut:
+			records = append(records, types.NewRecordWithSeqNum(operation.key, operation.value, false, seqNum))
+		case batchDelete:
+			records = append(records, types.NewRecordWithSeqNum(operation.key, nil, true, seqNum))
+		}
+	}
+
+	return records
+}
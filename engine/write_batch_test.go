@@ -0,0 +1,268 @@
+package engine
+
+import (
+	"LsmStorageEngine/types"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func operationStrings(batch *WriteBatch) []string {
+	var operations []string
+	for _, operation := range batch.operations {
+		switch {
+		case operation.operation == batchDelete:
+			operations = append(operations, fmt.Sprintf("delete %s", operation.key))
+		case operation.operation == batchDeleteRange && operation.value == nil:
+			operations = append(operations, fmt.Sprintf("delete range %s -", operation.key))
+		case operation.operation == batchDeleteRange:
+			operations = append(operations, fmt.Sprintf("delete range %s %s", operation.key, operation.value))
+		default:
+			operations = append(operations, fmt.Sprintf("put %s %s", operation.key, operation.value))
+		}
+	}
+
+	return operations
+}
+
+func TestWriteBatchEncodeDecode(t *testing.T) {
+	batch := NewWriteBatch()
+	batch.Put([]byte("a"), []byte("1"))
+	batch.Delete([]byte("b"))
+	batch.DeleteRange([]byte("c"), []byte("d"))
+	batch.Put([]byte("e"), []byte("2"))
+	batch.DeleteRange([]byte("f"), nil)
+	batch.seqNum = 42
+
+	decoded, err := DecodeWriteBatch(batch.Encode())
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(42), decoded.seqNum)
+	assert.Equal(t, operationStrings(batch), operationStrings(decoded))
+	assert.Equal(t, batch.Encode(), decoded.Encode())
+
+	empty, err := DecodeWriteBatch(NewWriteBatch().Encode())
+	assert.NoError(t, err)
+	assert.Zero(t, empty.Count())
+}
+
+func TestDecodeWriteBatchRefusesMalformedInput(t *testing.T) {
+	batch := NewWriteBatch()
+	batch.Put([]byte("key"), []byte("value"))
+	batch.DeleteRange([]byte("a"), []byte("b"))
+	encoded := batch.Encode()
+
+	header := binary.LittleEndian.AppendUint64(nil, 1)
+	inputs := map[string][]byte{
+		"trailing bytes":     append(append([]byte(nil), encoded...), 0),
+		"unknown operation":  append(binary.AppendUvarint(append([]byte(nil), header...), 1), 9, 0, 0),
+		"huge key length":    append(binary.AppendUvarint(append([]byte(nil), header...), 1), byte(batchPut), 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01),
+		"overflowing length": append(binary.AppendUvarint(append([]byte(nil), header...), 1), byte(batchPut), 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01),
+		"more than counted":  binary.AppendUvarint(append([]byte(nil), header...), 1<<40),
+	}
+
+	// every cut of a valid batch is missing something
+	for i := 0; i < len(encoded); i++ {
+		inputs[fmt.Sprintf("cut at %d", i)] = encoded[:i]
+	}
+
+	for name, input := range inputs {
+		_, err := DecodeWriteBatch(input)
+
+		if assert.Error(t, err, name) {
+			assert.Equal(t, types.WRITE_BATCH_DECODE_ERROR, err.(*types.EngineError).GetErrorCode(), name)
+		}
+	}
+}
+
+func TestDeleteRangeExpandsToTheCoveredKeys(t *testing.T) {
+	stored := []string{"a", "b1", "b3", "c"}
+	scan := func(start, end []byte, limit int) ([]types.Record, error) {
+		var records []types.Record
+		for _, key := range stored {
+			if key >= string(start) && (end == nil || key < string(end)) {
+				records = append(records, types.NewRecord([]byte(key), []byte("v"), false))
+			}
+		}
+
+		return records, nil
+	}
+
+	batch := NewWriteBatch()
+	batch.Put([]byte("b2"), []byte("earlier"))
+	batch.Put([]byte("c1"), []byte("outside"))
+	batch.DeleteRange([]byte("b"), []byte("c"))
+	batch.Put([]byte("b4"), []byte("later"))
+	batch.DeleteRange([]byte("c"), nil)
+
+	expanded, err := batch.expandRangeDeletes(scan)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"put b2 earlier",
+		"put c1 outside",
+		"delete b1",
+		"delete b3",
+		"delete b2",
+		"put b4 later",
+		"delete c",
+		"delete c1",
+	}, operationStrings(expanded))
+}
+
+func TestDeleteRangeRefusesTooManyKeys(t *testing.T) {
+	limits := []int{}
+	scan := func(start, end []byte, limit int) ([]types.Record, error) {
+		limits = append(limits, limit)
+
+		records := make([]types.Record, min(limit, MaxRangeDeleteKeys/2+1))
+		for i := range records {
+			records[i] = types.NewRecord([]byte(fmt.Sprintf("%s%06d", start, i)), nil, false)
+		}
+
+		return records, nil
+	}
+
+	batch := NewWriteBatch()
+	batch.DeleteRange([]byte("a"), []byte("b"))
+	_, err := batch.expandRangeDeletes(scan)
+	assert.NoError(t, err)
+
+	// two halves are over the cap together, and the second scan stops right
+	// past it
+	batch.DeleteRange([]byte("b"), []byte("c"))
+	limits = nil
+	_, err = batch.expandRangeDeletes(scan)
+
+	if assert.Error(t, err) {
+		assert.Equal(t, types.WRITE_BATCH_TOO_LARGE_ERROR, err.(*types.EngineError).GetErrorCode())
+	}
+	assert.Equal(t, []int{MaxRangeDeleteKeys + 1, MaxRangeDeleteKeys - (MaxRangeDeleteKeys/2 + 1) + 1}, limits)
+}
+
+func TestWriteAppliesDeleteRange(t *testing.T) {
+	engine := openTestEngine(t)
+	defer os.RemoveAll(dataDir)
+	defer engine.Close()
+
+	for _, key := range []string{"a", "b1", "b3"} {
+		put(t, engine, key, "v")
+	}
+	flushMemtable(t, engine)
+	put(t, engine, "b5", "v")
+	put(t, engine, "c", "v")
+
+	batch := NewWriteBatch()
+	batch.Put([]byte("b2"), []byte("earlier"))
+	batch.DeleteRange([]byte("b"), []byte("c"))
+	batch.Put([]byte("b4"), []byte("later"))
+	assert.NoError(t, (<-engine.Write(batch)).Err)
+
+	it := engine.NewIterator(nil)
+	defer it.Close()
+
+	it.SeekToFirst()
+	assert.Equal(t, []string{"a=v", "b4=later", "c=v"}, keyValues(it, true))
+
+	// the tombstones of the range outlive a flush and a reopen
+	flushMemtable(t, engine)
+	assert.NoError(t, engine.Close())
+
+	se, err := Open(dataDir)
+	assert.NoError(t, err)
+	engine = se.(*storageEngine)
+
+	result := <-engine.Scan(nil, nil, 0)
+	assert.NoError(t, result.Err)
+	assert.Len(t, result.Records, 3)
+}
+
+func TestWriteRefusesDeleteRangeOverTheCap(t *testing.T) {
+	engine := openTestEngine(t)
+	defer os.RemoveAll(dataDir)
+	defer engine.Close()
+
+	fill := NewWriteBatch()
+	for i := 0; i <= MaxRangeDeleteKeys; i++ {
+		fill.Put([]byte(fmt.Sprintf("k%05d", i)), []byte("v"))
+	}
+	assert.NoError(t, (<-engine.Write(fill)).Err)
+
+	// one key over the cap fails the whole batch, its put included
+	batch := NewWriteBatch()
+	batch.Put([]byte("a"), []byte("v"))
+	batch.DeleteRange([]byte("k"), nil)
+
+	err := (<-engine.Write(batch)).Err
+	if assert.Error(t, err) {
+		assert.Equal(t, types.WRITE_BATCH_TOO_LARGE_ERROR, err.(*types.EngineError).GetErrorCode())
+	}
+
+	result := <-engine.Scan(nil, nil, 0)
+	assert.NoError(t, result.Err)
+	assert.Len(t, result.Records, MaxRangeDeleteKeys+1)
+	assert.Equal(t, "k00000", string(result.Records[0].Key))
+
+	// a range of exactly the cap is deleted
+	batch = NewWriteBatch()
+	batch.DeleteRange([]byte("k"), []byte(fmt.Sprintf("k%05d", MaxRangeDeleteKeys)))
+	assert.NoError(t, (<-engine.Write(batch)).Err)
+
+	result = <-engine.Scan(nil, nil, 0)
+	assert.NoError(t, result.Err)
+	if assert.Len(t, result.Records, 1) {
+		assert.Equal(t, fmt.Sprintf("k%05d", MaxRangeDeleteKeys), string(result.Records[0].Key))
+	}
+}
+
+func TestWriteIsVisibleAtomically(t *testing.T) {
+	engine := openTestEngine(t, WithMemTableSize(64))
+	defer os.RemoveAll(dataDir)
+	defer engine.Close()
+
+	keys := []string{"a", "b", "c", "d", "e"}
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+
+		for i := 1; i <= 200; i++ {
+			batch := NewWriteBatch()
+			for _, key := range keys {
+				batch.Put([]byte(key), []byte(fmt.Sprintf("%04d", i)))
+			}
+
+			assert.NoError(t, (<-engine.Write(batch)).Err)
+		}
+	}()
+
+	// a reader sees every key of a batch or none of them
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+
+		result := <-engine.Scan(nil, nil, 0)
+		if !assert.NoError(t, result.Err) {
+			break
+		}
+
+		if len(result.Records) == 0 {
+			continue
+		}
+
+		assert.Len(t, result.Records, len(keys))
+		for _, record := range result.Records {
+			assert.Equal(t, result.Records[0].Value, record.Value, string(record.Key))
+		}
+	}
+
+	wg.Wait()
+}
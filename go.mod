@@ -2,13 +2,15 @@ module LsmStorageEngine
 
 go 1.24.3
 
-require golang.org/x/exp v0.0.0-20250531010427-b6e5de432a8b
+require (
+	github.com/google/uuid v1.6.0
+	github.com/spaolacci/murmur3 v1.1.0
+	github.com/stretchr/testify v1.10.0
+	golang.org/x/exp v0.0.0-20250531010427-b6e5de432a8b
+)
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/google/uuid v1.6.0 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/spaolacci/murmur3 v1.1.0 // indirect
-	github.com/stretchr/testify v1.10.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
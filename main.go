@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 
 	"LsmStorageEngine/engine"
@@ -11,10 +12,16 @@ import (
 )
 
 func main() {
-	se := engine.CreateNewEngine()
+	se, err := engine.CreateNewEngine()
+	if err != nil {
+		fmt.Println("Error starting engine:", err)
+		os.Exit(1)
+	}
+	defer se.Close()
+
 	reader := bufio.NewReader(os.Stdin)
 	fmt.Println("LSM Storage Engine CLI")
-	fmt.Println("Commands: get <key>, put <key> <value>, delete <key>, exit")
+	fmt.Println("Commands: get <key>, put <key> <value>, delete <key>, scan <start> <end> [limit], prefix <prefix> [limit], exit")
 
 	for {
 		fmt.Print("> ")
@@ -39,7 +46,7 @@ func main() {
 				continue
 			}
 			key := []byte(args[1])
-			ch := se.Get(key)
+			ch := se.Get(key, nil)
 			res := <-ch
 			if res.Err != nil {
 				fmt.Println("Error:", res.Err)
@@ -76,9 +83,59 @@ func main() {
 			} else {
 				fmt.Printf("Deleted Key: %s\n", args[1])
 			}
+		case "scan":
+			if len(args) != 3 && len(args) != 4 {
+				fmt.Println("Usage: scan <start> <end> [limit]")
+				continue
+			}
+			limit, ok := parseLimit(args, 3)
+			if !ok {
+				fmt.Println("Usage: scan <start> <end> [limit]")
+				continue
+			}
+			ch := se.Scan([]byte(args[1]), []byte(args[2]), limit)
+			printScanResult(<-ch)
+		case "prefix":
+			if len(args) != 2 && len(args) != 3 {
+				fmt.Println("Usage: prefix <prefix> [limit]")
+				continue
+			}
+			limit, ok := parseLimit(args, 2)
+			if !ok {
+				fmt.Println("Usage: prefix <prefix> [limit]")
+				continue
+			}
+			ch := se.ScanPrefix([]byte(args[1]), limit)
+			printScanResult(<-ch)
 		default:
 			fmt.Println("Unknown command")
 		}
 	}
 	fmt.Println("Exiting CLI.")
 }
+
+// the optional limit argument at index, no limit when it is absent
+func parseLimit(args []string, index int) (int, bool) {
+	if len(args) <= index {
+		return 0, true
+	}
+
+	limit, err := strconv.Atoi(args[index])
+	if err != nil || limit < 0 {
+		return 0, false
+	}
+
+	return limit, true
+}
+
+func printScanResult(res engine.ScanResult) {
+	if res.Err != nil {
+		fmt.Println("Error:", res.Err)
+		return
+	}
+
+	for _, record := range res.Records {
+		fmt.Printf("Key: %s, Value: %s\n", string(record.Key), string(record.Value))
+	}
+	fmt.Printf("(%d records)\n", len(res.Records))
+}
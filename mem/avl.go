@@ -11,16 +11,20 @@ type node struct {
 	value     []byte
 	height    int
 	tombStone bool
+	seqNum    uint64
+	// versions the newest one replaced, newest first
+	older     []types.Record
 	leftNode  *node
 	rightNode *node
 }
 
-func newNode(key []byte, value []byte, tombStone bool) *node {
+func newNode(key []byte, value []byte, tombStone bool, seqNum uint64) *node {
 	return &node{
 		key:       key,
 		value:     value,
 		height:    1,
 		tombStone: tombStone,
+		seqNum:    seqNum,
 		leftNode:  nil,
 		rightNode: nil,
 	}
@@ -98,15 +102,19 @@ func (t *AvlTree) getSize(rootNode *node) int {
 		int(unsafe.Sizeof(rootNode.height)) +
 			int(unsafe.Sizeof(rootNode.leftNode)) +
 			int(unsafe.Sizeof(rootNode.rightNode)) +
-			int(unsafe.Sizeof(rootNode.tombStone))
+			int(unsafe.Sizeof(rootNode.tombStone)) +
+			int(unsafe.Sizeof(rootNode.seqNum))
 
 	size := keyValuesize + structuralInformationSize
+	for _, version := range rootNode.older {
+		size += version.GetSize()
+	}
 
 	return size + t.getSize(rootNode.leftNode) + t.getSize(rootNode.rightNode)
 }
 
 func (t *AvlTree) InsertRecord(r types.Record) {
-	t.Insert(r.Key, r.Value, r.TombStone)
+	t.Insert(r.Key, r.Value, r.TombStone, r.SeqNum)
 }
 
 func (t *AvlTree) Clear() {
@@ -114,12 +122,12 @@ func (t *AvlTree) Clear() {
 	t.height = 0
 }
 
-func (t *AvlTree) Insert(key []byte, value []byte, tombStone bool) {
+func (t *AvlTree) Insert(key []byte, value []byte, tombStone bool, seqNum uint64) {
 	if t.rootNode == nil {
-		t.rootNode = newNode(key, value, tombStone)
+		t.rootNode = newNode(key, value, tombStone, seqNum)
 		t.height = t.rootNode.height
 	} else {
-		t.rootNode = t.insert(newNode(key, value, tombStone), t.rootNode)
+		t.rootNode = t.insert(newNode(key, value, tombStone, seqNum), t.rootNode)
 		t.height = t.rootNode.height
 	}
 }
@@ -160,9 +168,15 @@ func (t *AvlTree) insert(n *node, current *node) *node {
 	}
 
 	if bytes.Equal(current.key, n.key) {
+		// the replaced version stays readable for snapshots
+		current.older = append([]types.Record{
+			types.NewRecordWithSeqNum(current.key, current.value, current.tombStone, current.seqNum),
+		}, current.older...)
+
 		current.key = n.key
 		current.value = n.value
 		current.tombStone = n.tombStone
+		current.seqNum = n.seqNum
 
 		return current
 	}
@@ -228,6 +242,9 @@ func (t *AvlTree) delete(key []byte, current *node) *node {
 				temp := current.rightNode.getInOrder()
 				current.key = temp.key
 				current.value = temp.value
+				current.tombStone = temp.tombStone
+				current.seqNum = temp.seqNum
+				current.older = temp.older
 
 				current.rightNode = t.delete(temp.key, current.rightNode)
 			}
@@ -263,13 +280,13 @@ func (t *AvlTree) delete(key []byte, current *node) *node {
 
 func (t *AvlTree) Search(key []byte) (types.Record, error) {
 	if t.rootNode != nil {
-		if value, tombstone := t.search(key, t.rootNode); value == nil {
+		if n := t.search(key, t.rootNode); n == nil {
 			return types.Record{}, &AvlTreeError{
 				errCode: AVL_KEY_DOES_NOT_EXIST,
 				msg:     "key does not exist in avl tree",
 			}
 		} else {
-			return types.NewRecord(key, value, tombstone), nil
+			return types.NewRecordWithSeqNum(key, n.value, n.tombStone, n.seqNum), nil
 		}
 	}
 
@@ -279,13 +296,35 @@ func (t *AvlTree) Search(key []byte) (types.Record, error) {
 	}
 }
 
-func (t *AvlTree) search(key []byte, root *node) ([]byte, bool) {
+// the newest version of key with a sequence number of at most seqNum
+func (t *AvlTree) SearchAt(key []byte, seqNum uint64) (types.Record, error) {
+	n := t.search(key, t.rootNode)
+
+	if n != nil {
+		if n.seqNum <= seqNum {
+			return types.NewRecordWithSeqNum(key, n.value, n.tombStone, n.seqNum), nil
+		}
+
+		for _, version := range n.older {
+			if version.SeqNum <= seqNum {
+				return version, nil
+			}
+		}
+	}
+
+	return types.Record{}, &AvlTreeError{
+		errCode: AVL_KEY_DOES_NOT_EXIST,
+		msg:     "key does not exist in avl tree",
+	}
+}
+
+func (t *AvlTree) search(key []byte, root *node) *node {
 	if root == nil {
-		return nil, false
+		return nil
 	}
 
 	if bytes.Equal(root.key, key) {
-		return root.value, root.tombStone
+		return root
 	}
 
 	if bytes.Compare(key, root.key) == 1 {
@@ -315,8 +354,9 @@ func (t *AvlTree) getAll(n *node, buffer *[]types.Record) {
 
 	t.getAll(n.leftNode, buffer)
 
-	record := types.NewRecord(n.key, n.value, n.tombStone)
+	record := types.NewRecordWithSeqNum(n.key, n.value, n.tombStone, n.seqNum)
 	*buffer = append(*buffer, record)
+	*buffer = append(*buffer, n.older...)
 
 	t.getAll(n.rightNode, buffer)
 }
@@ -23,79 +23,58 @@ func NewMemtable(memTableSize int) *Memtable {
 	}
 }
 
-func (m *Memtable) Put(r types.Record, dm *disk.DiskManager) error {
+func (m *Memtable) Put(records ...types.Record) {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
-	m.avl.InsertRecord(r)
+	for _, record := range records {
+		m.avl.InsertRecord(record)
+	}
+}
 
-	if m.avl.GetSize() >= m.memtableSize {
-		err := dm.Flush(m.avl.GetAll())
+func (m *Memtable) Delete(key []byte) {
+	m.Put(types.NewRecord(key, nil, true))
+}
 
-		if err != nil {
-			return err
-		} else {
-			m.avl.Clear()
-			return nil
-		}
-	}
+func (m *Memtable) IsFull() bool {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
 
-	return nil
+	return m.avl.GetSize() >= m.memtableSize
 }
 
-func (m *Memtable) Delete(key []byte, dm *disk.DiskManager) error {
+// writes the memtable out as a new table and empties it, logNumber is the
+// first wal segment holding writes that are not part of this memtable.
+// readers keep finding the records here until the table holding them is in
+// place, so the memtable must not take writes during the flush
+func (m *Memtable) Flush(dm *disk.DiskManager, logNumber int) error {
+	records := m.GetAll()
+
+	if len(records) == 0 {
+		return nil
+	}
+
+	if err := dm.Flush(records, logNumber); err != nil {
+		return err
+	}
+
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
-	record, err := m.avl.Search(key)
-
-	if err != nil {
-		if status, ok := err.(*types.EngineError); ok {
-			if status.GetErrorCode() == AVL_KEY_DOES_NOT_EXIST {
-				record, err = dm.Get(key)
-
-				if err == nil {
-					record.TombStone = true
-					m.Put(record, dm)
-
-					return nil
-				} else {
-					return err
-				}
-			} else {
-				return status
-			}
-		}
-	} else {
-		if !record.TombStone {
-			m.avl.Insert(record.Key, record.Value, true)
-		}
-	}
+	m.avl.Clear()
 
 	return nil
 }
 
-func (m *Memtable) Get(key []byte, dm *disk.DiskManager) (types.Record, error) {
+// the newest version of key visible at sequence number seqNum, if the
+// memtable holds one
+func (m *Memtable) Get(key []byte, seqNum uint64) (types.Record, bool) {
 	m.mtx.RLock()
 	defer m.mtx.RUnlock()
 
-	record, err := m.avl.Search(key)
-
-	if err != nil {
-		if status, ok := err.(*types.EngineError); ok {
-			if status.GetErrorCode() == AVL_KEY_DOES_NOT_EXIST {
-				record, err = dm.Get(key)
-
-				if err != nil {
-					return types.Record{}, err
-				} else {
-					return record, nil
-				}
-			}
-		}
-	}
+	record, err := m.avl.SearchAt(key, seqNum)
 
-	return record, nil
+	return record, err == nil
 }
 
 func (m *Memtable) GetAll() []types.Record {
@@ -43,26 +43,26 @@ func NewBitSetVectorFromFile(file *os.File, length int) (BitVector, error) {
 }
 
 func (b *BitVector) Set(index int) error {
-	if index > b.length {
+	if index >= b.length*8 {
 		return NewEngineError(
 			BIT_VECTOR_OUT_OF_BOUNDS,
-			fmt.Sprintf("index %d is beyond bounds %d", index, b.length),
+			fmt.Sprintf("index %d is beyond bounds %d", index, b.length*8),
 		)
 	}
 
 	pos := index / 8
 	i := index % 8
 
-	b.vector[pos] = b.vector[pos] ^ (1 << i)
+	b.vector[pos] = b.vector[pos] | (1 << i)
 
 	return nil
 }
 
 func (b *BitVector) IsSet(index int) (bool, error) {
-	if index > b.length {
+	if index >= b.length*8 {
 		return false, NewEngineError(
 			BIT_VECTOR_OUT_OF_BOUNDS,
-			fmt.Sprintf("index %d is beyond bounds %d", index, b.length),
+			fmt.Sprintf("index %d is beyond bounds %d", index, b.length*8),
 		)
 	}
 
@@ -17,6 +17,26 @@ const (
 	BIT_VECTOR_SEARCH_ERROR             = 13
 	TABLE_FILE_DELETE_ERROR             = 14
 	DISKMANAGER_KEY_NOT_FOUND_ERROR     = 15
+	DISKMANAGER_INCONSISTENT_DIR_ERROR  = 21
+	TABLE_FORMAT_ERROR                  = 26
+	TABLE_BLOCK_DECOMPRESSION_ERROR     = 27
+	TABLE_CORRUPTION_ERROR              = 28
+
+	// Write Ahead Log Errors
+	WAL_FILE_OPEN_ERROR        = 16
+	WAL_WRITE_ERROR            = 17
+	WAL_READ_ERROR             = 18
+	WAL_RECORD_CORRUPTED_ERROR = 19
+	WAL_FILE_DELETE_ERROR      = 20
+
+	// Manifest Errors
+	MANIFEST_READ_ERROR   = 22
+	MANIFEST_WRITE_ERROR  = 23
+	MANIFEST_DECODE_ERROR = 24
+
+	// Write Batch Errors
+	WRITE_BATCH_DECODE_ERROR    = 25
+	WRITE_BATCH_TOO_LARGE_ERROR = 29
 )
 
 type EngineError struct {
@@ -14,6 +14,8 @@ type Record struct {
 	Key       []byte
 	Value     []byte
 	TombStone bool
+	// sequence number of the write that produced this version, higher is newer
+	SeqNum uint64
 }
 
 func NewRecord(key []byte, value []byte, tombStone bool) Record {
@@ -21,11 +23,44 @@ func NewRecord(key []byte, value []byte, tombStone bool) Record {
 		Key: key, Value: value, TombStone: tombStone,
 	}
 }
+
+func NewRecordWithSeqNum(key []byte, value []byte, tombStone bool, seqNum uint64) Record {
+	return Record{
+		Key: key, Value: value, TombStone: tombStone, SeqNum: seqNum,
+	}
+}
+
 func (e *Record) GetSize() int {
-	return len(e.Key) + len(e.Value) + int(unsafe.Sizeof(0)*2)
+	return len(e.Key) + len(e.Value) + int(unsafe.Sizeof(0)*2) + int(unsafe.Sizeof(e.SeqNum))
+}
+
+// orders versions by key and puts the newest version of a key first
+func CompareVersions(a, b Record) int {
+	if compare := bytes.Compare(a.Key, b.Key); compare != 0 {
+		return compare
+	}
+
+	switch {
+	case a.SeqNum > b.SeqNum:
+		return -1
+	case a.SeqNum < b.SeqNum:
+		return 1
+	}
+
+	return 0
 }
 
 func DecodeRecordsFromBuffer(bufferReader *bytes.Reader) ([]Record, error) {
+	return decodeRecords(bufferReader, true)
+}
+
+// records written before they carried a sequence number, every one of them
+// gets sequence number 0
+func DecodeUnsequencedRecordsFromBuffer(bufferReader *bytes.Reader) ([]Record, error) {
+	return decodeRecords(bufferReader, false)
+}
+
+func decodeRecords(bufferReader *bytes.Reader, sequenced bool) ([]Record, error) {
 	read := func(reader *bytes.Reader, len int) ([]byte, error) {
 		buff := make([]byte, len)
 		_, err := reader.Read(buff)
@@ -79,11 +114,23 @@ func DecodeRecordsFromBuffer(bufferReader *bytes.Reader) ([]Record, error) {
 		}
 
 		var tombStone bool = false
-		if t[0] == '1' {
+		if t[0] == 1 {
 			tombStone = true
 		}
 
-		records = append(records, NewRecord(key, value, tombStone))
+		if !sequenced {
+			records = append(records, NewRecord(key, value, tombStone))
+			continue
+		}
+
+		s, err = read(bufferReader, 8)
+		if s == nil && err == nil {
+			break
+		} else if err != nil {
+			return nil, NewEngineError(BUFFER_READ_ERROR, err.Error())
+		}
+
+		records = append(records, NewRecordWithSeqNum(key, value, tombStone, binary.LittleEndian.Uint64(s)))
 	}
 
 	return records, nil
@@ -145,11 +192,20 @@ func DecocodeRecordFromFile(fd *os.File) (Record, error) {
 	}
 
 	tombStone := false
-	if tombStoneBuffer[0] == '1' {
+	if tombStoneBuffer[0] == 1 {
 		tombStone = true
 	}
 
-	return NewRecord(keyBuffer, valBuffer, tombStone), nil
+	_, err = fd.Read(sizeBuf)
+
+	if err != nil {
+		return Record{}, NewEngineError(
+			TABLE_KEY_FILE_SEEK_ERR,
+			fmt.Sprintf("sequence number read file err : %s", err.Error()),
+		)
+	}
+
+	return NewRecordWithSeqNum(keyBuffer, valBuffer, tombStone, binary.LittleEndian.Uint64(sizeBuf)), nil
 }
 
 type Element struct {
@@ -171,9 +227,12 @@ func (h *ElementHeap) Len() int {
 	return len(*h)
 }
 
+// orders by key and, for equal keys, puts the newest version first. the
+// source index only breaks ties between records without sequence numbers.
 func (h *ElementHeap) Less(i, j int) bool {
-	return bytes.Compare((*h)[i].Entry.Key, (*h)[j].Entry.Key) == -1 && (*h)[i].Index == (*h)[j].Index ||
-		bytes.Equal((*h)[i].Entry.Key, (*h)[j].Entry.Key) && (*h)[i].Index < (*h)[j].Index
+	compare := CompareVersions((*h)[i].Entry, (*h)[j].Entry)
+
+	return compare == -1 || compare == 0 && (*h)[i].Index < (*h)[j].Index
 }
 
 func (h ElementHeap) Swap(i, j int) {